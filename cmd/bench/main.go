@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+const usage = `usage: bench [flags] <database>
+
+runs a mix of gets, sets, deletes and scans against the database and reports
+the throughput, the latency percentiles of each operation, the pages written
+per logical write (write amplification) and the fsyncs
+
+the keys are key0000000000 to the size of the key space, a new database is
+loaded with all of them first, encrypted databases need DB_KEY like dbtool
+
+flags:
+`
+
+// the operations of a workload
+const (
+	OP_GET = iota
+	OP_SET
+	OP_DEL
+	OP_SCAN
+	OP_COUNT
+)
+
+var opNames = [OP_COUNT]string{"get", "set", "del", "scan"}
+
+type config struct {
+	ops      int
+	clients  int
+	keys     int
+	dist     string
+	zipf     float64
+	reads    int
+	dels     int
+	scans    int
+	scanLen  int
+	batch    int
+	valSize  int
+	cache    int
+	compress int
+	seed     int64
+}
+
+func main() {
+	cfg := config{}
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.IntVar(&cfg.ops, "ops", 100000, "operations to run, a batch of writes counts as one")
+	fs.IntVar(&cfg.clients, "clients", 1, "goroutines running operations, writes are serialized by the database")
+	fs.IntVar(&cfg.keys, "keys", 100000, "size of the key space")
+	fs.StringVar(&cfg.dist, "dist", "random", "key distribution: seq, random or zipf")
+	fs.Float64Var(&cfg.zipf, "zipf", 1.1, "exponent of the zipf distribution, greater than 1")
+	fs.IntVar(&cfg.reads, "reads", 50, "percentage of gets")
+	fs.IntVar(&cfg.dels, "dels", 0, "percentage of deletes")
+	fs.IntVar(&cfg.scans, "scans", 0, "percentage of scans, the rest of the operations are sets")
+	fs.IntVar(&cfg.scanLen, "scan-len", 100, "keys read by a scan")
+	fs.IntVar(&cfg.batch, "batch", 1, "writes committed together in a transaction")
+	fs.IntVar(&cfg.valSize, "val-size", 100, "bytes of the values")
+	fs.IntVar(&cfg.cache, "cache-pages", 0, "read through a page cache of this many pages instead of mmap")
+	fs.IntVar(&cfg.compress, "compress", 0, "compress values of at least this many bytes, 0 disables it")
+	fs.Int64Var(&cfg.seed, "seed", 1, "seed of the key generators")
+	fs.Parse(os.Args[1:])
+
+	if err := run(fs, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(fs *flag.FlagSet, cfg config) error {
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one database path, got %d arguments", fs.NArg())
+	}
+	if cfg.reads+cfg.dels+cfg.scans > 100 || cfg.reads < 0 || cfg.dels < 0 || cfg.scans < 0 {
+		return fmt.Errorf("the percentages of gets, deletes and scans add up to more than 100")
+	}
+	if cfg.dist != "seq" && cfg.dist != "random" && cfg.dist != "zipf" {
+		return fmt.Errorf("unknown distribution %q", cfg.dist)
+	}
+	if cfg.dist == "zipf" && cfg.zipf <= 1 {
+		return fmt.Errorf("the zipf exponent must be greater than 1")
+	}
+	if cfg.keys < 1 || cfg.clients < 1 || cfg.batch < 1 {
+		return fmt.Errorf("-keys, -clients and -batch must be at least 1")
+	}
+
+	db := &btree.KV{Path: fs.Arg(0), CachePages: cfg.cache, CompressMin: cfg.compress, SweepInterval: -1}
+	if key := os.Getenv("DB_KEY"); key != "" {
+		var err error
+		if db.Key, err = hex.DecodeString(key); err != nil {
+			return fmt.Errorf("DB_KEY: %w", err)
+		}
+	}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	val := bytes.Repeat([]byte("v"), cfg.valSize)
+	if db.Count(nil, nil) == 0 {
+		start := time.Now()
+		n, err := db.BulkLoad(func(yield func([]byte, []byte) bool) {
+			for i := 0; i < cfg.keys && yield(key(i), val); i++ {
+			}
+		}, 0)
+		if err != nil {
+			return fmt.Errorf("load: %w", err)
+		}
+		fmt.Printf("loaded %d keys in %v\n", n, time.Since(start).Round(time.Millisecond))
+	}
+
+	before, err := db.Stats()
+	if err != nil {
+		return err
+	}
+
+	results := make([]result, cfg.clients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for c := range results {
+		ops := cfg.ops / cfg.clients
+		if c < cfg.ops%cfg.clients {
+			ops++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[c], results[c].err = runClient(db, cfg, ops, cfg.seed+int64(c), val)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := result{}
+	for _, r := range results {
+		if r.err != nil {
+			return r.err
+		}
+		total.merge(r)
+	}
+	after, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	report(cfg, total, elapsed, before, after)
+	return nil
+}
+
+// what a client did, latencies are per operation (per transaction for batched writes)
+type result struct {
+	latencies [OP_COUNT][]time.Duration
+	writes    int // logical writes, a batch counts each of its keys
+	err       error
+}
+
+func (r *result) merge(other result) {
+	for op := range r.latencies {
+		r.latencies[op] = append(r.latencies[op], other.latencies[op]...)
+	}
+	r.writes += other.writes
+}
+
+func runClient(db *btree.KV, cfg config, ops int, seed int64, val []byte) (result, error) {
+	rng := rand.New(rand.NewSource(seed))
+	next := keyGen(cfg, rng)
+	r := result{}
+
+	for i := 0; i < ops; i++ {
+		op := OP_SET
+		switch p := rng.Intn(100); {
+		case p < cfg.reads:
+			op = OP_GET
+		case p < cfg.reads+cfg.dels:
+			op = OP_DEL
+		case p < cfg.reads+cfg.dels+cfg.scans:
+			op = OP_SCAN
+		}
+
+		start := time.Now()
+		var err error
+		switch op {
+		case OP_GET:
+			db.Get(key(next()))
+		case OP_SCAN:
+			n := 0
+			db.Scan(key(next()), nil, func(k, v []byte) bool {
+				n++
+				return n < cfg.scanLen
+			})
+		case OP_SET, OP_DEL:
+			err = write(db, cfg, op, next, val)
+			r.writes += cfg.batch
+		}
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", opNames[op], err)
+		}
+		r.latencies[op] = append(r.latencies[op], time.Since(start))
+	}
+	return r, nil
+}
+
+// one write, or a transaction of -batch writes
+func write(db *btree.KV, cfg config, op int, next func() int, val []byte) error {
+	if cfg.batch == 1 {
+		if op == OP_DEL {
+			_, err := db.Del(key(next()))
+			return err
+		}
+		return db.Set(key(next()), val)
+	}
+	return db.Update(func(tx *btree.Tx) error {
+		for i := 0; i < cfg.batch; i++ {
+			if op == OP_DEL {
+				tx.Del(key(next()))
+			} else if err := tx.Set(key(next()), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%010d", i))
+}
+
+// indexes of keys in the order of the distribution
+// the zipfian hot keys are spread over the key space instead of being neighbours
+func keyGen(cfg config, rng *rand.Rand) func() int {
+	n := cfg.keys
+	switch cfg.dist {
+	case "seq":
+		i := rng.Intn(n) - 1 // clients start at different keys
+		return func() int {
+			i = (i + 1) % n
+			return i
+		}
+	case "zipf":
+		zipf := rand.NewZipf(rng, cfg.zipf, 1, uint64(n-1))
+		return func() int { return int(zipf.Uint64() * 2654435761 % uint64(n)) }
+	}
+	return func() int { return rng.Intn(n) }
+}
+
+func report(cfg config, r result, elapsed time.Duration, before, after btree.Stats) {
+	ops := 0
+	for _, lat := range r.latencies {
+		ops += len(lat)
+	}
+	fmt.Printf("%d operations in %v, %.0f ops/s, %d clients\n", ops, elapsed.Round(time.Millisecond), float64(ops)/elapsed.Seconds(), cfg.clients)
+
+	fmt.Printf("\n%-5s %9s %10s %10s %10s %10s %10s\n", "op", "count", "p50", "p90", "p99", "p99.9", "max")
+	for op, lat := range r.latencies {
+		if len(lat) == 0 {
+			continue
+		}
+		slices.Sort(lat)
+		fmt.Printf("%-5s %9d %10v %10v %10v %10v %10v\n", opNames[op], len(lat),
+			percentile(lat, 50), percentile(lat, 90), percentile(lat, 99), percentile(lat, 99.9), percentile(lat, 100))
+	}
+
+	commits := after.Commits - before.Commits
+	pages := after.PagesWritten - before.PagesWritten
+	syncs := after.Syncs - before.Syncs
+	fmt.Printf("\nlogical writes:  %d\n", r.writes)
+	fmt.Printf("commits:         %d\n", commits)
+	fmt.Printf("pages written:   %d (%d MB)\n", pages, pages*btree.BTREE_PAGE_SIZE>>20)
+	fmt.Printf("fsyncs:          %d\n", syncs)
+	if r.writes > 0 {
+		fmt.Printf("write amplification: %.2f pages per write, %.2f fsyncs per write\n",
+			float64(pages)/float64(r.writes), float64(syncs)/float64(r.writes))
+	}
+	fmt.Printf("file size:       %d MB, %d keys\n", after.FileSize>>20, after.Keys)
+}
+
+// the latency below which p percent of the sorted latencies are
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(idx, 0), len(sorted)-1)].Round(time.Microsecond)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/siluk00/db.git/internal/btree"
+	"github.com/siluk00/db.git/internal/httpapi"
+)
+
+const usage = `usage: dbserver [flags] <database>
+
+serves the database over the Redis protocol (RESP2) on TCP, a Unix socket or both
+the commands are GET, SET, DEL, EXISTS, TTL, SCAN, MGET, MSET, INCR, EXPIRE,
+MULTI, EXEC, DISCARD, PING and QUIT
+
+with -http it also serves the HTTP/JSON API of internal/httpapi: /kv/{key}, /kv,
+/batch, /tx, /stats and /check
+
+with -replicate it streams its commits to followers connecting to that address, and
+with -follow it is a read-only follower of the primary at that address: it keeps its file
+a copy of the primary's and serves reads of the last commit it applied
+
+with -memory there is no database file and the keys are lost on exit
+encrypted databases need their AES key, hex encoded, in DB_KEY
+
+flags:
+`
+
+// how long the HTTP requests being run have to finish at shutdown
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+func main() {
+	fs := flag.NewFlagSet("dbserver", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", "localhost:6380", "TCP address to listen on, empty disables TCP")
+	unix := fs.String("unix", "", "path of a Unix socket to listen on")
+	httpAddr := fs.String("http", "", "TCP address of the HTTP/JSON API, empty disables it")
+	replicate := fs.String("replicate", "", "TCP address followers connect to, empty disables it")
+	follow := fs.String("follow", "", "address of the primary to follow, the database is read-only")
+	memory := fs.Bool("memory", false, "keep the database in memory")
+	cache := fs.Int("cache-pages", 0, "read through a page cache of this many pages instead of mmap")
+	compress := fs.Int("compress", 0, "compress values of at least this many bytes, 0 disables it")
+	fs.Parse(os.Args[1:])
+
+	if err := run(fs, *addr, *unix, *httpAddr, *replicate, *follow, *memory, *cache, *compress); err != nil {
+		fmt.Fprintf(os.Stderr, "dbserver: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(fs *flag.FlagSet, addr, unix, httpAddr, replicate, follow string, memory bool, cache, compress int) error {
+	if memory && fs.NArg() != 0 || !memory && fs.NArg() != 1 {
+		return fmt.Errorf("expected one database path or -memory, got %d arguments", fs.NArg())
+	}
+	if addr == "" && unix == "" && httpAddr == "" {
+		return fmt.Errorf("nothing to listen on, set -addr, -unix or -http")
+	}
+	if replicate != "" && follow != "" {
+		return fmt.Errorf("-replicate and -follow can't be combined")
+	}
+
+	db := &btree.KV{Path: fs.Arg(0), InMemory: memory, CachePages: cache, CompressMin: compress, Follower: follow != ""}
+	if replicate != "" {
+		db.ReplicationLog = REPLICATION_LOG
+	}
+	if key := os.Getenv("DB_KEY"); key != "" {
+		var err error
+		if db.Key, err = hex.DecodeString(key); err != nil {
+			return fmt.Errorf("DB_KEY: %w", err)
+		}
+	}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	listeners := []net.Listener{}
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	if addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	if unix != "" {
+		// a socket left by a server that didn't exit cleanly
+		if err := os.Remove(unix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		ln, err := net.Listen("unix", unix)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	var httpLn, replLn net.Listener
+	if httpAddr != "" {
+		var err error
+		if httpLn, err = net.Listen("tcp", httpAddr); err != nil {
+			return err
+		}
+	}
+	if replicate != "" {
+		var err error
+		if replLn, err = net.Listen("tcp", replicate); err != nil {
+			return err
+		}
+		listeners = append(listeners, replLn)
+	}
+
+	srv := newServer(db)
+	repl := newReplicas(db)
+	errs := make(chan error, len(listeners)+1)
+	for _, ln := range listeners {
+		if ln == replLn {
+			log.Printf("serving followers on %s", ln.Addr())
+			go func() { errs <- repl.serve(ln) }()
+			continue
+		}
+		log.Printf("listening on %s %s", ln.Addr().Network(), ln.Addr())
+		go func() { errs <- srv.serve(ln) }()
+	}
+	if follow != "" {
+		go repl.follow(follow)
+	}
+	httpSrv := &http.Server{Handler: httpapi.NewHandler(db)}
+	if httpLn != nil {
+		log.Printf("serving HTTP on %s", httpLn.Addr())
+		go func() {
+			if err := httpSrv.Serve(httpLn); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var err error
+	select {
+	case sig := <-signals:
+		log.Printf("%v, shutting down", sig)
+	case err = <-errs:
+	}
+	// the commands and requests being run finish before the database is closed
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		log.Printf("http shutdown: %v", err)
+		httpSrv.Close()
+	}
+	srv.close()
+	repl.close()
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+// a primary keeps this many commits for followers that reconnect, see btree.KV.ReplicationLog
+const REPLICATION_LOG = 4096
+
+// how long a follower waits before dialing its primary again
+const FOLLOW_RETRY = time.Second
+
+// the followers connected to a primary, or the connection of a follower to its primary
+type replicas struct {
+	db *btree.KV
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func newReplicas(db *btree.KV) *replicas {
+	return &replicas{db: db, conns: map[net.Conn]bool{}}
+}
+
+// tracks conn until it's closed, false once close was called
+func (r *replicas) add(conn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		conn.Close()
+		return false
+	}
+	r.conns[conn] = true
+	r.wg.Add(1)
+	return true
+}
+
+func (r *replicas) done(conn net.Conn) {
+	conn.Close()
+	r.mu.Lock()
+	delete(r.conns, conn)
+	r.mu.Unlock()
+	r.wg.Done()
+}
+
+// accepts followers until the listener is closed
+func (r *replicas) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !r.add(conn) {
+			continue
+		}
+		go func() {
+			defer r.done(conn)
+			log.Printf("follower %s connected", conn.RemoteAddr())
+			err := r.db.ServeReplica(conn)
+			log.Printf("follower %s disconnected: %v", conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// follows the primary at addr until close, dialing it again after every error
+func (r *replicas) follow(addr string) {
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil && r.add(conn) {
+			log.Printf("following %s from version %d", addr, r.db.Version())
+			err = r.db.Follow(conn)
+			status := r.db.ReplicaStatus()
+			log.Printf("stopped following %s at version %d, %d behind: %v", addr, status.Applied, status.Lag, err)
+			r.done(conn)
+		} else if err != nil {
+			log.Printf("follow %s: %v", addr, err)
+		}
+
+		r.mu.Lock()
+		closing := r.closing
+		r.mu.Unlock()
+		if closing {
+			return
+		}
+		time.Sleep(FOLLOW_RETRY)
+	}
+}
+
+// closes the connections and waits for ServeReplica and Follow to return
+func (r *replicas) close() {
+	r.mu.Lock()
+	r.closing = true
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+// RESP2, the protocol of Redis
+// requests are arrays of bulk strings, or inline commands split on spaces (what telnet sends)
+// replies are one of the types below, EXEC collects them in an array
+
+type (
+	status   string // +OK
+	errReply string // -ERR message, the message starts with the error code
+	nilBulk  struct{}
+)
+
+// other replies are int64, []byte and []any
+
+// a header can't make the server allocate more than what the arguments it read take:
+// the array grows with its arguments and no argument is longer than a value of the database
+const (
+	MAX_ARGS     = 1024 * 1024
+	MAX_BULK_LEN = btree.BTREE_MAX_VAL_SIZE
+)
+
+var errProtocol = errors.New("protocol error")
+
+// reads the next command, io.EOF when the client closed the connection between commands
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		args := [][]byte{}
+		for _, field := range strings.Fields(string(line)) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > MAX_ARGS {
+		return nil, fmt.Errorf("%w: bad array length %q", errProtocol, line[1:])
+	}
+	args := [][]byte{}
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected a bulk string, got %q", errProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > MAX_BULK_LEN {
+			return nil, fmt.Errorf("%w: bad bulk length %q, the limit is %d", errProtocol, line[1:], MAX_BULK_LEN)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string without CRLF", errProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// a line without its CRLF (or LF, for inline commands)
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", errProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// the connection closed in the middle of a command
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch r := reply.(type) {
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", r)
+	case errReply:
+		fmt.Fprintf(w, "-%s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(string(r)))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(r))
+		w.Write(r)
+		w.WriteString("\r\n")
+	case nilBulk:
+		w.WriteString("$-1\r\n")
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, item := range r {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("unknown reply %T", reply))
+	}
+}
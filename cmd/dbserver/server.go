@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+// every connection has its goroutine
+// reads go to KV directly and writes run in KV.Update, which takes the write lock of the database,
+// so a read-modify-write like INCR is atomic and MULTI/EXEC runs its queue in a single commit
+
+type server struct {
+	db      *btree.KV
+	cursors cursors
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	closing   bool
+	wg        sync.WaitGroup
+}
+
+func newServer(db *btree.KV) *server {
+	return &server{db: db, conns: map[net.Conn]bool{}}
+}
+
+// what the commands read, KV outside transactions and Tx inside them
+type reader interface {
+	Get(key []byte) ([]byte, bool)
+	TTL(key []byte) (time.Duration, bool)
+	Scan(start, end []byte, fn func(key, val []byte) bool)
+}
+
+type command struct {
+	arity int // arguments with the name, -n means at least n
+	read  func(s *server, r reader, args [][]byte) any
+	write func(s *server, tx *btree.Tx, args [][]byte) any
+}
+
+var commands = map[string]command{
+	"PING":   {arity: -1, read: cmdPing},
+	"GET":    {arity: 2, read: cmdGet},
+	"MGET":   {arity: -2, read: cmdMGet},
+	"EXISTS": {arity: -2, read: cmdExists},
+	"TTL":    {arity: 2, read: cmdTTL},
+	"SCAN":   {arity: -2, read: cmdScan},
+	"SET":    {arity: -3, write: cmdSet},
+	"MSET":   {arity: -3, write: cmdMSet},
+	"DEL":    {arity: -2, write: cmdDel},
+	"INCR":   {arity: 2, write: cmdIncr},
+	"EXPIRE": {arity: 3, write: cmdExpire},
+}
+
+var errWrongArgs = errors.New("wrong number of arguments")
+
+// the arguments match the arity of the command
+func (c command) check(name string, args [][]byte) error {
+	if c.arity >= 0 && len(args) != c.arity || c.arity < 0 && len(args) < -c.arity {
+		return fmt.Errorf("%w for '%s' command", errWrongArgs, strings.ToLower(name))
+	}
+	return nil
+}
+
+// accepts connections until the listener is closed
+func (s *server) serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// stops accepting connections, closes the open ones and waits for their commands to finish
+// the database is left open
+func (s *server) close() {
+	s.mu.Lock()
+	s.closing = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		// unblocks the reads, a command being run still writes its reply
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// the state of a connection
+type session struct {
+	queue  [][][]byte // commands after MULTI, nil outside a transaction
+	failed bool       // a queued command was rejected, EXEC will abort
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &session{}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				writeReply(w, errReply("ERR "+err.Error()))
+				w.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) && !isTimeout(err) {
+				log.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(string(args[0]))
+		if name == "QUIT" {
+			writeReply(w, status("OK"))
+			w.Flush()
+			return
+		}
+		writeReply(w, s.run(sess, name, args))
+
+		// pipelined commands are answered together
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// runs a command or queues it inside MULTI
+func (s *server) run(sess *session, name string, args [][]byte) any {
+	switch name {
+	case "MULTI":
+		if sess.queue != nil {
+			return errReply("ERR MULTI calls can not be nested")
+		}
+		sess.queue, sess.failed = [][][]byte{}, false
+		return status("OK")
+	case "DISCARD":
+		if sess.queue == nil {
+			return errReply("ERR DISCARD without MULTI")
+		}
+		sess.queue = nil
+		return status("OK")
+	case "EXEC":
+		if sess.queue == nil {
+			return errReply("ERR EXEC without MULTI")
+		}
+		queue, failed := sess.queue, sess.failed
+		sess.queue = nil
+		if failed {
+			return errReply("EXECABORT Transaction discarded because of previous errors.")
+		}
+		return s.exec(queue)
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		sess.failed = sess.queue != nil
+		return errReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if err := cmd.check(name, args); err != nil {
+		sess.failed = sess.queue != nil
+		return errReply("ERR " + err.Error())
+	}
+	if sess.queue != nil {
+		sess.queue = append(sess.queue, args)
+		return status("QUEUED")
+	}
+
+	if cmd.read != nil {
+		return cmd.read(s, s.db, args)
+	}
+	var reply any
+	err := s.db.Update(func(tx *btree.Tx) error {
+		reply = cmd.write(s, tx, args)
+		if _, failed := reply.(errReply); failed {
+			return errRollback
+		}
+		return nil
+	})
+	if err != nil && err != errRollback {
+		return errReply("ERR " + err.Error())
+	}
+	return reply
+}
+
+// a command failed, nothing it did is committed
+var errRollback = errors.New("rollback")
+
+// runs the queue of a transaction in a single commit
+// like Redis, a command that fails doesn't stop the others
+func (s *server) exec(queue [][][]byte) any {
+	replies := []any{}
+	err := s.db.Update(func(tx *btree.Tx) error {
+		replies = replies[:0]
+		for _, args := range queue {
+			cmd := commands[strings.ToUpper(string(args[0]))]
+			if cmd.read != nil {
+				replies = append(replies, cmd.read(s, tx, args))
+			} else {
+				replies = append(replies, cmd.write(s, tx, args))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errReply("ERR " + err.Error())
+	}
+	return replies
+}
+
+func cmdPing(s *server, r reader, args [][]byte) any {
+	if len(args) > 2 {
+		return errReply("ERR wrong number of arguments for 'ping' command")
+	}
+	if len(args) == 2 {
+		return args[1]
+	}
+	return status("PONG")
+}
+
+func cmdGet(s *server, r reader, args [][]byte) any {
+	val, ok := r.Get(args[1])
+	if !ok {
+		return nilBulk{}
+	}
+	// KV.Get returns a copy, the values of a Tx point into pages the commit can reuse
+	// and the replies of EXEC are written after it
+	if _, inTx := r.(*btree.Tx); inTx {
+		return bytes.Clone(val)
+	}
+	return val
+}
+
+func cmdMGet(s *server, r reader, args [][]byte) any {
+	vals := []any{}
+	for _, key := range args[1:] {
+		vals = append(vals, cmdGet(s, r, [][]byte{nil, key}))
+	}
+	return vals
+}
+
+func cmdExists(s *server, r reader, args [][]byte) any {
+	n := int64(0)
+	for _, key := range args[1:] {
+		if _, ok := r.Get(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// -2 if the key doesn't exist and -1 if it doesn't expire
+func cmdTTL(s *server, r reader, args [][]byte) any {
+	ttl, ok := r.TTL(args[1])
+	switch {
+	case !ok:
+		return int64(-2)
+	case ttl == 0:
+		return int64(-1)
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX]
+func cmdSet(s *server, tx *btree.Tx, args [][]byte) any {
+	var ttl time.Duration
+	nx, xx := false, false
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) || ttl != 0 {
+				return errReply("ERR syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 || n > math.MaxInt64/int64(time.Second) {
+				return errReply("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			return errReply("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return errReply("ERR syntax error")
+	}
+
+	if nx || xx {
+		if _, exists := tx.Get(args[1]); exists == nx {
+			return nilBulk{}
+		}
+	}
+	var err error
+	if ttl > 0 {
+		err = tx.SetWithTTL(args[1], args[2], ttl)
+	} else {
+		err = tx.Set(args[1], args[2])
+	}
+	if err != nil {
+		return errReply("ERR " + err.Error())
+	}
+	return status("OK")
+}
+
+func cmdMSet(s *server, tx *btree.Tx, args [][]byte) any {
+	if len(args)%2 == 0 {
+		return errReply("ERR wrong number of arguments for 'mset' command")
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := tx.Set(args[i], args[i+1]); err != nil {
+			return errReply("ERR " + err.Error())
+		}
+	}
+	return status("OK")
+}
+
+func cmdDel(s *server, tx *btree.Tx, args [][]byte) any {
+	n := int64(0)
+	for _, key := range args[1:] {
+		// expired keys are still in the tree
+		if _, ok := tx.Get(key); ok && tx.Del(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// the expiry of the key is kept
+func cmdIncr(s *server, tx *btree.Tx, args [][]byte) any {
+	n, err := tx.Incr(args[1], 1)
+	switch {
+	case errors.Is(err, btree.ErrNotInteger):
+		return errReply("ERR value is not an integer or out of range")
+	case errors.Is(err, btree.ErrOverflow):
+		return errReply("ERR increment or decrement would overflow")
+	case err != nil:
+		return errReply("ERR " + err.Error())
+	}
+	return n
+}
+
+// 1 if the key exists, a timeout that isn't positive deletes it
+func cmdExpire(s *server, tx *btree.Tx, args [][]byte) any {
+	secs, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil || secs > math.MaxInt64/int64(time.Second) {
+		return errReply("ERR value is not an integer or out of range")
+	}
+	val, ok := tx.Get(args[1])
+	if !ok {
+		return int64(0)
+	}
+	if secs <= 0 {
+		tx.Del(args[1])
+		return int64(1)
+	}
+	if err := tx.SetWithTTL(args[1], val, time.Duration(secs)*time.Second); err != nil {
+		return errReply("ERR " + err.Error())
+	}
+	return int64(1)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// reads count keys from the cursor and returns the ones matching the pattern
+// with the cursor of the next call, 0 when the iteration is over
+func cmdScan(s *server, r reader, args [][]byte) any {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return errReply("ERR invalid cursor")
+	}
+	start := []byte{}
+	if cursor != 0 {
+		if start, err = s.cursors.get(cursor); err != nil {
+			return errReply("ERR " + err.Error())
+		}
+	}
+
+	pattern, count := []byte("*"), 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errReply("ERR syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				return errReply("ERR syntax error")
+			}
+		default:
+			return errReply("ERR syntax error")
+		}
+	}
+
+	keys := []any{}
+	var last []byte
+	read := 0
+	r.Scan(start, nil, func(key, val []byte) bool {
+		if read == count {
+			last = bytes.Clone(key) // the page of key may be reused once Scan returns
+			return false
+		}
+		read++
+		if globMatch(pattern, key) {
+			keys = append(keys, bytes.Clone(key))
+		}
+		return true
+	})
+
+	next := uint64(0)
+	if last != nil {
+		next = s.cursors.put(last)
+	}
+	return []any{[]byte(strconv.FormatUint(next, 10)), keys}
+}
+
+// the cursors handed out by SCAN, each one is the key the next call starts from
+// clients expect numbers, so the keys stay on the server until MAX_CURSORS newer ones replace them
+type cursors struct {
+	mu    sync.Mutex
+	next  uint64
+	keys  map[uint64][]byte
+	order []uint64 // oldest first
+}
+
+const MAX_CURSORS = 4096
+
+func (c *cursors) put(key []byte) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		c.keys = map[uint64][]byte{}
+	}
+	c.next++
+	c.keys[c.next] = key
+	c.order = append(c.order, c.next)
+	if len(c.order) > MAX_CURSORS {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.next
+}
+
+func (c *cursors) get(cursor uint64) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[cursor]
+	if !ok {
+		return nil, fmt.Errorf("invalid cursor %d, it may have expired", cursor)
+	}
+	return key, nil
+}
+
+// the glob patterns of Redis: * ? [abc] [^a-z] and \ to escape
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := bytes.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			pattern = pattern[end+2:]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			found := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					found = found || class[i] <= s[0] && s[0] <= class[i+2]
+					i += 2
+				} else {
+					found = found || class[i] == s[0]
+				}
+			}
+			if found == negate {
+				return false
+			}
+			s = s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+func startServer(t *testing.T, network, addr string) (*server, string) {
+	t.Helper()
+	db := &btree.KV{InMemory: true, SweepInterval: -1}
+	require.NoError(t, db.Open())
+	ln, err := net.Listen(network, addr)
+	require.NoError(t, err)
+
+	srv := newServer(db)
+	done := make(chan error)
+	go func() { done <- srv.serve(ln) }()
+	t.Cleanup(func() {
+		srv.close()
+		assert.NoError(t, <-done)
+		db.Close()
+	})
+	return srv, ln.Addr().String()
+}
+
+// a minimal RESP client
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, network, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(args ...string) error {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// replies are decoded to string (status and bulk), error, int64, nil and []any
+func (c *client) read() (any, error) {
+	line, err := readLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch body := string(line[1:]); line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return fmt.Errorf("%s", body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := []any{}
+		for i := 0; i < n; i++ {
+			item, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown reply %q", line)
+}
+
+func (c *client) do(t *testing.T, args ...string) any {
+	t.Helper()
+	require.NoError(t, c.send(args...))
+	reply, err := c.read()
+	require.NoError(t, err)
+	return reply
+}
+
+// the message of an error reply
+func errMsg(reply any) string {
+	if err, ok := reply.(error); ok {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestServerCommands(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	assert.Equal(t, "PONG", c.do(t, "PING"))
+	assert.Equal(t, "hi", c.do(t, "ping", "hi"))
+	assert.Nil(t, c.do(t, "GET", "a"))
+	assert.Equal(t, "OK", c.do(t, "SET", "a", "1"))
+	assert.Equal(t, "1", c.do(t, "get", "a"))
+	assert.Equal(t, "OK", c.do(t, "SET", "b", ""))
+	assert.Equal(t, "", c.do(t, "GET", "b"))
+	assert.Equal(t, int64(3), c.do(t, "EXISTS", "a", "b", "c", "a"))
+
+	// NX and XX
+	assert.Nil(t, c.do(t, "SET", "a", "2", "NX"))
+	assert.Nil(t, c.do(t, "SET", "c", "2", "XX"))
+	assert.Equal(t, "OK", c.do(t, "SET", "c", "3", "NX"))
+	assert.Equal(t, "OK", c.do(t, "SET", "a", "2", "XX"))
+	assert.Equal(t, "2", c.do(t, "GET", "a"))
+	assert.Contains(t, errMsg(c.do(t, "SET", "a", "2", "NX", "XX")), "syntax error")
+
+	assert.Equal(t, "OK", c.do(t, "MSET", "x", "10", "y", "20"))
+	assert.Equal(t, []any{"10", nil, "20"}, c.do(t, "MGET", "x", "nope", "y"))
+	assert.Contains(t, errMsg(c.do(t, "MSET", "x", "1", "y")), "wrong number of arguments")
+
+	assert.Equal(t, int64(2), c.do(t, "DEL", "x", "y", "nope"))
+	assert.Equal(t, int64(0), c.do(t, "DEL", "x"))
+	assert.Nil(t, c.do(t, "GET", "x"))
+
+	assert.Contains(t, errMsg(c.do(t, "NOPE")), "unknown command 'NOPE'")
+	assert.Contains(t, errMsg(c.do(t, "GET")), "wrong number of arguments for 'get' command")
+	assert.Contains(t, errMsg(c.do(t, "SET", "", "v")), "empty key")
+
+	// inline commands, as telnet sends them
+	_, err := c.conn.Write([]byte("GET a\r\n"))
+	require.NoError(t, err)
+	reply, err := c.read()
+	require.NoError(t, err)
+	assert.Equal(t, "2", reply)
+
+	assert.Equal(t, "OK", c.do(t, "QUIT"))
+	_, err = c.read()
+	assert.Error(t, err)
+}
+
+func TestServerIncr(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	assert.Equal(t, int64(1), c.do(t, "INCR", "n"))
+	assert.Equal(t, int64(2), c.do(t, "INCR", "n"))
+	assert.Equal(t, "OK", c.do(t, "SET", "s", "abc"))
+	assert.Contains(t, errMsg(c.do(t, "INCR", "s")), "not an integer")
+	assert.Equal(t, "OK", c.do(t, "SET", "max", strconv.FormatInt(1<<63-1, 10)))
+	assert.Contains(t, errMsg(c.do(t, "INCR", "max")), "overflow")
+
+	// the increments of concurrent clients are not lost
+	const CLIENTS, INCRS = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < CLIENTS; i++ {
+		cc := dial(t, "tcp", addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < INCRS; j++ {
+				if err := cc.send("INCR", "counter"); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := cc.read(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, strconv.Itoa(CLIENTS*INCRS), c.do(t, "GET", "counter"))
+}
+
+func TestServerExpire(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	assert.Equal(t, int64(-2), c.do(t, "TTL", "a"))
+	assert.Equal(t, int64(0), c.do(t, "EXPIRE", "a", "10"))
+	assert.Equal(t, "OK", c.do(t, "SET", "a", "1"))
+	assert.Equal(t, int64(-1), c.do(t, "TTL", "a"))
+	assert.Equal(t, int64(1), c.do(t, "EXPIRE", "a", "100"))
+	assert.Equal(t, int64(100), c.do(t, "TTL", "a"))
+	assert.Equal(t, "1", c.do(t, "GET", "a"))
+
+	// INCR keeps the expiry
+	assert.Equal(t, int64(2), c.do(t, "INCR", "a"))
+	assert.Equal(t, int64(100), c.do(t, "TTL", "a"))
+
+	// a timeout that isn't positive deletes the key
+	assert.Equal(t, int64(1), c.do(t, "EXPIRE", "a", "0"))
+	assert.Nil(t, c.do(t, "GET", "a"))
+
+	assert.Equal(t, "OK", c.do(t, "SET", "b", "1", "EX", "50"))
+	assert.Equal(t, int64(50), c.do(t, "TTL", "b"))
+	assert.Contains(t, errMsg(c.do(t, "SET", "b", "1", "EX", "0")), "invalid expire time")
+	assert.Contains(t, errMsg(c.do(t, "SET", "b", "1", "PX")), "syntax error")
+
+	assert.Equal(t, "OK", c.do(t, "SET", "c", "1", "PX", "50"))
+	assert.Equal(t, int64(1), c.do(t, "EXISTS", "c"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, c.do(t, "GET", "c"))
+	assert.Equal(t, int64(0), c.do(t, "EXISTS", "c"))
+	assert.Equal(t, int64(-2), c.do(t, "TTL", "c"))
+	assert.Equal(t, int64(0), c.do(t, "DEL", "c"))
+}
+
+func TestServerScan(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	want := []string{}
+	for i := 0; i < 95; i++ {
+		key := fmt.Sprintf("user:%03d", i)
+		want = append(want, key)
+		assert.Equal(t, "OK", c.do(t, "SET", key, "v"))
+	}
+	assert.Equal(t, "OK", c.do(t, "SET", "other", "v"))
+
+	// scans to the end, returns the keys and the number of calls
+	scan := func(opts ...string) ([]string, int) {
+		keys := []string{}
+		cursor := "0"
+		for calls := 1; ; calls++ {
+			reply := c.do(t, append([]string{"SCAN", cursor}, opts...)...)
+			require.IsType(t, []any{}, reply, errMsg(reply))
+			items := reply.([]any)
+			for _, key := range items[1].([]any) {
+				keys = append(keys, key.(string))
+			}
+			if cursor = items[0].(string); cursor == "0" {
+				return keys, calls
+			}
+		}
+	}
+
+	keys, calls := scan()
+	assert.Equal(t, append([]string{"other"}, want...), keys)
+	assert.Equal(t, 10, calls)
+
+	keys, calls = scan("COUNT", "40")
+	assert.Len(t, keys, 96)
+	assert.Equal(t, 3, calls)
+
+	keys, _ = scan("MATCH", "user:*", "COUNT", "7")
+	assert.Equal(t, want, keys)
+	keys, _ = scan("MATCH", "user:0[1-2]?")
+	assert.Equal(t, want[10:30], keys)
+	keys, _ = scan("MATCH", "nope")
+	assert.Empty(t, keys)
+
+	assert.Contains(t, errMsg(c.do(t, "SCAN", "x")), "invalid cursor")
+	assert.Contains(t, errMsg(c.do(t, "SCAN", "12345")), "invalid cursor")
+	assert.Contains(t, errMsg(c.do(t, "SCAN", "0", "COUNT")), "syntax error")
+	assert.Contains(t, errMsg(c.do(t, "SCAN", "0", "COUNT", "0")), "syntax error")
+}
+
+// a reader whose keys point into pages that are overwritten once Scan returns, like pages reused by a commit
+type reusedPages []string
+
+func (r reusedPages) Get(key []byte) ([]byte, bool)        { return nil, false }
+func (r reusedPages) TTL(key []byte) (time.Duration, bool) { return 0, false }
+
+func (r reusedPages) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	pages := [][]byte{}
+	defer func() {
+		for _, page := range pages {
+			clear(page)
+		}
+	}()
+	for _, key := range r {
+		if key < string(start) {
+			continue
+		}
+		page := []byte(key)
+		pages = append(pages, page)
+		if !fn(page, nil) {
+			return
+		}
+	}
+}
+
+func TestServerScanCursorCopy(t *testing.T) {
+	s := newServer(nil)
+	r := reusedPages{"a", "b", "c", "d"}
+	reply := cmdScan(s, r, [][]byte{[]byte("SCAN"), []byte("0"), []byte("COUNT"), []byte("2")})
+	items := reply.([]any)
+	assert.Equal(t, []any{[]byte("a"), []byte("b")}, items[1])
+	reply = cmdScan(s, r, [][]byte{[]byte("SCAN"), items[0].([]byte), []byte("COUNT"), []byte("2")})
+	assert.Equal(t, []any{[]byte("c"), []byte("d")}, reply.([]any)[1])
+}
+
+// the cursor of SCAN stays valid while writers reuse the pages the previous call read
+func TestServerScanWhileWriting(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	want := []string{}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		want = append(want, key)
+		assert.Equal(t, "OK", c.do(t, "SET", key, "v"))
+	}
+
+	// sets and deletes keys between the ones of the scan, freeing and reusing their pages
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w := dial(t, "tcp", addr)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprintf("key:%04d:tmp", i*7%500)
+			if err := w.send("SET", key, fmt.Sprintf("%0200d", i)); err != nil {
+				return
+			}
+			if _, err := w.read(); err != nil {
+				return
+			}
+			if err := w.send("DEL", key); err != nil {
+				return
+			}
+			if _, err := w.read(); err != nil {
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	for round := 0; round < 5; round++ {
+		keys := []string{}
+		cursor := "0"
+		for {
+			reply := c.do(t, "SCAN", cursor, "MATCH", "key:????", "COUNT", "3")
+			require.IsType(t, []any{}, reply, errMsg(reply))
+			items := reply.([]any)
+			for _, key := range items[1].([]any) {
+				keys = append(keys, key.(string))
+			}
+			if cursor = items[0].(string); cursor == "0" {
+				break
+			}
+		}
+		require.Equal(t, want, keys)
+	}
+}
+
+func TestServerMulti(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	assert.Equal(t, "OK", c.do(t, "MULTI"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "a", "1"))
+	assert.Equal(t, "QUEUED", c.do(t, "INCR", "a"))
+	assert.Equal(t, "QUEUED", c.do(t, "GET", "a"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "s", "x"))
+	assert.Equal(t, "QUEUED", c.do(t, "INCR", "s"))
+	assert.Equal(t, "QUEUED", c.do(t, "MGET", "a", "s"))
+	// other clients don't see the queued commands
+	other := dial(t, "tcp", addr)
+	assert.Nil(t, other.do(t, "GET", "a"))
+
+	// a command that fails doesn't stop the others
+	reply := c.do(t, "EXEC")
+	require.IsType(t, []any{}, reply)
+	items := reply.([]any)
+	require.Len(t, items, 6)
+	assert.Equal(t, []any{"OK", int64(2), "2", "OK"}, items[:4])
+	assert.Contains(t, errMsg(items[4]), "not an integer")
+	assert.Equal(t, []any{"2", "x"}, items[5])
+	assert.Equal(t, "2", other.do(t, "GET", "a"))
+
+	assert.Equal(t, "OK", c.do(t, "MULTI"))
+	assert.Contains(t, errMsg(c.do(t, "MULTI")), "can not be nested")
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "a", "3"))
+	assert.Equal(t, "OK", c.do(t, "DISCARD"))
+	assert.Equal(t, "2", c.do(t, "GET", "a"))
+
+	// a rejected command aborts the transaction
+	assert.Equal(t, "OK", c.do(t, "MULTI"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "a", "4"))
+	assert.Contains(t, errMsg(c.do(t, "GET")), "wrong number of arguments")
+	assert.Contains(t, errMsg(c.do(t, "EXEC")), "EXECABORT")
+	assert.Equal(t, "2", c.do(t, "GET", "a"))
+
+	assert.Contains(t, errMsg(c.do(t, "EXEC")), "EXEC without MULTI")
+	assert.Contains(t, errMsg(c.do(t, "DISCARD")), "DISCARD without MULTI")
+
+	// a standalone command that fails commits nothing
+	assert.Contains(t, errMsg(c.do(t, "MSET", "m", "1", "", "2")), "empty key")
+	assert.Nil(t, c.do(t, "GET", "m"))
+}
+
+// the headers of a request can't make the server allocate more than the request holds
+func TestServerRequestLimits(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+
+	c := dial(t, "tcp", addr)
+	val := strings.Repeat("v", btree.BTREE_MAX_VAL_SIZE)
+	assert.Equal(t, "OK", c.do(t, "SET", "key", val))
+	assert.Contains(t, errMsg(c.do(t, "SET", "key", val+"v")), "bad bulk length")
+
+	// the server used to wait for the 512MB of the argument
+	c = dial(t, "tcp", addr)
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := c.conn.Write([]byte("*2\r\n$3\r\nGET\r\n$536870912\r\n"))
+	require.NoError(t, err)
+	reply, err := c.read()
+	require.NoError(t, err)
+	assert.Contains(t, errMsg(reply), "bad bulk length")
+
+	// an array of a million arguments that never come
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = readCommand(bufio.NewReader(strings.NewReader("*1048576\r\n$4\r\nPING\r\n")))
+	runtime.ReadMemStats(&after)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(64<<10))
+}
+
+func TestServerPipeline(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	const N = 1000
+	go func() {
+		for i := 0; i < N; i++ {
+			c.send("SET", fmt.Sprintf("k%d", i), strconv.Itoa(i))
+			c.send("GET", fmt.Sprintf("k%d", i))
+		}
+	}()
+	for i := 0; i < N; i++ {
+		reply, err := c.read()
+		require.NoError(t, err)
+		require.Equal(t, "OK", reply)
+		reply, err = c.read()
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(i), reply)
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sock")
+	srv, _ := startServer(t, "unix", path)
+	c := dial(t, "unix", path)
+	assert.Equal(t, "OK", c.do(t, "SET", "a", "1"))
+	assert.Equal(t, "1", c.do(t, "GET", "a"))
+
+	// close waits for the connections and the listener stops accepting
+	srv.close()
+	_, err := c.read()
+	assert.Error(t, err)
+	_, err = net.Dial("unix", path)
+	assert.Error(t, err)
+}
+
+func TestServerFollower(t *testing.T) {
+	primary := &btree.KV{InMemory: true, SweepInterval: -1, ReplicationLog: REPLICATION_LOG}
+	require.NoError(t, primary.Open())
+	defer primary.Close()
+	require.NoError(t, primary.Set([]byte("a"), []byte("1")))
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	repl := newReplicas(primary)
+	go repl.serve(ln)
+	defer repl.close()
+
+	follower := &btree.KV{Path: filepath.Join(t.TempDir(), "follower.db"), Follower: true}
+	require.NoError(t, follower.Open())
+	defer follower.Close()
+	following := newReplicas(follower)
+	go following.follow(ln.Addr().String())
+	defer following.close()
+
+	srv := newServer(follower)
+	fln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go srv.serve(fln)
+	defer srv.close()
+	c := dial(t, "tcp", fln.Addr().String())
+
+	require.NoError(t, primary.Set([]byte("b"), []byte("2")))
+	require.Eventually(t, func() bool {
+		return follower.ReplicaStatus().Applied == primary.Version()
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []any{"1", "2"}, c.do(t, "MGET", "a", "b"))
+	assert.Contains(t, errMsg(c.do(t, "SET", "c", "3")), "read-only")
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+const usage = `usage: dbtool <command> [flags] <database>
+
+commands:
+  export   write the keys of the database to stdout or -out
+  import   load a dump from stdin or -in into an empty database
+  stats    print the shape of the tree and the use of the file
+
+encrypted databases need their AES key, hex encoded, in DB_KEY
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	case "stats":
+		err = runStats(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbtool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// flags shared by export and import
+func dumpFlags(fs *flag.FlagSet) func() btree.DumpOptions {
+	format := fs.String("format", btree.FORMAT_JSONL, "dump format: jsonl or csv")
+	encoding := fs.String("encoding", btree.ENCODING_BASE64, "key and value encoding: base64 or escape")
+	start := fs.String("start", "", "first key of the range")
+	end := fs.String("end", "", "end of the range (exclusive), empty means no upper bound")
+
+	return func() btree.DumpOptions {
+		opts := btree.DumpOptions{Format: *format, Encoding: *encoding, Start: []byte(*start)}
+		if *end != "" {
+			opts.End = []byte(*end)
+		}
+		return opts
+	}
+}
+
+// opens the database named by the only positional argument
+// commands that only read it open it read-only, so they can run next to each other
+func openDB(fs *flag.FlagSet, readOnly bool) (*btree.KV, error) {
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("expected one database path, got %d arguments", fs.NArg())
+	}
+
+	db := &btree.KV{Path: fs.Arg(0), ReadOnly: readOnly}
+	if key := os.Getenv("DB_KEY"); key != "" {
+		var err error
+		if db.Key, err = hex.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("DB_KEY: %w", err)
+		}
+	}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	opts := dumpFlags(fs)
+	out := fs.String("out", "", "output file, stdout if empty")
+	fs.Parse(args)
+
+	db, err := openDB(fs, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	n, err := db.Export(w, opts())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys\n", n)
+
+	if *out != "" {
+		return w.Sync()
+	}
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	opts := dumpFlags(fs)
+	in := fs.String("in", "", "input file, stdin if empty")
+	quiet := fs.Bool("q", false, "don't report progress")
+	compress := fs.Int("compress", 0, "compress values of at least this many bytes, 0 disables it")
+	fs.Parse(args)
+
+	r := os.Stdin
+	if *in != "" {
+		var err error
+		if r, err = os.Open(*in); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+
+	db, err := openDB(fs, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.CompressMin = *compress
+
+	progress := func(n int) {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "\rimported %d keys", n)
+		}
+	}
+
+	n, err := db.Import(r, opts(), progress)
+	// overwrites the progress line
+	fmt.Fprintf(os.Stderr, "\rimported %d keys\n", n)
+	return err
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDB(fs, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("depth:           %d\n", stats.Depth)
+	fmt.Printf("keys:            %d\n", stats.Keys)
+	fmt.Printf("leaf pages:      %d\n", stats.LeafPages)
+	fmt.Printf("internal pages:  %d\n", stats.InternalPages)
+	fmt.Printf("expiry index:    %d pages\n", stats.IndexPages)
+	fmt.Printf("buckets:         %d, %d keys in %d pages\n", stats.Buckets, stats.BucketKeys, stats.BucketPages)
+	fmt.Printf("fill avg/min/max: %.1f%% / %.1f%% / %.1f%%\n", 100*stats.AvgFill, 100*stats.MinFill, 100*stats.MaxFill)
+	fmt.Printf("total pages:     %d\n", stats.TotalPages)
+	fmt.Printf("free pages:      %d\n", stats.FreePages)
+	fmt.Printf("free list nodes: %d\n", stats.FreeListNodes)
+	fmt.Printf("file size:       %d bytes\n", stats.FileSize)
+	fmt.Printf("live data:       %d bytes\n", stats.LiveBytes)
+	fmt.Printf("values:          %d bytes stored, %d bytes raw\n", stats.ValueBytes, stats.RawValueBytes)
+	fmt.Printf("compression:     %.2fx, %d values compressed\n", stats.CompressionRatio, stats.CompressedValues)
+	return nil
+}
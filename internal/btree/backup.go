@@ -0,0 +1,403 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"syscall"
+)
+
+// Backup stream format
+// | magic	| version	| page size	| records	| crc	|
+// | 8B		| 4B		| 4B		| ...		| 4B	|
+// each record is a tag byte followed by a page image
+// tag 'P' -> tree page, pages come in the order they are written in the restored file starting from page 2
+// the main tree comes first, then the expiry index, then the catalog followed by the buckets
+// tag 'M' -> the meta page of the restored file, it's always the last record
+// the pages of the stream are plain, the meta page of an encrypted database keeps META_ENCRYPTED and the key check
+// so it's only restored with its key, by RestoreKey, which seals the pages again
+// crc is the crc32 (castagnoli) of everything before it
+const (
+	BACKUP_MAGIC   = "DBBACKUP"
+	BACKUP_VERSION = 1
+)
+
+const (
+	backupTagPage = 'P'
+	backupTagMeta = 'M'
+)
+
+var ErrBadBackup = errors.New("invalid backup stream")
+
+var backupCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// Backup writes a consistent copy of the database to w while writers keep committing
+// the root is pinned, so the pages reachable from it are not reused until the backup ends
+// the pages are renumbered in breadth first order, the restored file has no free pages
+func (db *KV) Backup(w io.Writer) (err error) {
+	snap, release := db.pin()
+	defer release()
+	defer recoverCorrupt(&err, nil)
+
+	return writeBackup(w, snap)
+}
+
+// BackupFile writes a backup to a new file at path and syncs it
+func (db *KV) BackupFile(file string) error {
+	fd, err := createFileSync(file)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Ftruncate(fd, 0); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+
+	bw := bufio.NewWriter(fdWriter(fd))
+	if err := db.Backup(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	return syscall.Fsync(fd)
+}
+
+// walks the trees of the snapshot and streams every reachable page with the child pointers rewritten
+func writeBackup(w io.Writer, snap *snapshot) error {
+	crc := crc32.New(backupCRC)
+	out := io.MultiWriter(w, crc)
+
+	var header [16]byte
+	copy(header[:8], BACKUP_MAGIC)
+	binary.LittleEndian.PutUint32(header[8:], BACKUP_VERSION)
+	binary.LittleEndian.PutUint32(header[12:], BTREE_PAGE_SIZE)
+	if _, err := out.Write(header[:]); err != nil {
+		return err
+	}
+
+	// the restored file: meta, an empty free list node, then the trees
+	restored := KV{crypt: snap.crypt}
+	restored.free.headPage = 1
+	restored.free.tailPage = 1
+
+	// queue[i] is the page that becomes page i+2
+	type queued struct {
+		ptr     uint64
+		catalog bool // the leaves hold the roots of the buckets
+	}
+	queue := []queued{}
+	next := 0
+	page := BNode(make([]byte, BTREE_PAGE_SIZE))
+	trees := []struct {
+		old, new *BTree
+		catalog  bool
+	}{
+		{&snap.tree, &restored.tree, false},
+		{&snap.ttl, &restored.ttl, false},
+		{&snap.catalog, &restored.catalog, true},
+	}
+	for _, tree := range trees {
+		if tree.old.root == 0 {
+			continue
+		}
+		tree.new.root = uint64(len(queue)) + 2
+		queue = append(queue, queued{tree.old.root, tree.catalog})
+		// the buckets are walked after the catalog, in the same queue
+		for ; next < len(queue); next++ {
+			item := queue[next]
+			copy(page, tree.old.get(item.ptr))
+			switch {
+			case page.bType() == BNODE_NODE:
+				for j := uint16(0); j < page.nKeys(); j++ {
+					queue = append(queue, queued{page.getPtr(j), item.catalog})
+					page.setPtr(j, uint64(len(queue)+1))
+				}
+			case item.catalog:
+				for j := uint16(0); j < page.nKeys(); j++ {
+					val := page.getVal(j)
+					if len(val) != 8 || binary.LittleEndian.Uint64(val) == 0 {
+						continue // dummy key or empty bucket
+					}
+					queue = append(queue, queued{binary.LittleEndian.Uint64(val), false})
+					binary.LittleEndian.PutUint64(val, uint64(len(queue)+1))
+				}
+			}
+
+			if _, err := out.Write([]byte{backupTagPage}); err != nil {
+				return err
+			}
+			if _, err := out.Write(page); err != nil {
+				return err
+			}
+		}
+	}
+	restored.page.flushed = 2 + uint64(len(queue))
+
+	meta := make([]byte, BTREE_PAGE_SIZE)
+	copy(meta, saveMeta(&restored))
+	if _, err := out.Write([]byte{backupTagMeta}); err != nil {
+		return err
+	}
+	if _, err := out.Write(meta); err != nil {
+		return err
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+// Restore validates a backup stream and writes it to a new database file at path
+// the meta page is written last, so a failed restore never leaves a valid database behind
+// the backup of an encrypted database needs RestoreKey
+func Restore(r io.Reader, file string) error {
+	return RestoreKey(r, file, nil)
+}
+
+// RestoreKey is Restore with the key of the backed up database, the restored file is encrypted with it
+// it fails with ErrEncrypted if the backup is encrypted and key is nil, with ErrBadKey if the key doesn't match
+func RestoreKey(r io.Reader, file string, key []byte) (err error) {
+	var crypt *pageCipher
+	var version uint64
+	if key != nil {
+		if crypt, err = newPageCipher(key); err != nil {
+			return err
+		}
+		if version, err = restoreVersion(); err != nil {
+			return err
+		}
+		crypt.reserved = version + 1
+	}
+
+	fd, err := createFileSync(file)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	stat := &syscall.Stat_t{}
+	if err := syscall.Fstat(fd, stat); err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if stat.Size != 0 {
+		return fmt.Errorf("restore: %s is not empty", file)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = syscall.Unlink(file)
+		}
+	}()
+
+	seal := func(ptr uint64, page []byte) []byte {
+		if crypt == nil {
+			return page
+		}
+		return crypt.seal(ptr, page, version)
+	}
+	meta, err := readBackup(bufio.NewReader(r), func(ptr uint64, page []byte) error {
+		_, err := syscall.Pwrite(fd, seal(ptr, page), int64(ptr*BTREE_PAGE_SIZE))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	encrypted := binary.LittleEndian.Uint64(meta[72:])&META_ENCRYPTED != 0
+	switch {
+	case encrypted && crypt == nil:
+		return ErrEncrypted
+	case !encrypted && crypt != nil:
+		return fmt.Errorf("%w: the backup is not encrypted", ErrBadKey)
+	case encrypted:
+		if _, err := crypt.aead.Open(nil, pageNonce(0, 0), meta[88:120], nil); err != nil {
+			return ErrBadKey
+		}
+		binary.LittleEndian.PutUint64(meta[80:], crypt.reserved)
+	}
+
+	// free list node
+	if _, err := syscall.Pwrite(fd, seal(1, make([]byte, BTREE_PAGE_SIZE)), BTREE_PAGE_SIZE); err != nil {
+		return err
+	}
+	if err := syscall.Fsync(fd); err != nil {
+		return err
+	}
+	if _, err := syscall.Pwrite(fd, meta, 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+
+	return syscall.Fsync(fd)
+}
+
+// reads and validates a backup stream, every tree page is passed to put
+// returns the meta page once the checksum matches
+func readBackup(r io.Reader, put func(uint64, []byte) error) ([]byte, error) {
+	crc := crc32.New(backupCRC)
+	in := io.TeeReader(r, crc)
+
+	var header [16]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrBadBackup, err)
+	}
+	if string(header[:8]) != BACKUP_MAGIC {
+		return nil, fmt.Errorf("%w: bad magic", ErrBadBackup)
+	}
+	if v := binary.LittleEndian.Uint32(header[8:]); v != BACKUP_VERSION {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadBackup, v)
+	}
+	if size := binary.LittleEndian.Uint32(header[12:]); size != BTREE_PAGE_SIZE {
+		return nil, fmt.Errorf("%w: page size %d", ErrBadBackup, size)
+	}
+
+	ptr := uint64(2)
+	maxChild := uint64(0)
+	page := BNode(make([]byte, BTREE_PAGE_SIZE))
+	tag := []byte{0}
+	for {
+		if _, err := io.ReadFull(in, tag); err != nil {
+			return nil, fmt.Errorf("%w: truncated at page %d: %v", ErrBadBackup, ptr, err)
+		}
+		if _, err := io.ReadFull(in, page); err != nil {
+			return nil, fmt.Errorf("%w: truncated at page %d: %v", ErrBadBackup, ptr, err)
+		}
+		if tag[0] == backupTagMeta {
+			break
+		}
+		if tag[0] != backupTagPage {
+			return nil, fmt.Errorf("%w: bad record tag %q", ErrBadBackup, tag[0])
+		}
+
+		if err := checkPage(page); err != nil {
+			return nil, fmt.Errorf("%w: page %d: %v", ErrBadBackup, ptr, err)
+		}
+		if page.bType() == BNODE_NODE {
+			for i := uint16(0); i < page.nKeys(); i++ {
+				child := page.getPtr(i)
+				if child <= ptr {
+					return nil, fmt.Errorf("%w: page %d: child pointer %d is not after its parent", ErrBadBackup, ptr, child)
+				}
+				maxChild = max(maxChild, child)
+			}
+		}
+
+		if err := put(ptr, page); err != nil {
+			return nil, err
+		}
+		ptr++
+	}
+
+	sum := crc.Sum32()
+	var stored [4]byte
+	if _, err := io.ReadFull(r, stored[:]); err != nil {
+		return nil, fmt.Errorf("%w: checksum: %v", ErrBadBackup, err)
+	}
+	if binary.LittleEndian.Uint32(stored[:]) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrBadBackup)
+	}
+
+	meta := make([]byte, BTREE_PAGE_SIZE)
+	copy(meta, page)
+	if string(meta[:len(DB_SIG)]) != DB_SIG {
+		return nil, fmt.Errorf("%w: invalid meta signature", ErrBadBackup)
+	}
+	restored := KV{}
+	loadMeta(&restored, meta)
+	if restored.page.flushed != ptr || maxChild >= ptr {
+		return nil, fmt.Errorf("%w: meta page expects %d pages, stream has %d", ErrBadBackup, restored.page.flushed, ptr)
+	}
+	if (ptr == 2) != (restored.tree.root == 0 && restored.ttl.root == 0 && restored.catalog.root == 0) || (restored.tree.root != 0 && restored.tree.root != 2) {
+		return nil, fmt.Errorf("%w: bad root pointer %d", ErrBadBackup, restored.tree.root)
+	}
+	if restored.ttl.root != 0 && (restored.ttl.root < 2 || restored.ttl.root >= ptr) {
+		return nil, fmt.Errorf("%w: bad expiry index root pointer %d", ErrBadBackup, restored.ttl.root)
+	}
+	if restored.catalog.root != 0 && (restored.catalog.root < 2 || restored.catalog.root >= ptr) {
+		return nil, fmt.Errorf("%w: bad catalog root pointer %d", ErrBadBackup, restored.catalog.root)
+	}
+
+	return meta, nil
+}
+
+// verifies the header and the sizes of a tree page
+func checkPage(node BNode) error {
+	if t := node.bType(); t != BNODE_NODE && t != BNODE_LEAF {
+		return fmt.Errorf("bad node type %d", t)
+	}
+	if node.nKeys() == 0 {
+		return fmt.Errorf("empty node")
+	}
+	header := HEADER
+	if node.hasPrefix() {
+		header += 2 + int(binary.LittleEndian.Uint16(node[HEADER:]))
+	}
+	if header+10*int(node.nKeys()) > BTREE_PAGE_SIZE {
+		return fmt.Errorf("too many keys %d", node.nKeys())
+	}
+	size := header + 10*int(node.nKeys()) + int(node.getOffset(node.nKeys()))
+	if size > BTREE_PAGE_SIZE {
+		return fmt.Errorf("node size %d exceeds page size", size)
+	}
+	return nil
+}
+
+// io.Writer over a file descriptor
+type fdWriter int
+
+func (fd fdWriter) Write(p []byte) (int, error) {
+	return syscall.Write(int(fd), p)
+}
+
+// Check verifies a snapshot of the database the way Restore verifies a backup of it,
+// then reads the main tree in order to check the order of the keys and decode the values
+// it returns an error wrapping ErrCorrupt on the first problem, writers are not blocked
+func (db *KV) Check() (err error) {
+	snap, release := db.pin()
+	defer release()
+	defer recoverCorrupt(&err, nil)
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			pw.CloseWithError(err)
+			written <- err
+		}()
+		defer recoverCorrupt(&err, nil)
+		err = writeBackup(pw, snap)
+	}()
+	_, err = readBackup(pr, func(uint64, []byte) error { return nil })
+	pr.CloseWithError(io.ErrClosedPipe) // unblocks the writer if the stream was rejected
+	werr := <-written
+	if errors.Is(werr, ErrCorrupt) {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if werr != nil {
+		return werr
+	}
+
+	var prev []byte
+	for iter := snap.tree.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			return corruptf("key %q after %q", key, prev).error
+		}
+		if _, err := decodeVal(val, iter.Flags()); err != nil {
+			return corruptf("key %q: %v", key, err).error
+		}
+		prev = append(prev[:0], key...)
+	}
+	return nil
+}
@@ -13,8 +13,15 @@ const HEADER = 4
 // for each kv pair
 // klen	//vlen	//key	//val
 // 2B	//2B
+// the high bits of vlen are flags of the value (VAL_COMPRESSED), the length is below them
 // pointers -> child pointers (byte offset)
 // offsets -> take you right to the klen (not global, it's irt the end of offsets)
+//
+// nodes with the BNODE_PREFIX flag in the type store the prefix shared by all their keys once
+// type		// nkeys	// plen	// prefix	// pointers	//offsets	// key-values
+// 2B		2B			2B		plen B		nKeys * 8B	nKeys*2B
+// and the keys in the key-values only hold what comes after the prefix
+// nodes without the flag come from files written before the format version 1
 type BNode []byte
 
 // bType types
@@ -23,20 +30,38 @@ const (
 	BNODE_LEAF = 2
 )
 
+// flag inside the type field of nodes with a shared key prefix
+const BNODE_PREFIX = 0x100
+
+// the prefix is capped so that a node whose prefix shrinks after an insert
+// still fits in the uint16 offsets before it's split
+const BNODE_MAX_PREFIX = 128
+
+// flags stored in the high bits of vlen, values never reach them
+const (
+	VAL_COMPRESSED = 0x8000 // the value was compressed by the KV
+	VAL_TTL        = 0x4000 // the value starts with its expiry time
+	VAL_FLAGS      = 0xc000 // mask of every flag
+)
+
 const BTREE_PAGE_SIZE = 4096
+
+// the end of every page is kept for the encryption trailer, nodes must fit in the rest
+const PAGE_TRAILER = 32
+const BTREE_NODE_SIZE = BTREE_PAGE_SIZE - PAGE_TRAILER
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
 func init() {
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	if !(node1max <= BTREE_PAGE_SIZE) {
+	node1max := HEADER + 2 + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
+	if !(node1max <= BTREE_NODE_SIZE) {
 		panic("node1max larger than page size")
 	}
 }
 
 // Btypes Node or leaf
 func (node BNode) bType() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIX
 }
 
 // Number of keys in KV, in case of BNODE_NODE nKeys = number of childs
@@ -44,10 +69,40 @@ func (node BNode) nKeys() uint16 {
 	return binary.LittleEndian.Uint16(node[2:4])
 }
 
-// Header of 4 bytes = btype(2 bytes) : nKeys(2 bytes)
+// Header of 4 bytes = btype(2 bytes) : nKeys(2 bytes), followed by an empty prefix
+// setPrefix must be called before adding keys if the keys share a prefix
 func (node BNode) setHeader(btype, nKeys uint16) {
-	binary.LittleEndian.PutUint16(node[0:2], btype)
+	binary.LittleEndian.PutUint16(node[0:2], btype|BNODE_PREFIX)
 	binary.LittleEndian.PutUint16(node[2:4], nKeys)
+	binary.LittleEndian.PutUint16(node[4:6], 0)
+}
+
+// the node stores a shared prefix
+func (node BNode) hasPrefix() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIX != 0
+}
+
+// the prefix shared by every key of the node
+func (node BNode) prefix() []byte {
+	if !node.hasPrefix() {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node[HEADER:])
+	return node[HEADER+2:][:plen]
+}
+
+// Sets the prefix right after the header, before any pointer or key is written
+func (node BNode) setPrefix(prefix []byte) {
+	binary.LittleEndian.PutUint16(node[HEADER:], uint16(len(prefix)))
+	copy(node[HEADER+2:], prefix)
+}
+
+// size of the header plus the prefix, where the pointers begin
+func (node BNode) headerSize() uint16 {
+	if !node.hasPrefix() {
+		return HEADER
+	}
+	return HEADER + 2 + binary.LittleEndian.Uint16(node[HEADER:])
 }
 
 // After header theres a list of pointers to the child nodes in the case B_NODE_NODE btype
@@ -56,13 +111,13 @@ func (node BNode) getPtr(idx uint16) uint64 {
 		panic("nKeys should be greater then index")
 	}
 
-	pos := HEADER + 8*idx
+	pos := node.headerSize() + 8*idx
 	return binary.LittleEndian.Uint64(node[pos:])
 }
 
 // Sets the pointer to child node where idx represents the offset of the child node beginning at zero
 func (node BNode) setPtr(idx uint16, val uint64) {
-	pos := HEADER + 8*idx
+	pos := node.headerSize() + 8*idx
 	binary.LittleEndian.PutUint64(node[pos:], val)
 }
 
@@ -72,7 +127,7 @@ func offsetPos(node BNode, idx uint16) uint16 {
 		panic("")
 	}
 
-	return HEADER + 8*node.nKeys() + 2*(idx-1)
+	return node.headerSize() + 8*node.nKeys() + 2*(idx-1)
 }
 
 // if the index is zero, the offset position of the kv pair is just 0;
@@ -101,81 +156,190 @@ func (node BNode) kvPos(idx uint16) uint16 {
 		panic("index greater than number of keys")
 	}
 
-	return HEADER + 8*node.nKeys() + 2*node.nKeys() + node.getOffset(idx)
+	return node.headerSize() + 8*node.nKeys() + 2*node.nKeys() + node.getOffset(idx)
 }
 
-// gets key by idx by searching first the kvposition
+// gets key by idx, the prefix of the node is prepended so it allocates if the node has one
+// lookups should use cmpKey and copies keyParts instead
+func (node BNode) getKey(idx uint16) []byte {
+	prefix, suffix := node.keyParts(idx)
+	if len(prefix) == 0 {
+		return suffix
+	}
+	return append(bytes.Clone(prefix), suffix...)
+}
+
+// gets the key by idx as the node prefix and what is stored after it
 // after HEADER + ptr + offset theres the key with 2 bytes for klen and 2 bytes for vlen
 // then slices with value of klen
-func (node BNode) getKey(idx uint16) []byte {
+func (node BNode) keyParts(idx uint16) ([]byte, []byte) {
 	if !(idx < node.nKeys()) {
 		panic("")
 	}
 
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
-	return node[pos+4:][:klen]
+	return node.prefix(), node[pos+4:][:klen]
+}
+
+// compares the keys a1+a2 and b1+b2 without building them
+func cmpParts(a1, a2, b1, b2 []byte) int {
+	n := min(len(a1)+len(a2), len(b1)+len(b2))
+	at := func(p1, p2 []byte, i int) byte {
+		if i < len(p1) {
+			return p1[i]
+		}
+		return p2[i-len(p1)]
+	}
+	for i := 0; i < n; i++ {
+		if x, y := at(a1, a2, i), at(b1, b2, i); x != y {
+			return int(x) - int(y)
+		}
+	}
+	return (len(a1) + len(a2)) - (len(b1) + len(b2))
+}
+
+// compares the key at idx with key without building it
+func (node BNode) cmpKey(idx uint16, key []byte) int {
+	prefix, suffix := node.keyParts(idx)
+	n := min(len(prefix), len(key))
+	if cmp := bytes.Compare(prefix, key[:n]); cmp != 0 {
+		return cmp
+	}
+	if len(key) < len(prefix) {
+		return 1
+	}
+	return bytes.Compare(suffix, key[len(prefix):])
 }
 
 // gets the value after Key
 func (node BNode) getVal(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:]) &^ VAL_FLAGS
 	return node[pos+4+klen:][:vlen]
 }
 
+// gets the flags of the value at idx
+func (node BNode) getValFlags(idx uint16) uint16 {
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node[pos+2:]) & VAL_FLAGS
+}
+
+// sets the flags of the value at idx, it must be written already
+func (node BNode) setValFlags(idx uint16, flags uint16) {
+	pos := node.kvPos(idx)
+	vlen := binary.LittleEndian.Uint16(node[pos+2:]) &^ VAL_FLAGS
+	binary.LittleEndian.PutUint16(node[pos+2:], vlen|flags&VAL_FLAGS)
+}
+
 // returns the last index written on BNode
 func (node BNode) nBytes() uint16 {
 	return node.kvPos(node.nKeys())
 }
 
-// TODO: Binary Search
-// Searches for key child inside BNode, returns the index of first child node whose range intersects key
-func nodeLookupLE(node BNode, key []byte) uint16 {
-	nKeys := node.nKeys()
-	found := uint16(0)
+// size of all the kv pairs with the prefix put back in the keys
+func (node BNode) kvBytes() int {
+	return int(node.getOffset(node.nKeys())) + int(node.nKeys())*len(node.prefix())
+}
 
-	for i := uint16(1); i < nKeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
+// size of a node with n keys sharing a prefix of plen bytes, kv is the size of the kv pairs with full keys
+func nodeSize(plen, n, kv int) int {
+	return HEADER + 2 + plen + 10*n + kv - n*plen
+}
 
-		if cmp >= 0 {
-			break
+// length of the common prefix of the keys a1+a2 and b1+b2, capped to BNODE_MAX_PREFIX
+func commonPrefix(a1, a2, b1, b2 []byte) int {
+	at := func(p1, p2 []byte, i int) byte {
+		if i < len(p1) {
+			return p1[i]
 		}
+		return p2[i-len(p1)]
 	}
 
-	return found
+	n := min(len(a1)+len(a2), len(b1)+len(b2), BNODE_MAX_PREFIX)
+	i := 0
+	for i < n && at(a1, a2, i) == at(b1, b2, i) {
+		i++
+	}
+	return i
 }
 
-func nodeLookupE(node BNode, key []byte) (uint16, bool) {
-	nKeys := node.nKeys()
-	found := uint16(0)
-	ok := false
-
-	for i := uint16(1); i < nKeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp == 0 {
-			found = i
-			ok = true
+// sets the prefix of node to the one shared by its first and last keys, given as 2 parts each
+// the keys in between are sorted, so they share it too
+func setPrefixOf(node BNode, f1, f2, l1, l2 []byte) {
+	plen := commonPrefix(f1, f2, l1, l2)
+	if plen <= len(f1) {
+		node.setPrefix(f1[:plen])
+	} else {
+		node.setPrefix(append(bytes.Clone(f1), f2[:plen-len(f1)]...))
+	}
+}
+
+// allocates a node buffer of at least one page
+func nodeBuf(size int) BNode {
+	return BNode(make([]byte, max(size, BTREE_PAGE_SIZE)))
+}
+
+// Searches for key child inside BNode, returns the index of first child node whose range intersects key
+// it's the last index whose key is less or equal to key, the first key is always a candidate
+func nodeLookupLE(node BNode, key []byte) uint16 {
+	// binary search for the first key greater than key in [1, nKeys)
+	lo, hi := uint16(1), node.nKeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if node.cmpKey(mid, key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
+	}
+
+	return lo - 1
+}
 
-		if cmp >= 0 {
-			break
+// Searches for the first key greater or equal to key, returns nKeys if there's none
+func nodeLookupGE(node BNode, key []byte) uint16 {
+	lo, hi := uint16(0), node.nKeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if node.cmpKey(mid, key) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
+	return lo
+}
 
-	return found, ok
+// Searches for the exact key inside BNode, returns its index and true if found
+func nodeLookupE(node BNode, key []byte) (uint16, bool) {
+	lo := nodeLookupGE(node, key)
+	if lo < node.nKeys() && node.cmpKey(lo, key) == 0 {
+		return lo, true
+	}
+	return 0, false
 }
 
 // adds new kv inside a leaf
-func leafInsert(newBNode, oldBNode BNode, idx uint16, key, val []byte) {
-	newBNode.setHeader(BNODE_LEAF, oldBNode.nKeys()+1)
+func leafInsert(newBNode, oldBNode BNode, idx uint16, key, val []byte, flags uint16) {
+	n := oldBNode.nKeys()
+	newBNode.setHeader(BNODE_LEAF, n+1)
+
+	f1, f2 := []byte(nil), key
+	if idx > 0 {
+		f1, f2 = oldBNode.keyParts(0)
+	}
+	l1, l2 := []byte(nil), key
+	if idx < n {
+		l1, l2 = oldBNode.keyParts(n - 1)
+	}
+	setPrefixOf(newBNode, f1, f2, l1, l2)
+
 	nodeAppendRange(newBNode, oldBNode, 0, 0, idx)
 	nodeAppendKV(newBNode, idx, 0, key, val)
-	nodeAppendRange(newBNode, oldBNode, idx+1, idx, oldBNode.nKeys()-idx)
+	newBNode.setValFlags(idx, flags)
+	nodeAppendRange(newBNode, oldBNode, idx+1, idx, n-idx)
 }
 
 // sets child pointer for BNODE_NODE to ptr
@@ -183,191 +347,199 @@ func leafInsert(newBNode, oldBNode BNode, idx uint16, key, val []byte) {
 // idx represents the index inside BNode
 // pointers are page number inside the Btree (byte offsets)
 // a zero pointer is just a pointer to nil (leaf nodes)
+// key is the full key, it must start with the node prefix
 func nodeAppendKV(newBNode BNode, idx uint16, ptr uint64, key, val []byte) {
-	newBNode.setPtr(idx, uint64(ptr))
+	prefix := newBNode.prefix()
+	if !bytes.HasPrefix(key, prefix) {
+		panic("key doesn't match the node prefix")
+	}
+	nodeWriteKV(newBNode, idx, ptr, nil, key[len(prefix):], val)
+}
+
+// writes the kv pair at idx, the stored key is k1+k2 (without the node prefix)
+func nodeWriteKV(newBNode BNode, idx uint16, ptr uint64, k1, k2, val []byte) {
+	newBNode.setPtr(idx, ptr)
+	klen := uint16(len(k1) + len(k2))
 	pos := newBNode.kvPos(idx)
-	binary.LittleEndian.PutUint16(newBNode[pos:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(newBNode[pos:], klen)
 	binary.LittleEndian.PutUint16(newBNode[pos+2:], uint16(len(val)))
-	copy(newBNode[pos+4:], key)
-	copy(newBNode[pos+4+uint16(len(key)):], val)
+	copy(newBNode[pos+4:], k1)
+	copy(newBNode[pos+4+uint16(len(k1)):], k2)
+	copy(newBNode[pos+4+klen:], val)
 
-	newBNode.setOffset(idx+1, uint16(newBNode.getOffset(idx)+4+uint16((len(key)+len(val)))))
+	newBNode.setOffset(idx+1, newBNode.getOffset(idx)+4+klen+uint16(len(val)))
 }
 
 // appends a range of n KV from oldBnode to newBnode strarting from srcOld
+// the keys are rewritten for the prefix of newBNode
 func nodeAppendRange(newBNode, oldBNode BNode, dstNew, srcOld, n uint16) {
 	if n == 0 {
 		return
 	}
 
-	// Copy offsets, pointers, and KV data for the range
 	for i := uint16(0); i < n; i++ {
 		srcIdx := srcOld + i
 		dstIdx := dstNew + i
 
 		// Copy pointer (for internal nodes) or set to 0 (for leaf nodes)
+		ptr := uint64(0)
 		if oldBNode.bType() == BNODE_NODE {
-			newBNode.setPtr(dstIdx, oldBNode.getPtr(srcIdx))
-		} else {
-			newBNode.setPtr(dstIdx, 0)
+			ptr = oldBNode.getPtr(srcIdx)
 		}
 
-		// Copy key-value data
-		key := oldBNode.getKey(srcIdx)
-		val := oldBNode.getVal(srcIdx)
-		pos := newBNode.kvPos(dstIdx)
-		binary.LittleEndian.PutUint16(newBNode[pos:], uint16(len(key)))
-		binary.LittleEndian.PutUint16(newBNode[pos+2:], uint16(len(val)))
-		copy(newBNode[pos+4:], key)
-		copy(newBNode[pos+4+uint16(len(key)):], val)
-
-		// Update offset for next position
-		newBNode.setOffset(dstIdx+1, newBNode.getOffset(dstIdx)+4+uint16(len(key)+len(val)))
+		prefix, suffix := oldBNode.keyParts(srcIdx)
+		nodeAppendParts(newBNode, dstIdx, ptr, prefix, suffix, oldBNode.getVal(srcIdx))
+		newBNode.setValFlags(dstIdx, oldBNode.getValFlags(srcIdx))
 	}
 }
 
-func nodeAppendKidN(tree *BTree, newBNode, oldBNode BNode, idx uint16, kids ...BNode) {
-	inc := uint16(len(kids))
-	newBNode.setHeader(BNODE_NODE, oldBNode.nKeys()+inc-1)
-	nodeAppendRange(newBNode, oldBNode, 0, 0, idx)
-	for i, node := range kids {
-		nodeNode, err := tree.newBNode(node)
-		if err != nil {
-			panic("")
-		}
-		nodeAppendKV(newBNode, idx+uint16(i), nodeNode, node.getKey(0), nil)
-	}
-	nodeAppendRange(newBNode, oldBNode, idx+inc, idx+1, oldBNode.nKeys()-(idx+1))
-}
-
-// review
+// Splits old into left and right, the right node always fits in a page
+// the left node may still be too big and is split again by nodeSplitN
 func nodeSplit2(left BNode, right BNode, old BNode) {
 	nKeys := old.nKeys()
-
-	// Find the optimal split point
-	splitIdx := uint16(0)
-	totalSize := old.nBytes()
-	targetSize := totalSize / 2
-
-	// Calculate cumulative sizes to find the best split point
-	currentSize := uint16(0)
-	for i := uint16(0); i < nKeys; i++ {
-		keySize := uint16(len(old.getKey(i)))
-		valSize := uint16(len(old.getVal(i)))
-		kvSize := 4 + keySize + valSize // 4 bytes for keyLen + valLen
-
-		if currentSize+kvSize > targetSize && i > 0 {
-			splitIdx = i
-			break
-		}
-		currentSize += kvSize
+	if nKeys < 2 {
+		panic("cannot split a node with less than 2 keys")
 	}
 
-	// If we didn't find a good split point, split in the middle
-	if splitIdx == 0 {
-		splitIdx = nKeys / 2
+	// sizes of the first n keys and of the rest as standalone nodes, with their own prefix
+	oldPrefix := len(old.prefix())
+	kvFull := func(n uint16) int {
+		return int(old.getOffset(n)) + int(n)*oldPrefix
+	}
+	rangeBytes := func(from, to uint16) int {
+		f1, f2 := old.keyParts(from)
+		l1, l2 := old.keyParts(to - 1)
+		return nodeSize(commonPrefix(f1, f2, l1, l2), int(to-from), kvFull(to)-kvFull(from))
 	}
 
-	// Ensure we have at least one key in each split
-	if splitIdx == 0 {
-		splitIdx = 1
+	// start from the middle, keep the left part small and then make the right fit
+	splitIdx := nKeys / 2
+	for splitIdx > 1 && rangeBytes(0, splitIdx) > BTREE_NODE_SIZE {
+		splitIdx--
 	}
-	if splitIdx == nKeys {
-		splitIdx = nKeys - 1
+	for splitIdx < nKeys-1 && rangeBytes(splitIdx, nKeys) > BTREE_NODE_SIZE {
+		splitIdx++
 	}
 
 	// Copy data to left and right nodes
 	left.setHeader(old.bType(), splitIdx)
+	f1, f2 := old.keyParts(0)
+	l1, l2 := old.keyParts(splitIdx - 1)
+	setPrefixOf(left, f1, f2, l1, l2)
+
 	right.setHeader(old.bType(), nKeys-splitIdx)
+	f1, f2 = old.keyParts(splitIdx)
+	l1, l2 = old.keyParts(nKeys - 1)
+	setPrefixOf(right, f1, f2, l1, l2)
 
-	// Copy the appropriate ranges
-	if old.bType() == BNODE_LEAF {
-		nodeAppendRange(left, old, 0, 0, splitIdx)
-		nodeAppendRange(right, old, 0, splitIdx, nKeys-splitIdx)
-	} else {
-		// For internal nodes, copy child pointers
-		for i := uint16(0); i < splitIdx; i++ {
-			left.setPtr(i, old.getPtr(i))
-			key := old.getKey(i)
-			val := old.getVal(i)
-			nodeAppendKV(left, i, old.getPtr(i), key, val)
-		}
-		for i := splitIdx; i < nKeys; i++ {
-			right.setPtr(i-splitIdx, old.getPtr(i))
-			key := old.getKey(i)
-			val := old.getVal(i)
-			nodeAppendKV(right, i-splitIdx, old.getPtr(i), key, val)
-		}
-	}
+	// nodeAppendRange copies the child pointers for internal nodes
+	nodeAppendRange(left, old, 0, 0, splitIdx)
+	nodeAppendRange(right, old, 0, splitIdx, nKeys-splitIdx)
 }
 
-// Splits the old Bnode into 1, 2, or 3 Bnodes, and returns the splitten nodes together with the number of nodes
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nBytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old}
+// Splits the old Bnode into as many page sized Bnodes as needed, usually 1, 2 or 3
+// more are needed when an insert shortens the prefix of a node
+// nodes from older files may use the whole page, they are split too
+func nodeSplitN(old BNode) []BNode {
+	if old.nBytes() <= BTREE_NODE_SIZE {
+		return []BNode{old[:BTREE_PAGE_SIZE]}
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-
-	if left.nBytes() <= BTREE_PAGE_SIZE {
-		left := left[:BTREE_PAGE_SIZE]
-		return 2, [3]BNode{left, right}
+	// peel page sized nodes from the right
+	split := []BNode{}
+	for old.nBytes() > BTREE_NODE_SIZE {
+		left := nodeBuf(int(old.nBytes()))
+		right := nodeBuf(BTREE_PAGE_SIZE)
+		nodeSplit2(left, right, old)
+		split = append([]BNode{right}, split...)
+		old = left
 	}
 
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	if !(leftleft.nBytes() <= BTREE_PAGE_SIZE) {
-		panic("")
-	}
-
-	return 3, [3]BNode{left, middle, right}
+	return append([]BNode{old[:BTREE_PAGE_SIZE]}, split...)
 }
 
 // Inserts
-func treeInsert(tree *BTree, node BNode, key, val []byte) BNode {
-	newBNode := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
-
+func treeInsert(tree *BTree, node BNode, key, val []byte, flags uint16) BNode {
 	idx := nodeLookupLE(node, key)
 
 	switch node.bType() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdate(newBNode, node, idx, key, val)
-		} else {
-			leafInsert(newBNode, node, idx+1, key, val)
+		// the new prefix may be shorter than the old one, size it as if there were none
+		newBNode := nodeBuf(nodeSize(0, int(node.nKeys())+1, node.kvBytes()+4+len(key)+len(val)))
+		switch cmp := node.cmpKey(idx, key); {
+		case cmp == 0:
+			leafUpdate(newBNode, node, idx, key, val, flags)
+		case cmp > 0:
+			// separators are kept on delete, so the key can be below the first key of the leaf
+			leafInsert(newBNode, node, idx, key, val, flags)
+		default:
+			leafInsert(newBNode, node, idx+1, key, val, flags)
 		}
+		return newBNode
 	case BNODE_NODE:
-		nodeInsert(tree, newBNode, node, idx, key, val)
+		return nodeInsert(tree, node, idx, key, val, flags)
 	default:
 		panic("bad node")
 	}
-
-	return newBNode
 }
 
 // TODO: change leaf update
 // leafUpdate copies everything from node to newBnode, but, it updates the value on key passed
-func leafUpdate(newBNode, node BNode, idx uint16, key, val []byte) {
-	newBNode.setHeader(BNODE_LEAF, node.nKeys())
+func leafUpdate(newBNode, node BNode, idx uint16, key, val []byte, flags uint16) {
+	n := node.nKeys()
+	newBNode.setHeader(BNODE_LEAF, n)
+	f1, f2 := node.keyParts(0)
+	l1, l2 := node.keyParts(n - 1)
+	setPrefixOf(newBNode, f1, f2, l1, l2)
+
 	nodeAppendRange(newBNode, node, 0, 0, idx)
 	nodeAppendKV(newBNode, idx, 0, key, val)
-	nodeAppendRange(newBNode, node, idx+1, idx+1, node.nKeys()-(idx+1))
+	newBNode.setValFlags(idx, flags)
+	nodeAppendRange(newBNode, node, idx+1, idx+1, n-(idx+1))
 }
 
-func nodeInsert(tree *BTree, newBNode, node BNode, idx uint16, key, val []byte) {
+// inserts into the kid at idx and replaces it with the nodes it was split into
+func nodeInsert(tree *BTree, node BNode, idx uint16, key, val []byte, flags uint16) BNode {
 	kptr := node.getPtr(idx)
-	knode := treeInsert(tree, tree.get(kptr), key, val)
-	nsplit, split := nodeSplit3(knode)
+	knode := treeInsert(tree, tree.get(kptr), key, val, flags)
+	split := nodeSplitN(knode)
 	tree.del(kptr)
-	nodeReplaceKidN(tree, newBNode, node, idx, split[:nsplit]...)
+
+	kv := node.kvBytes()
+	for _, kid := range split {
+		prefix, suffix := kid.keyParts(0)
+		kv += 4 + len(prefix) + len(suffix) + COUNT_SIZE
+	}
+	newBNode := nodeBuf(nodeSize(0, int(node.nKeys())+len(split), kv))
+	nodeReplaceKidN(tree, newBNode, node, idx, split...)
+	return newBNode
 }
 
+// replaces the kid at idx with kids
+// the first kid keeps the old separator key unless its first key is lower (an insert below the separator)
+// the other ones are linked by their first key, so separators are never above the keys of their kid
 func nodeReplaceKidN(tree *BTree, newBNode, oldBNode BNode, idx uint16, kids ...BNode) {
-	newBNode.setHeader(BNODE_NODE, oldBNode.nKeys()+uint16(len(kids))-1)
+	n := oldBNode.nKeys()
+	inc := uint16(len(kids))
+	newBNode.setHeader(BNODE_NODE, n+inc-1)
+
+	s1, s2 := oldBNode.keyParts(idx)
+	if k1, k2 := kids[0].keyParts(0); cmpParts(k1, k2, s1, s2) < 0 {
+		s1, s2 = k1, k2
+	}
+
+	f1, f2 := oldBNode.keyParts(0)
+	if idx == 0 {
+		f1, f2 = s1, s2
+	}
+	l1, l2 := oldBNode.keyParts(n - 1)
+	if idx == n-1 {
+		l1, l2 = s1, s2
+		if inc > 1 {
+			l1, l2 = kids[inc-1].keyParts(0)
+		}
+	}
+	setPrefixOf(newBNode, f1, f2, l1, l2)
 
 	// Copy nodes before the replacement point
 	nodeAppendRange(newBNode, oldBNode, 0, 0, idx)
@@ -378,9 +550,24 @@ func nodeReplaceKidN(tree *BTree, newBNode, oldBNode BNode, idx uint16, kids ...
 		if err != nil {
 			panic("")
 		}
-		nodeAppendKV(newBNode, idx+uint16(i), kidNode, kid.getKey(0), nil)
+		prefix, suffix := kid.keyParts(0)
+		if i == 0 {
+			prefix, suffix = s1, s2
+		}
+		nodeAppendParts(newBNode, idx+uint16(i), kidNode, prefix, suffix, countVal(kid))
 	}
 
 	// Copy nodes after the replacement point
-	nodeAppendRange(newBNode, oldBNode, idx+uint16(len(kids)), idx+1, oldBNode.nKeys()-(idx+1))
+	nodeAppendRange(newBNode, oldBNode, idx+inc, idx+1, n-(idx+1))
+}
+
+// like nodeAppendKV with the full key given as 2 parts
+// the new prefix is either a part of k1 or extends into k2
+func nodeAppendParts(newBNode BNode, idx uint16, ptr uint64, k1, k2, val []byte) {
+	newPrefix := len(newBNode.prefix())
+	if newPrefix <= len(k1) {
+		nodeWriteKV(newBNode, idx, ptr, k1[newPrefix:], k2, val)
+	} else {
+		nodeWriteKV(newBNode, idx, ptr, nil, k2[newPrefix-len(k1):], val)
+	}
 }
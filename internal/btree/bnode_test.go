@@ -0,0 +1,153 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the linear scans nodeLookupLE and nodeLookupE used before the binary search, kept as a reference
+func linearLookupLE(node BNode, key []byte) uint16 {
+	found := uint16(0)
+	for i := uint16(1); i < node.nKeys(); i++ {
+		cmp := bytes.Compare(node.getKey(i), key)
+		if cmp <= 0 {
+			found = i
+		}
+		if cmp >= 0 {
+			break
+		}
+	}
+	return found
+}
+
+func linearLookupE(node BNode, key []byte) (uint16, bool) {
+	for i := uint16(0); i < node.nKeys(); i++ {
+		cmp := bytes.Compare(node.getKey(i), key)
+		if cmp == 0 {
+			return i, true
+		}
+		if cmp > 0 {
+			break
+		}
+	}
+	return 0, false
+}
+
+// keys between 1 and 64 bytes sharing a few prefixes
+func mixedKeys(rng *rand.Rand, n int) [][]byte {
+	prefixes := []string{"", "user/", "tenant-0042/orders/", "k"}
+	keys := make([][]byte, n)
+	for i := range keys {
+		key := []byte(prefixes[rng.Intn(len(prefixes))])
+		for l := 1 + rng.Intn(40); l > 0; l-- {
+			key = append(key, byte('a'+rng.Intn(26)))
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// a full leaf with sorted keys taken from keys, the first one is the dummy key
+func leafOf(keys [][]byte) BNode {
+	sorted := [][]byte{nil}
+	seen := map[string]bool{"": true}
+	size := HEADER + 2 + 10 + 4
+	for _, key := range keys {
+		if seen[string(key)] || size+10+4+len(key) > BTREE_PAGE_SIZE {
+			continue
+		}
+		seen[string(key)] = true
+		sorted = append(sorted, key)
+		size += 10 + 4 + len(key)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, uint16(len(sorted)))
+	for i, key := range sorted {
+		nodeAppendKV(node, uint16(i), 0, key, nil)
+	}
+	return node
+}
+
+func TestNodeLookupMatchesLinear(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		node := leafOf(mixedKeys(rng, 300))
+		probes := mixedKeys(rng, 200)
+		for i := uint16(0); i < node.nKeys(); i++ {
+			probes = append(probes, node.getKey(i))
+		}
+
+		for _, key := range probes {
+			assert.Equal(t, linearLookupLE(node, key), nodeLookupLE(node, key), "%q", key)
+			idx, ok := nodeLookupE(node, key)
+			lidx, lok := linearLookupE(node, key)
+			assert.Equal(t, lok, ok, "%q", key)
+			assert.Equal(t, lidx, idx, "%q", key)
+		}
+	}
+}
+
+func benchmarkLookup(b *testing.B, lookup func(BNode, []byte) uint16) {
+	rng := rand.New(rand.NewSource(1))
+	node := leafOf(mixedKeys(rng, 1000))
+	probes := mixedKeys(rng, 1024)
+	b.ReportMetric(float64(node.nKeys()), "keys/node")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(node, probes[i%len(probes)])
+	}
+}
+
+func BenchmarkNodeLookupLE(b *testing.B) {
+	b.Run("binary", func(b *testing.B) { benchmarkLookup(b, nodeLookupLE) })
+	b.Run("linear", func(b *testing.B) { benchmarkLookup(b, linearLookupLE) })
+}
+
+func BenchmarkNodeLookupE(b *testing.B) {
+	lookupE := func(f func(BNode, []byte) (uint16, bool)) func(BNode, []byte) uint16 {
+		return func(node BNode, key []byte) uint16 {
+			idx, _ := f(node, key)
+			return idx
+		}
+	}
+	b.Run("binary", func(b *testing.B) { benchmarkLookup(b, lookupE(nodeLookupE)) })
+	b.Run("linear", func(b *testing.B) { benchmarkLookup(b, lookupE(linearLookupE)) })
+}
+
+// point lookups and inserts on an in-memory tree with mixed key sizes
+func BenchmarkTreeMixedKeys(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		rng := rand.New(rand.NewSource(1))
+		keys := mixedKeys(rng, n)
+
+		b.Run(fmt.Sprintf("Get/%d", n), func(b *testing.B) {
+			c := newC()
+			for _, key := range keys {
+				c.tree.Insert(key, key)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.tree.Get(keys[i%len(keys)])
+			}
+		})
+
+		b.Run(fmt.Sprintf("Insert/%d", n), func(b *testing.B) {
+			c := newC()
+			for _, key := range keys {
+				c.tree.Insert(key, key)
+			}
+			extra := mixedKeys(rng, 4096)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.tree.Insert(extra[i%len(extra)], nil)
+			}
+		})
+	}
+}
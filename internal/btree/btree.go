@@ -1,8 +1,6 @@
 package btree
 
-import (
-	"bytes"
-)
+import "bytes"
 
 // The methods are inside the struct to isolate what the BTree is able to do
 // The tree knows nothing about Writing to file, it isolates the mathematical structure
@@ -17,6 +15,11 @@ type BTree struct {
 
 // Inserts key, val into BTree
 func (tree *BTree) Insert(key, val []byte) {
+	tree.InsertFlags(key, val, 0)
+}
+
+// Inserts key, val with the value flags (VAL_COMPRESSED) stored next to it
+func (tree *BTree) InsertFlags(key, val []byte, flags uint16) {
 	// If BTree is empty insert a dummy key plus the key, val passed as parameters
 	if tree.root == 0 {
 		root := BNode(make([]byte, BTREE_PAGE_SIZE))
@@ -29,6 +32,7 @@ func (tree *BTree) Insert(key, val []byte) {
 		// the dummy key is the smallest possible node
 		nodeAppendKV(root, 0, 0, nil, nil)
 		nodeAppendKV(root, 1, 0, key, val)
+		root.setValFlags(1, flags)
 		var err error
 		tree.root, err = tree.newBNode(root)
 		if err != nil {
@@ -37,34 +41,41 @@ func (tree *BTree) Insert(key, val []byte) {
 		return
 	}
 
-	node := treeInsert(tree, tree.get(tree.root), key, val)
-	nsplit, split := nodeSplit3(node)
+	node := treeInsert(tree, tree.get(tree.root), key, val, flags)
 	tree.del(tree.root)
-	if nsplit > 1 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_NODE, nsplit)
+	tree.root = treeGrow(tree, nodeSplitN(node))
+}
 
-		for i, knode := range split[:nsplit] {
+// allocates the nodes of a split root and adds levels on top of them until there's a single root
+func treeGrow(tree *BTree, split []BNode) uint64 {
+	for len(split) > 1 {
+		kv := 0
+		for _, knode := range split {
+			prefix, suffix := knode.keyParts(0)
+			kv += 4 + len(prefix) + len(suffix) + COUNT_SIZE
+		}
+		root := nodeBuf(nodeSize(0, len(split), kv))
+		root.setHeader(BNODE_NODE, uint16(len(split)))
+		f1, f2 := split[0].keyParts(0)
+		l1, l2 := split[len(split)-1].keyParts(0)
+		setPrefixOf(root, f1, f2, l1, l2)
+
+		for i, knode := range split {
 			ptr, err := tree.newBNode(knode)
 			if err != nil {
 				panic("")
 			}
-			key := knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+			prefix, suffix := knode.keyParts(0)
+			nodeAppendParts(root, uint16(i), ptr, prefix, suffix, countVal(knode))
 		}
+		split = nodeSplitN(root)
+	}
 
-		var err error
-		tree.root, err = tree.newBNode(root)
-		if err != nil {
-			panic("")
-		}
-	} else {
-		var err error
-		tree.root, err = tree.newBNode(split[0])
-		if err != nil {
-			panic("")
-		}
+	ptr, err := tree.newBNode(split[0])
+	if err != nil {
+		panic("")
 	}
+	return ptr
 }
 
 func (tree *BTree) Delete(key []byte) bool {
@@ -80,15 +91,18 @@ func (tree *BTree) Delete(key []byte) bool {
 
 	tree.del(tree.root)
 
-	if updated.nKeys() == 0 {
+	switch {
+	case updated.nKeys() == 0:
 		// Tree became empty
 		tree.root = 0
-	} else {
-		var err error
-		tree.root, err = tree.newBNode(updated)
-		if err != nil {
-			panic("")
-		}
+	case updated.bType() == BNODE_LEAF && updated.nKeys() == 1 && len(updated.getKey(0)) == 0:
+		// only the dummy key is left
+		tree.root = 0
+	case updated.bType() == BNODE_NODE && updated.nKeys() == 1:
+		// the root has a single child, remove one level
+		tree.root = updated.getPtr(0)
+	default:
+		tree.root = treeGrow(tree, nodeSplitN(updated))
 	}
 
 	return true
@@ -96,48 +110,84 @@ func (tree *BTree) Delete(key []byte) bool {
 
 // Gets the val for the key, returns true if key is found
 func (tree *BTree) Get(key []byte) ([]byte, bool) {
-	root := BNode(tree.get(tree.root))
-	idx := nodeLookupLE(root, key)
-	//fmt.Println(string(key), idx)
+	val, _, ok := tree.GetFlags(key)
+	return val, ok
+}
 
-	if root.bType() == BNODE_LEAF {
-		idx, ok := nodeLookupE(root, key)
-		if ok {
-			return root.getVal(idx), true
-		}
-		return nil, false
+// Gets the val for the key and its flags
+func (tree *BTree) GetFlags(key []byte) ([]byte, uint16, bool) {
+	if tree.root == 0 {
+		return nil, 0, false
 	}
 
-	offset := BNode(root).getOffset(idx)
-	node := BNode(tree.get(uint64(offset)))
-
+	node := BNode(tree.get(tree.root))
 	for node.bType() == BNODE_NODE {
-		idx = nodeLookupLE(node, key)
-		offset = BNode(node).getOffset(idx)
-		node = BNode(tree.get(uint64(offset)))
+		idx := nodeLookupLE(node, key)
+		node = BNode(tree.get(node.getPtr(idx)))
 	}
 
-	idx = nodeLookupLE(node, key)
-	if idx == 0 {
-		return nil, false
+	idx, ok := nodeLookupE(node, key)
+	if !ok {
+		return nil, 0, false
 	}
 
-	return node.getVal(idx), true
+	return node.getVal(idx), node.getValFlags(idx), true
 }
 
 // remove a key from a leaf node
 func leafDelete(new BNode, old BNode, idx uint16) {
-	new.setHeader(BNODE_LEAF, old.nKeys()-1)
+	n := old.nKeys()
+	new.setHeader(BNODE_LEAF, n-1)
+	if n > 1 {
+		first, last := uint16(0), n-1
+		if idx == 0 {
+			first = 1
+		}
+		if idx == n-1 {
+			last = n - 2
+		}
+		f1, f2 := old.keyParts(first)
+		l1, l2 := old.keyParts(last)
+		setPrefixOf(new, f1, f2, l1, l2)
+	}
 
 	// Copy all keys before the deleted one
 	nodeAppendRange(new, old, 0, 0, idx)
 	// Copy all keys after the deleted one
-	nodeAppendRange(new, old, idx, idx+1, old.nKeys()-(idx+1))
+	nodeAppendRange(new, old, idx, idx+1, n-(idx+1))
+}
+
+// first and last keys of left and right together, either node may be empty
+func mergedBounds(left, right BNode) (f1, f2, l1, l2 []byte) {
+	first, last := left, right
+	if left.nKeys() == 0 {
+		first = right
+	}
+	if right.nKeys() == 0 {
+		last = left
+	}
+	f1, f2 = first.keyParts(0)
+	l1, l2 = last.keyParts(last.nKeys() - 1)
+	return
+}
+
+// size of the node holding the keys of left and right
+func mergedSize(left, right BNode) int {
+	n := int(left.nKeys()) + int(right.nKeys())
+	if n == 0 {
+		return nodeSize(0, 0, 0)
+	}
+	f1, f2, l1, l2 := mergedBounds(left, right)
+	return nodeSize(commonPrefix(f1, f2, l1, l2), n, left.kvBytes()+right.kvBytes())
 }
 
 // merge 2 nodes into 1
 func nodeMerge(new BNode, left BNode, right BNode) {
 	new.setHeader(left.bType(), left.nKeys()+right.nKeys())
+	if left.nKeys()+right.nKeys() > 0 {
+		f1, f2, l1, l2 := mergedBounds(left, right)
+		setPrefixOf(new, f1, f2, l1, l2)
+	}
 
 	// Copy all keys from left node
 	nodeAppendRange(new, left, 0, 0, left.nKeys())
@@ -145,38 +195,42 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 	nodeAppendRange(new, right, left.nKeys(), 0, right.nKeys())
 }
 
-// replace 2 adjacent links with 1
+// replace 2 adjacent links with 1 to merged, key is the separator of the first one
 func nodeReplace2Kid(
-	new BNode, old BNode, idx uint16, ptr uint64, key []byte,
+	new BNode, old BNode, idx uint16, ptr uint64, key []byte, merged BNode,
 ) {
-	new.setHeader(BNODE_NODE, old.nKeys()-1)
+	n := old.nKeys()
+	new.setHeader(BNODE_NODE, n-1)
+	f1, f2 := old.keyParts(0)
+	l1, l2 := old.keyParts(n - 1)
+	if idx+2 == n {
+		l1, l2 = nil, key
+	}
+	setPrefixOf(new, f1, f2, l1, l2)
 
 	// Copy nodes before the replacement point
 	nodeAppendRange(new, old, 0, 0, idx)
 	// Insert the merged node
-	nodeAppendKV(new, idx, ptr, key, nil)
+	nodeAppendKV(new, idx, ptr, key, countVal(merged))
 	// Copy nodes after the replacement point (skip one)
-	nodeAppendRange(new, old, idx+1, idx+2, old.nKeys()-(idx+2))
+	nodeAppendRange(new, old, idx+1, idx+2, n-(idx+2))
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nBytes() > BTREE_PAGE_SIZE/4 {
+	if updated.nBytes() > BTREE_NODE_SIZE/4 {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
 		sibling := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sibling.nBytes() + updated.nBytes() - HEADER
-
-		if merged <= BTREE_PAGE_SIZE {
+		if mergedSize(sibling, updated) <= BTREE_NODE_SIZE {
 			return -1, sibling
 		}
 	}
 
 	if idx+1 < node.nKeys() {
 		sibling := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sibling.nBytes() + updated.nBytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if mergedSize(updated, sibling) <= BTREE_NODE_SIZE {
 			return +1, sibling
 		}
 	}
@@ -190,7 +244,7 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 
 	switch node.bType() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
+		if node.cmpKey(idx, key) == 0 {
 			// Key found in leaf - delete it
 			new := BNode(make([]byte, BTREE_PAGE_SIZE))
 			leafDelete(new, node, idx)
@@ -208,6 +262,7 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	}
 }
 
+// the separators of the kids are kept when they change, they are still less or equal to their keys
 func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	kptr := node.getPtr(idx)
 	updated := treeDelete(tree, tree.get(kptr), key)
@@ -217,7 +272,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	}
 	tree.del(kptr)
 
-	newBnode := BNode(make([]byte, BTREE_PAGE_SIZE))
+	newBnode := nodeBuf(nodeSize(0, int(node.nKeys())+1, node.kvBytes()+4+BTREE_MAX_KEY_SIZE+COUNT_SIZE))
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0:
@@ -228,7 +283,7 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		if err != nil {
 			panic("")
 		}
-		nodeReplace2Kid(newBnode, node, idx-1, mergedBNode, merged.getKey(0))
+		nodeReplace2Kid(newBnode, node, idx-1, mergedBNode, node.getKey(idx-1), merged)
 	case mergeDir > 0:
 		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
 		nodeMerge(merged, updated, sibling)
@@ -237,15 +292,223 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		if err != nil {
 			panic("")
 		}
-		nodeReplace2Kid(newBnode, node, idx, mergedBNode, merged.getKey(0))
+		nodeReplace2Kid(newBnode, node, idx, mergedBNode, node.getKey(idx), merged)
 	case mergeDir == 0 && updated.nKeys() == 0:
 		if !(node.nKeys() == 1 && idx == 0) {
 			panic("")
 		}
 		newBnode.setHeader(BNODE_NODE, 0)
 	case mergeDir == 0 && updated.nKeys() > 0:
-		nodeReplaceKidN(tree, newBnode, node, idx, updated)
+		// a node from an older file gains the prefix field and may not fit anymore
+		nodeReplaceKidN(tree, newBnode, node, idx, nodeSplitN(updated)...)
 	}
 
 	return newBnode
 }
+
+// DeleteRange removes the keys in [start, end), a nil end means no upper bound
+// kids entirely inside the range are freed without being read, except for the internal nodes above the leaves
+// the nodes at the boundaries are merged with their siblings like in Delete
+// returns true if the tree changed
+func (tree *BTree) DeleteRange(start, end []byte) bool {
+	if tree.root == 0 || (end != nil && bytes.Compare(start, end) >= 0) {
+		return false
+	}
+
+	updated := treeDeleteRange(tree, BNode(tree.get(tree.root)), treeHeight(tree), nil, nil, start, end)
+	if len(updated) == 0 {
+		return false
+	}
+	tree.del(tree.root)
+
+	// levels left with a single kid are removed
+	for updated.bType() == BNODE_NODE && updated.nKeys() == 1 {
+		kptr := updated.getPtr(0)
+		updated = BNode(tree.get(kptr))
+		tree.del(kptr)
+	}
+	if updated.nKeys() == 0 || (updated.bType() == BNODE_LEAF && updated.nKeys() == 1 && len(updated.getKey(0)) == 0) {
+		tree.root = 0
+		return true
+	}
+	tree.root = treeGrow(tree, nodeSplitN(updated))
+	return true
+}
+
+// removes the keys in [start, end) from the subtree of node, whose keys are in [lo, hi)
+// returns an empty BNode if nothing changed, a node without keys if everything went
+func treeDeleteRange(tree *BTree, node BNode, height int, lo, hi, start, end []byte) BNode {
+	if node.bType() == BNODE_LEAF {
+		return leafDeleteRange(node, start, end)
+	}
+
+	// the kids that stay, updated is set for the ones that changed
+	type kid struct {
+		ptr     uint64
+		key     []byte
+		count   []byte
+		updated BNode
+	}
+	kids := []kid{}
+	changed := false
+	for i := uint16(0); i < node.nKeys(); i++ {
+		klo, khi := node.getKey(i), hi
+		if i == 0 {
+			klo = lo
+		}
+		if i+1 < node.nKeys() {
+			khi = node.getKey(i + 1)
+		}
+
+		switch {
+		case (end != nil && bytes.Compare(klo, end) >= 0) || (khi != nil && bytes.Compare(khi, start) <= 0):
+			// outside of the range
+			kids = append(kids, kid{ptr: node.getPtr(i), key: node.getKey(i), count: node.getVal(i)})
+		case len(klo) > 0 && bytes.Compare(klo, start) >= 0 && (end == nil || (khi != nil && bytes.Compare(khi, end) <= 0)):
+			// inside of the range, the kid holding the dummy key is never dropped
+			treeFree(tree, node.getPtr(i), height-1)
+			changed = true
+		default:
+			updated := treeDeleteRange(tree, tree.get(node.getPtr(i)), height-1, klo, khi, start, end)
+			if len(updated) == 0 {
+				kids = append(kids, kid{ptr: node.getPtr(i), key: node.getKey(i), count: node.getVal(i)})
+				continue
+			}
+			tree.del(node.getPtr(i))
+			changed = true
+			if updated.nKeys() > 0 {
+				kids = append(kids, kid{key: node.getKey(i), updated: updated})
+			}
+		}
+	}
+	if !changed {
+		return BNode{}
+	}
+
+	// the kids that changed are merged with a sibling if they got small
+	for i := 0; i < len(kids); i++ {
+		if kids[i].updated == nil {
+			continue
+		}
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(kids) || kids[i].updated.nBytes() > BTREE_NODE_SIZE/4 {
+				continue
+			}
+			sibling := kids[j].updated
+			if sibling == nil {
+				sibling = tree.get(kids[j].ptr)
+			}
+			left, right := min(i, j), max(i, j)
+			lnode, rnode := kids[i].updated, sibling
+			if j < i {
+				lnode, rnode = sibling, kids[i].updated
+			}
+			if mergedSize(lnode, rnode) > BTREE_NODE_SIZE {
+				continue
+			}
+
+			merged := BNode(make([]byte, BTREE_PAGE_SIZE))
+			nodeMerge(merged, lnode, rnode)
+			if kids[j].updated == nil {
+				tree.del(kids[j].ptr)
+			}
+			kids[left] = kid{key: kids[left].key, updated: merged}
+			kids = append(kids[:right], kids[right+1:]...)
+			i = left - 1 // the merged kid may merge again
+			break
+		}
+	}
+
+	kv := 0
+	for _, k := range kids {
+		kv += 4 + len(k.key) + COUNT_SIZE
+	}
+	newBNode := nodeBuf(nodeSize(0, len(kids), kv))
+	newBNode.setHeader(BNODE_NODE, uint16(len(kids)))
+	if len(kids) == 0 {
+		return newBNode
+	}
+	setPrefixOf(newBNode, nil, kids[0].key, nil, kids[len(kids)-1].key)
+	for i, k := range kids {
+		ptr, count := k.ptr, k.count
+		if k.updated != nil {
+			split := nodeSplitN(k.updated)
+			if len(split) > 1 {
+				// only nodes from older files, shrinking never makes a node bigger
+				panic("node grew after a range delete")
+			}
+			var err error
+			if ptr, err = tree.newBNode(split[0]); err != nil {
+				panic("")
+			}
+			count = countVal(split[0])
+		}
+		nodeAppendKV(newBNode, uint16(i), ptr, k.key, count)
+	}
+	return newBNode
+}
+
+// the keys of the leaf outside of [start, end), the dummy key stays
+func leafDeleteRange(node BNode, start, end []byte) BNode {
+	n := node.nKeys()
+	from := nodeLookupGE(node, start)
+	if from == 0 && len(node.getKey(0)) == 0 {
+		from = 1
+	}
+	to := n
+	if end != nil {
+		to = nodeLookupGE(node, end)
+	}
+	if from >= to {
+		return BNode{}
+	}
+
+	newBNode := BNode(make([]byte, BTREE_PAGE_SIZE))
+	newBNode.setHeader(BNODE_LEAF, n-(to-from))
+	if n-(to-from) > 0 {
+		first, last := uint16(0), n-1
+		if from == 0 {
+			first = to
+		}
+		if to == n {
+			last = from - 1
+		}
+		f1, f2 := node.keyParts(first)
+		l1, l2 := node.keyParts(last)
+		setPrefixOf(newBNode, f1, f2, l1, l2)
+	}
+	nodeAppendRange(newBNode, node, 0, 0, from)
+	nodeAppendRange(newBNode, node, from, to, n-to)
+	return newBNode
+}
+
+// levels of the tree, the leaves are all at the same depth
+func treeHeight(tree *BTree) int {
+	if tree.root == 0 {
+		return 0
+	}
+	height := 1
+	for node := BNode(tree.get(tree.root)); node.bType() == BNODE_NODE; height++ {
+		node = BNode(tree.get(node.getPtr(0)))
+	}
+	return height
+}
+
+// frees every page of the tree and leaves it empty, the leaves are not read
+func (tree *BTree) Drop() {
+	if tree.root != 0 {
+		treeFree(tree, tree.root, treeHeight(tree))
+		tree.root = 0
+	}
+}
+
+// frees the pages of a subtree, the leaves are not read
+func treeFree(tree *BTree, ptr uint64, height int) {
+	if height > 1 {
+		node := BNode(tree.get(ptr))
+		for i := uint16(0); i < node.nKeys(); i++ {
+			treeFree(tree, node.getPtr(i), height-1)
+		}
+	}
+	tree.del(ptr)
+}
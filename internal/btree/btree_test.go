@@ -1,8 +1,14 @@
 package btree
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"maps"
+	"math/rand"
+	"slices"
+	"sort"
 	"testing"
 	"unsafe"
 
@@ -336,7 +342,7 @@ func TestTreeRootNode(t *testing.T) {
 	}
 
 	// Verify all child pointers are valid
-	for i := uint16(0); i < rootNode.nKeys(); i++ {
+	for i := uint16(0); rootNode.bType() == BNODE_NODE && i < rootNode.nKeys(); i++ {
 		ptr := rootNode.getPtr(i)
 		if _, exists := c.pages[ptr]; !exists {
 			t.Fatalf("Root child pointer %d points to non-existent page", i)
@@ -392,3 +398,532 @@ func TestTreeComprehensive(t *testing.T) {
 	t.Run("RootNode", TestTreeRootNode)
 	t.Run("MemoryManagement", TestTreeMemoryManagement)
 }
+
+func TestTreeIterator(t *testing.T) {
+	c := newC()
+
+	keys := []string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i*2)
+		c.tree.Insert([]byte(key), []byte("value"))
+		keys = append(keys, key)
+	}
+
+	// forward from the middle, between two keys
+	iter := c.tree.Seek([]byte("key01001"))
+	for i := 501; i < len(keys); i++ {
+		if !iter.Valid() {
+			t.Fatalf("iterator ended early at %s", keys[i])
+		}
+		key, _ := iter.Deref()
+		assert.Equal(t, keys[i], string(key))
+		iter.Next()
+	}
+	assert.False(t, iter.Valid())
+
+	// backward to the dummy key
+	iter = c.tree.SeekLE([]byte("key01001"))
+	for i := 500; i >= 0; i-- {
+		key, _ := iter.Deref()
+		assert.Equal(t, keys[i], string(key))
+		iter.Prev()
+	}
+	key, _ := iter.Deref()
+	assert.Empty(t, key)
+	iter.Prev()
+	assert.False(t, iter.Valid())
+}
+
+// compares the whole tree with the reference map
+func checkRef(t *testing.T, c *C) {
+	t.Helper()
+	keys := []string{}
+	for key := range c.ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	got := []string{}
+	for iter := c.tree.Seek([]byte{0}); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		got = append(got, string(key))
+		if c.ref[string(key)] != string(val) {
+			t.Fatalf("key %q has value %q, expected %q", key, val, c.ref[string(key)])
+		}
+	}
+	assert.Equal(t, keys, got)
+
+	// the iterator doesn't use the separators, lookups do
+	for _, key := range keys {
+		val, ok := c.tree.Get([]byte(key))
+		if !ok || string(val) != c.ref[key] {
+			t.Fatalf("lookup of %q failed", key)
+		}
+	}
+	if c.tree.root != 0 {
+		checkSeparators(t, c, c.tree.root, nil, nil)
+		checkCounts(t, c, c.tree.root)
+		assert.Equal(t, uint64(len(keys)+1), c.tree.Len())
+	}
+
+	for _, node := range c.pages {
+		if node.nBytes() > BTREE_NODE_SIZE {
+			t.Fatalf("page exceeds size limit: %d", node.nBytes())
+		}
+	}
+}
+
+// every key under a separator is in [separator, next separator)
+func checkSeparators(t *testing.T, c *C, ptr uint64, lo, hi []byte) {
+	t.Helper()
+	node := BNode(c.tree.get(ptr))
+	for i := uint16(0); i < node.nKeys(); i++ {
+		key := node.getKey(i)
+		if (lo != nil && bytes.Compare(key, lo) < 0) || (hi != nil && bytes.Compare(key, hi) >= 0) {
+			t.Fatalf("key %q out of [%q, %q)", key, lo, hi)
+		}
+		if node.bType() == BNODE_NODE {
+			next := hi
+			if i+1 < node.nKeys() {
+				next = node.getKey(i + 1)
+			}
+			checkSeparators(t, c, node.getPtr(i), key, next)
+		}
+	}
+}
+
+// the stored counts match the keys under each kid, returns the keys under ptr
+func checkCounts(t *testing.T, c *C, ptr uint64) uint64 {
+	t.Helper()
+	node := BNode(c.tree.get(ptr))
+	if node.bType() == BNODE_LEAF {
+		return uint64(node.nKeys())
+	}
+	total := uint64(0)
+	for i := uint16(0); i < node.nKeys(); i++ {
+		n := checkCounts(t, c, node.getPtr(i))
+		if val := node.getVal(i); len(val) == COUNT_SIZE && binary.LittleEndian.Uint64(val) != n {
+			t.Fatalf("kid %d of %q counts %d keys, it has %d", i, node.getKey(0), binary.LittleEndian.Uint64(val), n)
+		}
+		total += n
+	}
+	return total
+}
+
+func TestTreePrefixCompression(t *testing.T) {
+	c := newC()
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("tenant-000042/users/%08d", i)
+		c.tree.Insert([]byte(key), []byte("v"))
+		c.ref[key] = "v"
+	}
+	checkRef(t, c)
+
+	// without the prefix each key takes 14+29+1 bytes, 91 keys per page
+	leaves := 0
+	for _, node := range c.pages {
+		if node.bType() == BNODE_LEAF {
+			leaves++
+		}
+	}
+	assert.Less(t, leaves, 3000/91)
+
+	// keys outside the shared prefix shorten it, then deletes bring it back
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		var key string
+		switch rng.Intn(3) {
+		case 0:
+			key = fmt.Sprintf("tenant-000042/users/%08d", rng.Intn(4000))
+		case 1:
+			key = fmt.Sprintf("tenant-000042/%d", rng.Intn(100))
+		default:
+			key = fmt.Sprintf("t%d", rng.Intn(100))
+		}
+		if rng.Intn(2) == 0 {
+			c.tree.Insert([]byte(key), []byte(key))
+			c.ref[key] = key
+		} else {
+			c.tree.Delete([]byte(key))
+			delete(c.ref, key)
+		}
+	}
+	checkRef(t, c)
+}
+
+// a leaf in the layout used before prefixes, without the flag and the prefix length
+func legacyLeaf(keys []string) BNode {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	binary.LittleEndian.PutUint16(node[0:2], BNODE_LEAF)
+	binary.LittleEndian.PutUint16(node[2:4], uint16(len(keys)))
+	pos := HEADER + 10*len(keys)
+	offset := 0
+	for i, key := range keys {
+		binary.LittleEndian.PutUint16(node[HEADER+8*len(keys)+2*i:], uint16(offset+4+2*len(key)))
+		binary.LittleEndian.PutUint16(node[pos+offset:], uint16(len(key)))
+		binary.LittleEndian.PutUint16(node[pos+offset+2:], uint16(len(key)))
+		copy(node[pos+offset+4:], key)
+		copy(node[pos+offset+4+len(key):], key)
+		offset += 4 + 2*len(key)
+	}
+	return node
+}
+
+func TestTreeLegacyNodes(t *testing.T) {
+	c := newC()
+	keys := []string{""}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("legacy/%04d", i))
+	}
+	root := legacyLeaf(keys)
+	assert.False(t, root.hasPrefix())
+	ptr, err := c.tree.newBNode(root)
+	assert.NoError(t, err)
+	c.tree.root = ptr
+	for _, key := range keys[1:] {
+		c.ref[key] = key
+	}
+	checkRef(t, c)
+
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("legacy/%04d", i)
+		assert.True(t, c.tree.Delete([]byte(key)))
+		delete(c.ref, key)
+	}
+	for i := 100; i < 300; i++ {
+		key := fmt.Sprintf("legacy/%04d", i)
+		c.tree.Insert([]byte(key), []byte(key))
+		c.ref[key] = key
+	}
+	checkRef(t, c)
+	assert.True(t, BNode(c.tree.get(c.tree.root)).hasPrefix())
+}
+
+// pages reachable from the root
+func countPages(c *C, ptr uint64) int {
+	node := BNode(c.tree.get(ptr))
+	n := 1
+	if node.bType() == BNODE_NODE {
+		for i := uint16(0); i < node.nKeys(); i++ {
+			n += countPages(c, node.getPtr(i))
+		}
+	}
+	return n
+}
+
+func TestTreeDeleteRange(t *testing.T) {
+	c := newC()
+	rng := rand.New(rand.NewSource(1))
+	for _, key := range mixedKeys(rng, 5000) {
+		c.tree.Insert(key, key)
+		c.ref[string(key)] = string(key)
+	}
+
+	for round := 0; round < 100; round++ {
+		keys := mixedKeys(rng, 2)
+		start, end := keys[0], keys[1]
+		if bytes.Compare(start, end) > 0 {
+			start, end = end, start
+		}
+		if round%10 == 0 {
+			end = nil
+		}
+
+		removed := false
+		for key := range c.ref {
+			if key >= string(start) && (end == nil || key < string(end)) {
+				delete(c.ref, key)
+				removed = true
+			}
+		}
+		assert.Equal(t, removed, c.tree.DeleteRange(start, end))
+
+		for _, key := range mixedKeys(rng, 50) {
+			c.tree.Insert(key, key)
+			c.ref[string(key)] = string(key)
+		}
+		checkRef(t, c)
+		if c.tree.root != 0 {
+			// everything that was unlinked was freed
+			assert.Equal(t, len(c.pages), countPages(c, c.tree.root))
+		}
+	}
+
+	assert.True(t, c.tree.DeleteRange(nil, nil))
+	c.ref = map[string]string{}
+	checkRef(t, c)
+	assert.Equal(t, uint64(0), c.tree.root)
+	assert.Empty(t, c.pages)
+}
+
+func TestTreeDeleteRangeSkipsLeaves(t *testing.T) {
+	c := newC()
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		c.tree.Insert([]byte(key), []byte(key))
+	}
+	pages := len(c.pages)
+
+	reads := 0
+	get := c.tree.get
+	c.tree.get = func(ptr uint64) []byte {
+		reads++
+		return get(ptr)
+	}
+	assert.True(t, c.tree.DeleteRange([]byte("key001000"), []byte("key019000")))
+	c.tree.get = get
+
+	assert.Less(t, reads, pages/10)
+	assert.Less(t, len(c.pages), pages/5)
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		c.ref[key] = key
+		if i >= 1000 && i < 19000 {
+			delete(c.ref, key)
+		}
+	}
+	checkRef(t, c)
+}
+
+// Rank and Select against the sorted keys
+func checkOrderStatistics(t *testing.T, c *C, rng *rand.Rand) {
+	t.Helper()
+	keys := []string{""}
+	for key := range c.ref {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i := 0; i < 200; i++ {
+		probe := string(mixedKeys(rng, 1)[0])
+		if i%2 == 0 {
+			probe = keys[rng.Intn(len(keys))]
+		}
+		assert.Equal(t, uint64(sort.SearchStrings(keys, probe)), c.tree.Rank([]byte(probe)), probe)
+
+		k := rng.Intn(len(keys))
+		key, val, _, ok := c.tree.Select(uint64(k))
+		assert.True(t, ok)
+		assert.Equal(t, keys[k], string(key))
+		assert.Equal(t, c.ref[keys[k]], string(val))
+	}
+	_, _, _, ok := c.tree.Select(uint64(len(keys)))
+	assert.False(t, ok)
+}
+
+func TestTreeOrderStatistics(t *testing.T) {
+	c := newC()
+	assert.Equal(t, uint64(0), c.tree.Rank([]byte("a")))
+	_, _, _, ok := c.tree.Select(0)
+	assert.False(t, ok)
+
+	rng := rand.New(rand.NewSource(3))
+	for _, key := range mixedKeys(rng, 20000) {
+		c.tree.Insert(key, key)
+		c.ref[string(key)] = string(key)
+	}
+	checkRef(t, c)
+	checkOrderStatistics(t, c, rng)
+
+	// merges and range deletes rewrite the counts
+	for key := range c.ref {
+		if rng.Intn(3) > 0 {
+			c.tree.Delete([]byte(key))
+			delete(c.ref, key)
+		}
+	}
+	c.tree.DeleteRange([]byte("k"), []byte("tenant"))
+	for key := range c.ref {
+		if key >= "k" && key < "tenant" {
+			delete(c.ref, key)
+		}
+	}
+	checkRef(t, c)
+	checkOrderStatistics(t, c, rng)
+}
+
+func TestTreeLegacyCounts(t *testing.T) {
+	c := newC()
+	// 2 legacy leaves under an internal node without counts
+	keys := []string{""}
+	for i := 0; i < 60; i++ {
+		keys = append(keys, fmt.Sprintf("legacy/%04d", i))
+	}
+	root := BNode(make([]byte, BTREE_PAGE_SIZE))
+	root.setHeader(BNODE_NODE, 2)
+	setPrefixOf(root, nil, nil, nil, []byte(keys[30]))
+	for i, leaf := range [][]string{keys[:30], keys[30:]} {
+		ptr, err := c.tree.newBNode(legacyLeaf(leaf))
+		assert.NoError(t, err)
+		nodeAppendKV(root, uint16(i), ptr, []byte(leaf[0]), nil)
+	}
+	ptr, err := c.tree.newBNode(root)
+	assert.NoError(t, err)
+	c.tree.root = ptr
+	for _, key := range keys[1:] {
+		c.ref[key] = key
+	}
+
+	rng := rand.New(rand.NewSource(4))
+	checkRef(t, c)
+	checkOrderStatistics(t, c, rng)
+
+	// the nodes get their counts once every kid has been rewritten
+	assert.True(t, c.tree.Delete([]byte("legacy/0001")))
+	delete(c.ref, "legacy/0001")
+	_, ok := nodeCount(BNode(c.tree.get(c.tree.root)))
+	assert.False(t, ok)
+	for i := 60; i < 2000; i++ {
+		key := fmt.Sprintf("legacy/%04d", i)
+		c.tree.Insert([]byte(key), []byte(key))
+		c.ref[key] = key
+	}
+	checkRef(t, c)
+	checkOrderStatistics(t, c, rng)
+	_, ok = nodeCount(BNode(c.tree.get(c.tree.root)))
+	assert.True(t, ok)
+}
+
+// node invariants of the whole tree: page sizes, key order inside nodes, separators,
+// counts, leaves at the same depth and no page leaked or missing
+func checkNodes(t *testing.T, c *C) {
+	t.Helper()
+	if c.tree.root == 0 {
+		assert.Empty(t, c.pages, "pages left in an empty tree")
+		return
+	}
+	depth := -1
+	var walk func(ptr uint64, level int) int
+	walk = func(ptr uint64, level int) int {
+		node, ok := c.pages[ptr]
+		if !ok {
+			t.Fatalf("pointer %d to a missing page", ptr)
+		}
+		if node.bType() != BNODE_LEAF && node.bType() != BNODE_NODE {
+			t.Fatalf("page %d has type %d", ptr, node.bType())
+		}
+		if node.nKeys() == 0 || node.nBytes() > BTREE_NODE_SIZE {
+			t.Fatalf("page %d has %d keys in %d bytes", ptr, node.nKeys(), node.nBytes())
+		}
+		for i := uint16(1); i < node.nKeys(); i++ {
+			if bytes.Compare(node.getKey(i-1), node.getKey(i)) >= 0 {
+				t.Fatalf("page %d: key %q is not above %q", ptr, node.getKey(i), node.getKey(i-1))
+			}
+		}
+		if node.bType() == BNODE_LEAF {
+			if depth >= 0 && depth != level {
+				t.Fatalf("leaf %d at depth %d, other leaves are at %d", ptr, level, depth)
+			}
+			depth = level
+			return 1
+		}
+		n := 1
+		for i := uint16(0); i < node.nKeys(); i++ {
+			n += walk(node.getPtr(i), level+1)
+		}
+		return n
+	}
+	if n := walk(c.tree.root, 0); n != len(c.pages) {
+		t.Fatalf("%d pages reachable out of %d", n, len(c.pages))
+	}
+	checkSeparators(t, c, c.tree.root, nil, nil)
+	checkCounts(t, c, c.tree.root)
+}
+
+// reads the fuzz input as tree operations, it returns zeros once it's consumed
+type fuzzInput struct {
+	data []byte
+}
+
+func (in *fuzzInput) byte() byte {
+	if len(in.data) == 0 {
+		return 0
+	}
+	b := in.data[0]
+	in.data = in.data[1:]
+	return b
+}
+
+// a short string taken from the input or a long one repeating a byte, from 1 to limit bytes
+// short keys collide often, long ones fill nodes and force splits
+func (in *fuzzInput) bytes(limit int) []byte {
+	n := int(in.byte())
+	if n < 0xf0 {
+		n = n%8 + 1
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = in.byte()
+		}
+		return out
+	}
+	n = (int(in.byte())<<8|int(in.byte()))%limit + 1
+	return bytes.Repeat([]byte{in.byte()}, n)
+}
+
+// runs the operations encoded in data, comparing the tree with a map after every step
+// the empty key is the dummy key, so keys have at least one byte
+func fuzzTree(t *testing.T, data []byte) {
+	c := newC()
+	in := &fuzzInput{data: data}
+	for step := 0; len(in.data) > 0; step++ {
+		switch op := in.byte() % 4; op {
+		case 0:
+			key, val := in.bytes(BTREE_MAX_KEY_SIZE), in.bytes(BTREE_MAX_VAL_SIZE)
+			c.tree.Insert(key, val)
+			c.ref[string(key)] = string(val)
+			checkNodes(t, c)
+		case 1:
+			key := in.bytes(BTREE_MAX_KEY_SIZE)
+			_, exists := c.ref[string(key)]
+			if c.tree.Delete(key) != exists {
+				t.Fatalf("step %d: delete of %q returned %v", step, key, !exists)
+			}
+			delete(c.ref, string(key))
+			checkNodes(t, c)
+		case 2:
+			key := in.bytes(BTREE_MAX_KEY_SIZE)
+			val, ok := c.tree.Get(key)
+			want, exists := c.ref[string(key)]
+			if ok != exists || string(val) != want {
+				t.Fatalf("step %d: get of %q returned %q %v, expected %q %v", step, key, val, ok, want, exists)
+			}
+		case 3:
+			start, limit := in.bytes(BTREE_MAX_KEY_SIZE), int(in.byte())
+			want := []string{}
+			for _, key := range slices.Sorted(maps.Keys(c.ref)) {
+				if key >= string(start) && len(want) < limit {
+					want = append(want, key)
+				}
+			}
+			got := []string{}
+			for iter := c.tree.Seek(start); iter.Valid() && len(got) < limit; iter.Next() {
+				key, val := iter.Deref()
+				if len(key) == 0 {
+					continue // dummy key
+				}
+				if string(val) != c.ref[string(key)] {
+					t.Fatalf("step %d: scan found %q = %q, expected %q", step, key, val, c.ref[string(key)])
+				}
+				got = append(got, string(key))
+			}
+			if !slices.Equal(want, got) {
+				t.Fatalf("step %d: scan from %q returned %q, expected %q", step, start, got, want)
+			}
+		}
+	}
+	checkRef(t, c)
+}
+
+func FuzzTree(f *testing.F) {
+	f.Add([]byte("\x00a1\x00b2\x02a\x01a\x03\x00\xff"))
+	// long keys and values, enough to split and merge nodes
+	seed := []byte{}
+	for i := 0; i < 40; i++ {
+		seed = append(seed, 0, 0xf0, 0x03, byte(i), 'k', 0xff, 0x0b, 0xb7, byte(i))
+	}
+	for i := 0; i < 40; i += 2 {
+		seed = append(seed, 1, 0xf0, 0x03, byte(i), 'k')
+	}
+	f.Add(append(seed, 3, 1, 0, 0xff))
+	f.Fuzz(fuzzTree)
+}
@@ -0,0 +1,242 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// buckets are keyspaces of their own in the same file
+// each one has a tree whose root is stored in the catalog under the bucket name
+// the keys of the main tree (KV.Get, KV.Set...) are not in any bucket
+// values in buckets may be compressed, they can't have a time to live
+
+var (
+	ErrBucketExists   = errors.New("bucket already exists")
+	ErrBucketNotFound = errors.New("bucket not found")
+)
+
+// Bucket is a handle to a bucket, it's valid while the bucket exists
+type Bucket struct {
+	db   *KV
+	name []byte
+}
+
+// Bucket returns a handle to the bucket name, it doesn't check that it exists
+func (db *KV) Bucket(name []byte) *Bucket {
+	return &Bucket{db: db, name: bytes.Clone(name)}
+}
+
+// CreateBucket creates an empty bucket, it fails with ErrBucketExists if there's one with that name
+func (db *KV) CreateBucket(name []byte) (*Bucket, error) {
+	err := db.Update(func(tx *Tx) error {
+		return tx.CreateBucket(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return db.Bucket(name), nil
+}
+
+// DeleteBucket deletes the bucket and frees all its pages
+func (db *KV) DeleteBucket(name []byte) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket(name)
+	})
+}
+
+// ListBuckets returns the names of the buckets in order
+func (db *KV) ListBuckets() (names [][]byte, err error) {
+	snap, release := db.pin()
+	defer release()
+	defer recoverCorrupt(&err, nil)
+
+	for iter := snap.catalog.Seek(nil); iter.Valid(); iter.Next() {
+		if name, _ := iter.Deref(); len(name) > 0 {
+			names = append(names, bytes.Clone(name))
+		}
+	}
+	return names, nil
+}
+
+// creates an empty bucket
+func (tx *Tx) CreateBucket(name []byte) error {
+	if len(name) == 0 || len(name) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("bucket name must have 1 to %d bytes", BTREE_MAX_KEY_SIZE)
+	}
+	if _, ok := tx.db.catalog.Get(name); ok {
+		return fmt.Errorf("%w: %q", ErrBucketExists, name)
+	}
+	setBucketRoot(tx.db, name, 0)
+	return nil
+}
+
+// deletes the bucket and frees all its pages
+func (tx *Tx) DeleteBucket(name []byte) error {
+	tree, ok := bucketTree(tx.db, name)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrBucketNotFound, name)
+	}
+	tree.Drop()
+	tx.db.catalog.Delete(name)
+	return nil
+}
+
+// the tree of the bucket, with the callbacks of the main tree
+func bucketTree(db *KV, name []byte) (BTree, bool) {
+	if len(name) == 0 {
+		return BTree{}, false // the dummy key of the catalog
+	}
+	val, ok := db.catalog.Get(name)
+	if !ok {
+		return BTree{}, false
+	}
+	tree := db.tree
+	tree.root = binary.LittleEndian.Uint64(val)
+	return tree, true
+}
+
+func setBucketRoot(db *KV, name []byte, root uint64) {
+	db.catalog.Insert(name, binary.LittleEndian.AppendUint64(nil, root))
+}
+
+// gets the value for key, returns false if the bucket or the key don't exist
+// the value is a copy like the one of KV.Get
+func (b *Bucket) Get(key []byte) ([]byte, bool) {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	val, ok := (&TxBucket{tx: &Tx{db: b.db}, name: b.name}).Get(key)
+	return bytes.Clone(val), ok
+}
+
+// inserts or updates key
+func (b *Bucket) Set(key, val []byte) error {
+	return b.db.Update(func(tx *Tx) error {
+		return tx.Bucket(b.name).Set(key, val)
+	})
+}
+
+// deletes key, returns true if it existed
+func (b *Bucket) Del(key []byte) (bool, error) {
+	return b.update(func(tb *TxBucket) (bool, error) {
+		return tb.Del(key)
+	})
+}
+
+// deletes the keys in [start, end) in a single commit, returns true if there was any
+func (b *Bucket) DeleteRange(start, end []byte) (bool, error) {
+	return b.update(func(tb *TxBucket) (bool, error) {
+		return tb.DeleteRange(start, end)
+	})
+}
+
+// like KV.Del, only commits if fn changed something
+func (b *Bucket) update(fn func(tb *TxBucket) (bool, error)) (_ bool, err error) {
+	db := b.db
+	if db.readOnly() {
+		return false, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	meta := saveMeta(db)
+	defer recoverCorrupt(&err, func() { revert(db, meta) })
+	changed, err := fn((&Tx{db: db}).Bucket(b.name))
+	if err != nil || !changed {
+		revert(db, meta)
+		return false, err
+	}
+	return true, updateOrRevert(db, meta)
+}
+
+// Scan calls fn for every key of the bucket in [start, end) like KV.Scan
+func (b *Bucket) Scan(start, end []byte, fn func(key, val []byte) bool) error {
+	snap, release := b.db.pin()
+	defer release()
+
+	val, ok := snap.catalog.Get(b.name)
+	if !ok || len(b.name) == 0 {
+		return fmt.Errorf("%w: %q", ErrBucketNotFound, b.name)
+	}
+	tree := BTree{root: binary.LittleEndian.Uint64(val), get: snap.tree.get}
+
+	for iter := tree.Seek(start); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if len(key) == 0 {
+			continue // dummy key
+		}
+		if !fn(key, mustDecodeVal(key, val, iter.Flags())) {
+			break
+		}
+	}
+	return nil
+}
+
+// TxBucket is a bucket inside a transaction
+type TxBucket struct {
+	tx   *Tx
+	name []byte
+}
+
+// the bucket name inside the transaction
+func (tx *Tx) Bucket(name []byte) *TxBucket {
+	return &TxBucket{tx: tx, name: name}
+}
+
+// gets the value for key, returns false if the bucket or the key don't exist
+// like the one of Tx.Get, the value is only valid inside the transaction
+func (b *TxBucket) Get(key []byte) ([]byte, bool) {
+	tree, ok := bucketTree(b.tx.db, b.name)
+	if !ok {
+		return nil, false
+	}
+	val, flags, ok := tree.GetFlags(key)
+	if !ok || len(key) == 0 {
+		return nil, false
+	}
+	return mustDecodeVal(key, val, flags), true
+}
+
+// inserts or updates key
+func (b *TxBucket) Set(key, val []byte) error {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	tree, ok := bucketTree(b.tx.db, b.name)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrBucketNotFound, b.name)
+	}
+	val, flags := b.tx.db.encodeVal(val)
+	tree.InsertFlags(key, val, flags)
+	setBucketRoot(b.tx.db, b.name, tree.root)
+	return nil
+}
+
+// deletes key, returns true if it existed
+func (b *TxBucket) Del(key []byte) (bool, error) {
+	tree, ok := bucketTree(b.tx.db, b.name)
+	if !ok {
+		return false, fmt.Errorf("%w: %q", ErrBucketNotFound, b.name)
+	}
+	if len(key) == 0 || !tree.Delete(key) {
+		return false, nil
+	}
+	setBucketRoot(b.tx.db, b.name, tree.root)
+	return true, nil
+}
+
+// deletes the keys in [start, end), returns true if there was any
+func (b *TxBucket) DeleteRange(start, end []byte) (bool, error) {
+	tree, ok := bucketTree(b.tx.db, b.name)
+	if !ok {
+		return false, fmt.Errorf("%w: %q", ErrBucketNotFound, b.name)
+	}
+	if !tree.DeleteRange(start, end) {
+		return false, nil
+	}
+	setBucketRoot(b.tx.db, b.name, tree.root)
+	return true, nil
+}
@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// fill factor used by BulkLoad when none is given
+const BULK_FILL = 0.9
+
+var ErrUnsorted = errors.New("bulk load input is not sorted")
+
+// an entry waiting to be written in a node, ptr is only used by internal nodes
+type bulkEntry struct {
+	key   []byte
+	val   []byte
+	flags uint16
+	ptr   uint64
+}
+
+// the node being filled at each level of the tree, level 0 are the leaves
+type bulkLevel struct {
+	entries []bulkEntry
+	kv      int // size of the kv pairs of the entries
+}
+
+// builds a tree bottom-up from sorted entries
+// nodes are written as soon as they are full, so only one node per level is kept in memory
+type bulkBuilder struct {
+	alloc  func([]byte) (uint64, error)
+	limit  int // target size of a node
+	levels []bulkLevel
+}
+
+// BulkLoad builds the tree of an empty database from key value pairs in strictly increasing order
+// nodes are packed up to fill (a fraction of the page, BULK_FILL if 0) and everything is committed once
+// unsorted input or a duplicated key fails with ErrUnsorted and nothing is committed
+func (db *KV) BulkLoad(pairs iter.Seq2[[]byte, []byte], fill float64) (int, error) {
+	if fill == 0 {
+		fill = BULK_FILL
+	}
+	if !(fill > 0 && fill <= 1) {
+		return 0, fmt.Errorf("bulk load: fill factor %v is not in (0, 1]", fill)
+	}
+	if db.readOnly() {
+		return 0, ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.tree.root != 0 {
+		return 0, ErrNotEmpty
+	}
+
+	meta := saveMeta(db)
+	builder := &bulkBuilder{
+		limit: int(fill * BTREE_NODE_SIZE),
+		alloc: func(node []byte) (uint64, error) {
+			ptr, err := db.pageAlloc(node)
+			// the new pages are not reachable before the meta page is written
+			// so they can go to the file early instead of piling up in memory
+			if err == nil && len(db.page.temp) >= IOV_MAX {
+				err = writePages(db)
+			}
+			return ptr, err
+		},
+	}
+
+	n := 0
+	prev := []byte{} // the dummy key
+	err := builder.add(0, bulkEntry{})
+	for key, val := range pairs {
+		if err != nil {
+			break
+		}
+		if bytes.Compare(prev, key) >= 0 {
+			err = fmt.Errorf("%w: key %q at position %d is not greater than %q", ErrUnsorted, key, n, prev)
+			break
+		}
+		if err = checkKV(key, val); err != nil {
+			break
+		}
+
+		prev = bytes.Clone(key)
+		db.watch.recordSet(db, prev, val)
+		val, flags := db.encodeVal(val)
+		err = builder.add(0, bulkEntry{key: prev, val: bytes.Clone(val), flags: flags})
+		n++
+	}
+
+	if err == nil && n > 0 {
+		db.tree.root, err = builder.finish()
+	}
+	if err != nil {
+		revert(db, meta)
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	return n, updateOrRevert(db, meta)
+}
+
+// appends an entry to the node of the level, the node is written first if the entry doesn't fit
+func (b *bulkBuilder) add(level int, entry bulkEntry) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, bulkLevel{})
+	}
+
+	lvl := &b.levels[level]
+	kv := 4 + len(entry.key) + len(entry.val)
+	if len(lvl.entries) > 0 {
+		plen := commonPrefix(nil, lvl.entries[0].key, nil, entry.key)
+		if nodeSize(plen, len(lvl.entries)+1, lvl.kv+kv) > b.limit {
+			if err := b.flush(level); err != nil {
+				return err
+			}
+		}
+	}
+
+	lvl = &b.levels[level] // flush may grow b.levels
+	lvl.entries = append(lvl.entries, entry)
+	lvl.kv += kv
+	return nil
+}
+
+// writes the node of the level and links it in the level above
+func (b *bulkBuilder) flush(level int) error {
+	lvl := &b.levels[level]
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	if level == 0 {
+		node.setHeader(BNODE_LEAF, uint16(len(lvl.entries)))
+	} else {
+		node.setHeader(BNODE_NODE, uint16(len(lvl.entries)))
+	}
+	setPrefixOf(node, nil, lvl.entries[0].key, nil, lvl.entries[len(lvl.entries)-1].key)
+	for i, e := range lvl.entries {
+		nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+		node.setValFlags(uint16(i), e.flags)
+	}
+
+	count := countVal(node)
+	ptr, err := b.alloc(node)
+	if err != nil {
+		return err
+	}
+	first := lvl.entries[0].key
+	lvl.entries = lvl.entries[:0]
+	lvl.kv = 0
+
+	return b.add(level+1, bulkEntry{key: first, ptr: ptr, val: count})
+}
+
+// writes the partially filled nodes from the bottom up and returns the root
+func (b *bulkBuilder) finish() (uint64, error) {
+	for level := 0; ; level++ {
+		lvl := b.levels[level]
+		if level > 0 && level == len(b.levels)-1 && len(lvl.entries) == 1 {
+			return lvl.entries[0].ptr, nil
+		}
+		if err := b.flush(level); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package btree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// with KV.CachePages set, or a storage that can't be mapped, pages are read with pread into a LRU cache
+// the cache holds copies (decrypted for encrypted files), evicting a page only drops it from the cache
+// so a reader still using it keeps it alive and the tree callbacks don't need to release pages
+//
+// pinned pages are never evicted, the roots of the trees are pinned after every commit
+// so a scan that fills the cache doesn't push out the pages every lookup starts from
+
+type pageCache struct {
+	store Storage
+	limit int // pages kept, pinned ones included
+	// called on every page read from the file, decrypts it
+	open func(ptr uint64, page []byte) []byte
+
+	mu     sync.Mutex
+	pages  map[uint64]*cachedPage
+	lru    list.List // unpinned pages, the most recently used at the front
+	pinned map[uint64]bool
+	hits   uint64
+	misses uint64
+}
+
+type cachedPage struct {
+	ptr  uint64
+	data []byte
+	elem *list.Element // nil while pinned
+}
+
+func newPageCache(store Storage, limit int, open func(uint64, []byte) []byte) *pageCache {
+	return &pageCache{
+		store:  store,
+		limit:  max(limit, 1),
+		open:   open,
+		pages:  map[uint64]*cachedPage{},
+		pinned: map[uint64]bool{},
+	}
+}
+
+// returns the page ptr, reading it from the file on a miss
+func (c *pageCache) get(ptr uint64) []byte {
+	c.mu.Lock()
+	if page, ok := c.pages[ptr]; ok {
+		c.hits++
+		if page.elem != nil {
+			c.lru.MoveToFront(page.elem)
+		}
+		c.mu.Unlock()
+		return page.data
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// the file is read without the lock, concurrent misses on the same page read it twice
+	data := make([]byte, BTREE_PAGE_SIZE)
+	if n, err := c.store.ReadAt(data, int64(ptr*BTREE_PAGE_SIZE)); err != nil || n != BTREE_PAGE_SIZE {
+		panic(corruptf("read page %d: %d bytes, %v", ptr, n, err))
+	}
+	if c.open != nil {
+		data = c.open(ptr, data)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if page, ok := c.pages[ptr]; ok {
+		return page.data
+	}
+	page := &cachedPage{ptr: ptr, data: data}
+	c.pages[ptr] = page
+	if !c.pinned[ptr] {
+		page.elem = c.lru.PushFront(page)
+	}
+	c.evict()
+	return data
+}
+
+// drops the least recently used pages over the limit
+func (c *pageCache) evict() {
+	for len(c.pages) > c.limit && c.lru.Len() > 0 {
+		page := c.lru.Remove(c.lru.Back()).(*cachedPage)
+		delete(c.pages, page.ptr)
+	}
+}
+
+// forgets a page before it's overwritten in the file
+func (c *pageCache) drop(ptr uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if page, ok := c.pages[ptr]; ok {
+		if page.elem != nil {
+			c.lru.Remove(page.elem)
+		}
+		delete(c.pages, ptr)
+	}
+}
+
+// pins ptrs and unpins everything else
+func (c *pageCache) pinOnly(ptrs ...uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pinned := map[uint64]bool{}
+	for _, ptr := range ptrs {
+		if ptr != 0 {
+			pinned[ptr] = true
+		}
+	}
+	for ptr := range c.pinned {
+		if page, ok := c.pages[ptr]; ok && !pinned[ptr] {
+			page.elem = c.lru.PushFront(page)
+		}
+	}
+	for ptr := range pinned {
+		if page, ok := c.pages[ptr]; ok && page.elem != nil {
+			c.lru.Remove(page.elem)
+			page.elem = nil
+		}
+	}
+	c.pinned = pinned
+	c.evict()
+}
+
+// hits and misses since the database was opened
+func (c *pageCache) stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,106 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// compressed values are stored as
+// | raw size | deflate stream |
+// | uvarint  | ...            |
+// and flagged with VAL_COMPRESSED in their leaf
+
+// the writers allocate several hundred KB, so they are reused
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, err := flate.NewWriter(nil, flate.DefaultCompression)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() any {
+		return flate.NewReader(nil)
+	},
+}
+
+// compresses val if it's at least db.CompressMin bytes and it gets smaller
+// returns the value to store and its flags
+func (db *KV) encodeVal(val []byte) ([]byte, uint16) {
+	if db.CompressMin <= 0 || len(val) < db.CompressMin {
+		return val, 0
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(val)))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(val))))
+
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	// writes to a bytes.Buffer don't fail
+	_, _ = w.Write(val)
+	_ = w.Close()
+
+	if buf.Len() >= len(val) {
+		return val, 0
+	}
+	return buf.Bytes(), VAL_COMPRESSED
+}
+
+// returns the value as it was given to Set
+func decodeVal(val []byte, flags uint16) ([]byte, error) {
+	if flags&VAL_TTL != 0 {
+		if len(val) < 8 {
+			return nil, fmt.Errorf("bad expiry time")
+		}
+		val = val[8:]
+	}
+	if flags&VAL_COMPRESSED == 0 {
+		return val, nil
+	}
+
+	size, n := binary.Uvarint(val)
+	if n <= 0 || size > BTREE_MAX_VAL_SIZE {
+		return nil, fmt.Errorf("bad compressed value header")
+	}
+
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(val[n:]), nil); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	return raw, nil
+}
+
+// decodeVal for values read from the tree, which only fails if the page is corrupted
+func mustDecodeVal(key, val []byte, flags uint16) []byte {
+	raw, err := decodeVal(val, flags)
+	if err != nil {
+		panic(corruptf("key %q: %v", key, err))
+	}
+	return raw
+}
+
+// size of the value before compression
+func rawValSize(val []byte, flags uint16) int {
+	if flags&VAL_TTL != 0 {
+		val = val[8:]
+	}
+	if flags&VAL_COMPRESSED == 0 {
+		return len(val)
+	}
+	size, _ := binary.Uvarint(val)
+	return int(size)
+}
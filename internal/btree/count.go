@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// internal nodes store the number of keys under each kid as its value
+// | count |
+// | 8B    |
+// the count includes the dummy key, so it's the number of entries of the leaves below the kid
+// nodes written before the format version 5 have empty values, their counts are read from the subtree
+// and the nodes above them are written without a count until the subtree is rewritten
+const COUNT_SIZE = 8
+
+// the value of the link to node in its parent, empty if the count of a kid is unknown
+func countVal(node BNode) []byte {
+	n, ok := nodeCount(node)
+	if !ok {
+		return nil
+	}
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+// number of keys under node, false if a kid has no count
+func nodeCount(node BNode) (uint64, bool) {
+	if node.bType() == BNODE_LEAF {
+		return uint64(node.nKeys()), true
+	}
+	total := uint64(0)
+	for i := uint16(0); i < node.nKeys(); i++ {
+		val := node.getVal(i)
+		if len(val) != COUNT_SIZE {
+			return 0, false
+		}
+		total += binary.LittleEndian.Uint64(val)
+	}
+	return total, true
+}
+
+// number of keys under the kid at idx, the subtree is read if the count is unknown
+func kidCount(tree *BTree, node BNode, idx uint16) uint64 {
+	if val := node.getVal(idx); len(val) == COUNT_SIZE {
+		return binary.LittleEndian.Uint64(val)
+	}
+	kid := BNode(tree.get(node.getPtr(idx)))
+	if kid.bType() == BNODE_LEAF {
+		return uint64(kid.nKeys())
+	}
+	total := uint64(0)
+	for i := uint16(0); i < kid.nKeys(); i++ {
+		total += kidCount(tree, kid, i)
+	}
+	return total
+}
+
+// Len returns the number of keys of the tree, including the dummy key
+func (tree *BTree) Len() uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+	node := BNode(tree.get(tree.root))
+	if node.bType() == BNODE_LEAF {
+		return uint64(node.nKeys())
+	}
+	total := uint64(0)
+	for i := uint16(0); i < node.nKeys(); i++ {
+		total += kidCount(tree, node, i)
+	}
+	return total
+}
+
+// Rank returns the number of keys less than key, O(log n) when every node has its counts
+func (tree *BTree) Rank(key []byte) uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+
+	rank := uint64(0)
+	node := BNode(tree.get(tree.root))
+	for node.bType() == BNODE_NODE {
+		// the keys of the kids before idx are below the separator of idx
+		idx := nodeLookupLE(node, key)
+		for i := uint16(0); i < idx; i++ {
+			rank += kidCount(tree, node, i)
+		}
+		node = BNode(tree.get(node.getPtr(idx)))
+	}
+	return rank + uint64(nodeLookupGE(node, key))
+}
+
+// Select returns the key at position k in order (the dummy key is at 0), false if there are not that many keys
+func (tree *BTree) Select(k uint64) (key, val []byte, flags uint16, ok bool) {
+	if tree.root == 0 {
+		return nil, nil, 0, false
+	}
+
+	node := BNode(tree.get(tree.root))
+	for node.bType() == BNODE_NODE {
+		idx := uint16(0)
+		for ; idx < node.nKeys(); idx++ {
+			count := kidCount(tree, node, idx)
+			if k < count {
+				break
+			}
+			k -= count
+		}
+		if idx == node.nKeys() {
+			return nil, nil, 0, false
+		}
+		node = BNode(tree.get(node.getPtr(idx)))
+	}
+	if k >= uint64(node.nKeys()) {
+		return nil, nil, 0, false
+	}
+	idx := uint16(k)
+	return node.getKey(idx), node.getVal(idx), node.getValFlags(idx), true
+}
+
+// the rank of key among the keys of the KV, without the dummy key
+func kvRank(tree *BTree, key []byte) uint64 {
+	rank := tree.Rank(key)
+	if rank > 0 {
+		rank-- // the dummy key is below every other key
+	}
+	return rank
+}
+
+// Count returns the number of keys in [start, end) without scanning them, a nil end means no upper bound
+// expired keys are counted until the sweeper deletes them
+func (db *KV) Count(start, end []byte) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return 0
+	}
+	to := uint64(0)
+	if end != nil {
+		to = kvRank(&db.tree, end)
+	} else if db.tree.root != 0 {
+		to = db.tree.Len() - 1
+	}
+	return int(to - kvRank(&db.tree, start))
+}
+
+// Rank returns the number of keys less than key, so it's the position of key if it exists
+func (db *KV) Rank(key []byte) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return int(kvRank(&db.tree, key))
+}
+
+// Select returns the key and value at position k (starting at 0) in key order
+// like Count, it sees expired keys until the sweeper deletes them
+func (db *KV) Select(k int) ([]byte, []byte, bool) {
+	if k < 0 {
+		return nil, nil, false
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// the dummy key is at 0
+	key, val, flags, ok := db.tree.Select(uint64(k) + 1)
+	if !ok {
+		return nil, nil, false
+	}
+	return key, mustDecodeVal(key, val, flags), true
+}
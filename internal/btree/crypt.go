@@ -0,0 +1,189 @@
+package btree
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// pages of encrypted files, every page but the meta page
+// | ciphertext      | tag | write version | unused |
+// | BTREE_NODE_SIZE | 16B | 8B            | 8B     |
+// the 12 bytes nonce is the write version (7B) followed by the page number (5B)
+//
+// a (page, write version) pair is never sealed twice: the version grows with every write
+// and the meta page reserves the versions a process may use before it uses them
+//
+// the tail node of the free list is rewritten in place, a plain file only changes its unused slots
+// but a sealed page is replaced as a whole, so encrypted files need page writes that don't tear
+const (
+	WRITE_VERSION_BATCH = 1 << 20 // versions reserved at once
+	MAX_WRITE_VERSION   = 1 << 56
+	MAX_ENCRYPTED_PAGES = 1 << 40
+)
+
+// meta flags
+const META_ENCRYPTED = 1
+
+var (
+	ErrCorrupt   = errors.New("database corrupted")
+	ErrEncrypted = errors.New("database is encrypted, a key is required")
+	ErrBadKey    = errors.New("wrong encryption key")
+)
+
+// corruption found where reads can't return an error (the tree callbacks) panics with a corruptError
+// the KV methods returning an error turn it back into one
+type corruptError struct {
+	error
+}
+
+func corruptf(format string, args ...any) corruptError {
+	return corruptError{fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))}
+}
+
+// deferred by the KV methods, it recovers a corruptError into err and calls undo
+// any other panic goes on
+func recoverCorrupt(err *error, undo func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	c, ok := r.(corruptError)
+	if !ok {
+		panic(r)
+	}
+	if undo != nil {
+		undo()
+	}
+	*err = c.error
+}
+
+type pageCipher struct {
+	aead     cipher.AEAD
+	version  uint64 // write version of the next writePages
+	reserved uint64 // versions below it may have been used, it's kept in the meta page
+}
+
+func newPageCipher(key []byte) (*pageCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCipher{aead: aead}, nil
+}
+
+func pageNonce(version, ptr uint64) []byte {
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], ptr<<24)
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], version)
+	copy(nonce[:7], v[:7])
+	return nonce[:]
+}
+
+// encrypts the node stored at ptr
+func (c *pageCipher) seal(ptr uint64, node []byte, version uint64) []byte {
+	page := make([]byte, BTREE_PAGE_SIZE)
+	c.aead.Seal(page[:0], pageNonce(version, ptr), node[:BTREE_NODE_SIZE], nil)
+	binary.LittleEndian.PutUint64(page[BTREE_NODE_SIZE+16:], version)
+	return page
+}
+
+// decrypts the page at ptr, the bytes after BTREE_NODE_SIZE are left zero
+func (c *pageCipher) open(ptr uint64, page []byte) []byte {
+	version := binary.LittleEndian.Uint64(page[BTREE_NODE_SIZE+16:])
+	node := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := c.aead.Open(node[:0], pageNonce(version, ptr), page[:BTREE_NODE_SIZE+16], nil); err != nil {
+		panic(corruptf("page %d: %v", ptr, err))
+	}
+	return node
+}
+
+// the meta page keeps a block of zeros sealed with version 0, which is never used by pages
+// it tells a wrong key apart from a corrupted page
+func (c *pageCipher) keyCheck() []byte {
+	return c.aead.Seal(nil, pageNonce(0, 0), make([]byte, 16), nil)
+}
+
+// gets the write version for the next writePages
+// more versions are reserved in the meta page before they are used
+func (c *pageCipher) nextVersion(store Storage) (uint64, error) {
+	if c.version >= c.reserved {
+		if c.reserved+WRITE_VERSION_BATCH > MAX_WRITE_VERSION {
+			return 0, fmt.Errorf("encryption: write versions exhausted")
+		}
+		if err := c.reserve(store, c.reserved+WRITE_VERSION_BATCH); err != nil {
+			return 0, err
+		}
+	}
+	c.version++
+	return c.version - 1, nil
+}
+
+// the first write version of a restored file
+// it shares the key of the database it was backed up from, which goes on sealing pages with the next versions,
+// so it starts at a random point in the upper half of the versions, far from the ones of any file of that key
+func restoreVersion() (uint64, error) {
+	var data [8]byte
+	if _, err := rand.Read(data[:]); err != nil {
+		return 0, fmt.Errorf("encryption: %w", err)
+	}
+	return MAX_WRITE_VERSION/2 + binary.LittleEndian.Uint64(data[:])%(MAX_WRITE_VERSION/4), nil
+}
+
+// persists the reservation in place, the rest of the meta page is unchanged
+func (c *pageCipher) reserve(store Storage, reserved uint64) error {
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], reserved)
+	if _, err := store.WriteAt(data[:], 80); err != nil {
+		return fmt.Errorf("reserve write versions: %w", err)
+	}
+	if err := store.Sync(); err != nil {
+		return err
+	}
+	c.reserved = reserved
+	return nil
+}
+
+// sets up the encryption of db from the meta page, or for a new file if data is nil
+func openCipher(db *KV, data []byte) error {
+	encrypted := data != nil && binary.LittleEndian.Uint64(data[72:])&META_ENCRYPTED != 0
+	if data == nil {
+		encrypted = db.Key != nil
+	}
+
+	db.free.nodeCap = FREE_LIST_CAP
+	if !encrypted {
+		if db.Key != nil {
+			return fmt.Errorf("%w: the database is not encrypted", ErrBadKey)
+		}
+		return nil
+	}
+	if db.Key == nil {
+		return ErrEncrypted
+	}
+
+	c, err := newPageCipher(db.Key)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if _, err := c.aead.Open(nil, pageNonce(0, 0), data[88:120], nil); err != nil {
+			return ErrBadKey
+		}
+		c.version = binary.LittleEndian.Uint64(data[80:])
+	}
+	// version 0 belongs to the key check
+	c.version = max(c.version, 1)
+	c.reserved = c.version
+	db.crypt = c
+	db.free.nodeCap = FREE_LIST_CAP_ENCRYPTED
+	return nil
+}
@@ -0,0 +1,213 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// dump formats
+const (
+	FORMAT_JSONL = "jsonl"
+	FORMAT_CSV   = "csv"
+)
+
+// how keys and values are written inside a dump
+const (
+	ENCODING_BASE64 = "base64" // standard base64
+	ENCODING_ESCAPE = "escape" // Go string escapes, printable text stays readable
+)
+
+// number of keys committed at once by Import
+const IMPORT_BATCH = 1000
+
+var ErrNotEmpty = errors.New("database is not empty")
+
+// DumpOptions selects the dump format and the key range [Start, End)
+// the zero value means JSON Lines, base64 and every key
+type DumpOptions struct {
+	Format   string
+	Encoding string
+	Start    []byte
+	End      []byte // nil means no upper bound
+}
+
+// one line of a JSON Lines dump
+type dumpRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes every key in the range to w, returns the number of keys written
+// it reads a snapshot, so it doesn't block writers
+func (db *KV) Export(w io.Writer, opts DumpOptions) (_ int, err error) {
+	enc, _, err := dumpCodec(opts.Encoding)
+	if err != nil {
+		return 0, err
+	}
+
+	var write func(key, val []byte) error
+	var flush func() error
+	switch opts.Format {
+	case "", FORMAT_JSONL:
+		bw := bufio.NewWriter(w)
+		je := json.NewEncoder(bw)
+		write = func(key, val []byte) error {
+			return je.Encode(dumpRecord{Key: enc(key), Value: enc(val)})
+		}
+		flush = bw.Flush
+	case FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"key", "value"}); err != nil {
+			return 0, err
+		}
+		write = func(key, val []byte) error {
+			return cw.Write([]string{enc(key), enc(val)})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown dump format %q", opts.Format)
+	}
+
+	n := 0
+	defer recoverCorrupt(&err, nil)
+	db.Scan(opts.Start, opts.End, func(key, val []byte) bool {
+		if err = write(key, val); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, flush()
+}
+
+// Import loads a dump written by Export into an empty database
+// keys outside [Start, End) are skipped, the keys are committed in batches of IMPORT_BATCH
+// progress, if not nil, is called after each commit with the number of keys loaded so far
+// on error the batches committed before it stay in the database
+func (db *KV) Import(r io.Reader, opts DumpOptions, progress func(n int)) (int, error) {
+	_, dec, err := dumpCodec(opts.Encoding)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mu.RLock()
+	empty := db.tree.root == 0
+	db.mu.RUnlock()
+	if !empty {
+		return 0, ErrNotEmpty
+	}
+
+	var read func() (string, string, error)
+	switch opts.Format {
+	case "", FORMAT_JSONL:
+		jd := json.NewDecoder(r)
+		read = func() (string, string, error) {
+			var rec dumpRecord
+			err := jd.Decode(&rec)
+			return rec.Key, rec.Value, err
+		}
+	case FORMAT_CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		header, err := cr.Read()
+		if err != nil {
+			return 0, fmt.Errorf("csv header: %w", err)
+		}
+		if header[0] != "key" || header[1] != "value" {
+			return 0, fmt.Errorf("csv header: expected key,value got %v", header)
+		}
+		read = func() (string, string, error) {
+			rec, err := cr.Read()
+			if err != nil {
+				return "", "", err
+			}
+			return rec[0], rec[1], nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown dump format %q", opts.Format)
+	}
+
+	n, line := 0, 0
+	done := false
+	for !done {
+		batch := 0
+		err := db.Update(func(tx *Tx) error {
+			for batch < IMPORT_BATCH {
+				k, v, err := read()
+				if err == io.EOF {
+					done = true
+					return nil
+				}
+				line++
+				if err != nil {
+					return fmt.Errorf("record %d: %w", line, err)
+				}
+
+				key, err := dec(k)
+				if err != nil {
+					return fmt.Errorf("record %d: key: %w", line, err)
+				}
+				val, err := dec(v)
+				if err != nil {
+					return fmt.Errorf("record %d: value: %w", line, err)
+				}
+				if !inRange(key, opts.Start, opts.End) {
+					continue
+				}
+				if err := tx.Set(key, val); err != nil {
+					return fmt.Errorf("record %d: %w", line, err)
+				}
+				batch++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+
+		n += batch
+		if progress != nil && batch > 0 {
+			progress(n)
+		}
+	}
+
+	return n, nil
+}
+
+// key is inside [start, end), a nil end means no upper bound
+func inRange(key, start, end []byte) bool {
+	return string(key) >= string(start) && (end == nil || string(key) < string(end))
+}
+
+// returns the encoder and decoder for the dump encoding
+func dumpCodec(encoding string) (func([]byte) string, func(string) ([]byte, error), error) {
+	switch encoding {
+	case "", ENCODING_BASE64:
+		return base64.StdEncoding.EncodeToString, base64.StdEncoding.DecodeString, nil
+	case ENCODING_ESCAPE:
+		enc := func(b []byte) string {
+			quoted := strconv.Quote(string(b))
+			return quoted[1 : len(quoted)-1]
+		}
+		dec := func(s string) ([]byte, error) {
+			unquoted, err := strconv.Unquote(`"` + s + `"`)
+			return []byte(unquoted), err
+		}
+		return enc, dec, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown dump encoding %q", encoding)
+	}
+}
@@ -1,5 +1,7 @@
 package btree
 
+import "encoding/binary"
+
 // Node format
 // |next	|pointers	|unused	|
 // | 8B		| n*8B		| ...	|
@@ -8,10 +10,28 @@ type LNode []byte
 const FREE_LIST_HEADER = 8
 const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
-func (node LNode) getNext() uint64
-func (node LNode) setNext(next uint64)
-func (node LNode) getPtr(idx int) uint64
-func (node LNode) setPtr(idx int, ptr uint64)
+// encrypted files keep the page trailer free in the free list nodes too
+const FREE_LIST_CAP_ENCRYPTED = (BTREE_NODE_SIZE - FREE_LIST_HEADER) / 8
+
+// pointer to the next node of the list
+func (node LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(node[0:8])
+}
+
+func (node LNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(node[0:8], next)
+}
+
+// gets the free page pointer stored at idx
+func (node LNode) getPtr(idx int) uint64 {
+	pos := FREE_LIST_HEADER + 8*idx
+	return binary.LittleEndian.Uint64(node[pos:])
+}
+
+func (node LNode) setPtr(idx int, ptr uint64) {
+	pos := FREE_LIST_HEADER + 8*idx
+	binary.LittleEndian.PutUint64(node[pos:], ptr)
+}
 
 type FreeList struct {
 	get         func(uint64) []byte // read a page
@@ -28,7 +48,8 @@ type FreeList struct {
 	// acts like a snapshot
 	// it's a pointer to tailSeq but it updates after
 	maxSeq uint64 //saved tailSeqto prevent consuming newly added items
-
+	// pointers per node, FREE_LIST_CAP or FREE_LIST_CAP_ENCRYPTED
+	nodeCap uint64
 }
 
 // Pops head and pushes to tail
@@ -43,10 +64,10 @@ func (fl *FreeList) PopHead() uint64 {
 // pushes ptr to tailSeq++
 func (fl *FreeList) PushTail(ptr uint64) {
 	//add it to the tail node
-	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl.tailSeq), ptr)
+	LNode(fl.set(fl.tailPage)).setPtr(fl.seq2idx(fl.tailSeq), ptr)
 	fl.tailSeq++
 	//add a new tail node if it's null (the list is never empty)
-	if seq2idx(fl.tailSeq) == 0 {
+	if fl.seq2idx(fl.tailSeq) == 0 {
 		//try to rescue from the list head
 		next, head := flPop(fl) //may remove the head node
 		if next == 0 {
@@ -65,8 +86,8 @@ func (fl *FreeList) PushTail(ptr uint64) {
 }
 
 // translates the global seq to a local index inside the current page
-func seq2idx(seq uint64) int {
-	return int(seq % FREE_LIST_CAP)
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % fl.nodeCap)
 }
 
 // make the newly added items available for consumption
@@ -83,10 +104,10 @@ func flPop(fl *FreeList) (ptr uint64, head uint64) {
 	}
 
 	node := LNode(fl.get(fl.headPage))
-	ptr = node.getPtr(seq2idx(fl.headSeq)) //item
+	ptr = node.getPtr(fl.seq2idx(fl.headSeq)) //item
 	fl.headSeq++
 	//move to the next one if the head node is empty
-	if seq2idx(fl.headSeq) == 0 {
+	if fl.seq2idx(fl.headSeq) == 0 {
 		head, fl.headPage = fl.headPage, node.getNext()
 		if fl.headPage == 0 {
 			panic("head page cannot be 0")
@@ -0,0 +1,125 @@
+package btree
+
+import "bytes"
+
+// BIter walks the leaves in key order
+// path holds the nodes from the root to the current leaf and pos the index inside each of them
+type BIter struct {
+	tree *BTree
+	path []BNode
+	pos  []uint16
+}
+
+// finds the closest position that is less or equal to key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	if tree.root == 0 {
+		return iter
+	}
+
+	for ptr := tree.root; ptr != 0; {
+		node := BNode(tree.get(ptr))
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.bType() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+
+	// a separator may be less than the first key of its kid, the key is then in the previous leaf
+	last := len(iter.path) - 1
+	if iter.Valid() && iter.path[last].cmpKey(iter.pos[last], key) > 0 {
+		iter.Prev()
+	}
+
+	return iter
+}
+
+// finds the first position that is greater or equal to key
+func (tree *BTree) Seek(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if iter.Valid() {
+		if cur, _ := iter.Deref(); bytes.Compare(cur, key) < 0 {
+			iter.Next()
+		}
+	}
+	return iter
+}
+
+// the iterator points to a key
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	return iter.pos[last] < iter.path[last].nKeys()
+}
+
+// gets the current key value pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	return node.getKey(iter.pos[last]), node.getVal(iter.pos[last])
+}
+
+// gets the flags of the current value
+func (iter *BIter) Flags() uint16 {
+	last := len(iter.path) - 1
+	return iter.path[last].getValFlags(iter.pos[last])
+}
+
+// moves to the next key, the iterator is invalid after the last one
+func (iter *BIter) Next() {
+	if !iter.Valid() {
+		return
+	}
+	last := len(iter.path) - 1
+	if !iterNext(iter, last) {
+		iter.pos[last] = iter.path[last].nKeys()
+	}
+}
+
+// moves to the previous key, the iterator is invalid before the first one
+func (iter *BIter) Prev() {
+	last := len(iter.path) - 1
+	if !iterPrev(iter, last) {
+		iter.pos[last] = iter.path[last].nKeys()
+	}
+}
+
+// returns false if there is no next position, in this case nothing is changed
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nKeys() {
+		iter.pos[level]++ // move within this node
+		return true
+	}
+	if level == 0 || !iterNext(iter, level-1) {
+		return false
+	}
+
+	// the parent moved to a sibling, load its first kid
+	parent := iter.path[level-1]
+	iter.path[level] = BNode(iter.tree.get(parent.getPtr(iter.pos[level-1])))
+	iter.pos[level] = 0
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 && iter.pos[level] <= iter.path[level].nKeys() {
+		iter.pos[level]-- // move within this node
+		return true
+	}
+	if level == 0 || !iterPrev(iter, level-1) {
+		return false
+	}
+
+	// the parent moved to a sibling, load its last kid
+	parent := iter.path[level-1]
+	kid := BNode(iter.tree.get(parent.getPtr(iter.pos[level-1])))
+	iter.path[level] = kid
+	iter.pos[level] = kid.nKeys() - 1
+	return true
+}
@@ -1,23 +1,87 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"sync"
 	"syscall"
-
-	"golang.org/x/sys/unix"
+	"time"
 )
 
 const DB_SIG = "DB6"
 
+// meta page layout
+// | sig | root | flushed | fl head page | fl head seq | fl tail page | fl tail seq | version |
+// | 16B | 8B   | 8B      | 8B           | 8B          | 8B           | 8B          | 8B      |
+// | flags | write version | key check | ttl root | catalog root | commit version |
+// | 8B    | 8B            | 32B       | 8B       | 8B           | 8B             |
+// write version and key check are only set for encrypted files (META_ENCRYPTED)
+// the commit version counts the commits since the file was created
+const META_SIZE = 144
+
+// version of the file format written by this code
+// 0 -> nodes without prefix, files from before the version field
+// 1 -> nodes may store a shared key prefix (BNODE_PREFIX)
+// 2 -> nodes keep the page trailer free, files may be encrypted
+// 3 -> expiry index (ttl root)
+// 4 -> bucket catalog (catalog root)
+// 5 -> internal nodes store the key count of each kid
+// 6 -> commit version
+// older versions are read as they are and upgraded by the next commit
+const FORMAT_VERSION = 6
+
+// limit of buffers for a single pwritev
+const IOV_MAX = 1024
+
+// returned by every write to a database opened with KV.ReadOnly or KV.Follower
+var ErrReadOnly = errors.New("database is read-only")
+
 type KV struct {
 	Path string //file name
-	fd   int    // file descriptor
+	// the file is opened O_RDONLY, it must exist, and every write returns ErrReadOnly
+	// the lock is shared, so several read-only processes can open it but no writer
+	ReadOnly bool
+	// values of at least this many bytes are compressed when it makes them smaller, 0 disables it
+	// it can be changed at any time, compressed and plain values are read alike
+	CompressMin int
+	// AES key (16, 24 or 32 bytes), a new file is encrypted if it's set and an encrypted file needs it
+	Key []byte
+	// how often expired keys are deleted in the background, 0 means TTL_SWEEP_INTERVAL and negative disables it
+	SweepInterval time.Duration
+	// if set the file is read with pread into a LRU cache of this many pages instead of being mapped
+	CachePages int
+	// how long Open waits for another process to release the file before returning ErrLocked
+	LockTimeout time.Duration
+	// if set the database lives in it instead of the file at Path, Close closes it
+	Storage Storage
+	// the database lives in memory instead of the file at Path and it's lost on Close
+	InMemory bool
+	// the database is a replica written only by Follow, every other write returns ErrReadOnly
+	// unlike ReadOnly the file is opened for writing and locked exclusively
+	Follower bool
+	// number of recent commits kept in memory for ServeReplica, 0 disables it
+	// a follower that falls further behind gets a new base copy
+	ReplicationLog int
+	// number of recent commits whose changes are kept in memory for Watch, 0 disables it
+	WatchLog int
+	// merge functions of Merge by key prefix, the longest prefix of a key wins and "" matches every key
+	MergeOperators map[string]MergeFunc
+	store          Storage // the file at Path, Storage or the memory
+	// writers take the lock exclusively, readers share it
+	mu   sync.RWMutex
 	tree BTree
-	free FreeList
-	mmap struct {
+	// expiry index, the keys are the expiry time (8B big endian) followed by the key, without values
+	ttl BTree
+	// buckets by name, the values are the roots of their trees (8B)
+	catalog BTree
+	// commits since the file was created, it's in the meta page
+	version uint64
+	free    FreeList
+	mmap    struct {
 		total  int      //mmap size
 		chunks [][]byte //multiple mmaps, can be non-continuous
 	}
@@ -29,40 +93,260 @@ type KV struct {
 		temp    [][]byte
 	}
 	failed bool
+	clock  func() time.Time // time of the expiry checks
+	sweep  struct {
+		stop chan struct{}
+		done chan struct{}
+	}
+	crypt *pageCipher // nil if the file is not encrypted
+	cache *pageCache  // nil if the file is mapped
+	// number of snapshots being read outside the lock (backups)
+	// while it's not zero the pages freed by new commits are not reused
+	pins int
+	// replication state, see replica.go
+	repl replState
+	// changes kept for Watch, see watch.go
+	watch watchState
+	// writes since Open, reported by Stats
+	written struct {
+		commits uint64
+		pages   uint64 // the meta page included
+		syncs   uint64
+	}
 }
 
 // initialize KV store tree struct
+// opens (or creates) the file at db.Path, maps it and reads the meta page
 func (db *KV) Open() error {
 	// B+ tree callbacks
 	db.tree.get = db.pageRead
 	db.tree.newBNode = db.pageAlloc
 	db.tree.del = db.free.PushTail
+	db.ttl.get = db.pageRead
+	db.ttl.newBNode = db.pageAlloc
+	db.ttl.del = db.free.PushTail
+	db.catalog.get = db.pageRead
+	db.catalog.newBNode = db.pageAlloc
+	db.catalog.del = db.free.PushTail
+	if db.clock == nil {
+		db.clock = time.Now
+	}
 
 	//free list callbacks
 	db.free.get = db.pageRead
 	db.free.newFreeList = db.pageAppend
 	db.free.set = db.pageWrite
 
+	db.page.updates = map[uint64][]byte{}
+	db.repl.init(db)
+
+	db.store = db.Storage
+	if db.store == nil && db.InMemory {
+		db.store = &memStorage{}
+	}
+	if db.store == nil {
+		file, err := openFile(db.Path, db.ReadOnly)
+		if err != nil {
+			return err
+		}
+		db.store = file
+	}
+
+	if err := lockStorage(db.store, db.ReadOnly, db.LockTimeout); err != nil {
+		_ = db.store.Close()
+		return err
+	}
+
+	size, err := db.store.Size()
+	if err != nil {
+		_ = db.store.Close()
+		return err
+	}
+	if db.ReadOnly && size == 0 {
+		_ = db.store.Close()
+		return fmt.Errorf("%w: %s is empty", ErrReadOnly, db.Path)
+	}
+
+	// storages that can't be mapped are read through the cache
+	cachePages := db.CachePages
+	if cachePages == 0 {
+		err := extendMap(db, max(int(size), BTREE_PAGE_SIZE))
+		if err != nil && !isUnsupported(err) {
+			_ = db.store.Close()
+			return err
+		}
+		if err != nil {
+			cachePages = DEFAULT_CACHE_PAGES
+		}
+	}
+	if cachePages > 0 {
+		db.cache = newPageCache(db.store, cachePages, func(ptr uint64, page []byte) []byte {
+			if db.crypt == nil {
+				return page
+			}
+			return db.crypt.open(ptr, page)
+		})
+	}
+
+	// a follower whose base copy didn't finish starts over like an empty file
+	if db.Follower && size > 0 && !hasMeta(db) {
+		size = 0
+	}
+	if err := readRoot(db, size); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	// a new file gets its meta page and free list node right away
+	// a follower gets them from its primary
+	if size == 0 && !db.Follower {
+		if err := updateFile(db); err != nil {
+			_ = db.Close()
+			return err
+		}
+	}
+	pinRoots(db)
+
+	db.watch.init(db)
+	db.startSweeper()
 	return nil
 }
 
+// writes return ErrReadOnly
+func (db *KV) readOnly() bool {
+	return db.ReadOnly || db.Follower
+}
+
+// Version returns the commit version of the database, the number of commits since the file was created
+func (db *KV) Version() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.version
+}
+
 // wrapper funtion  for getting value for key, returns true if key exists
+// the value is a copy, the pages it was read from can be reused by the next commit
 func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	val, flags, ok := db.tree.GetFlags(key)
+	if !ok || len(key) == 0 || isExpired(val, flags, db.clock()) {
+		return nil, false
+	}
+	return bytes.Clone(mustDecodeVal(key, val, flags)), true
+}
+
+// Get and Scan panic with an error wrapping ErrCorrupt if they read a corrupted page
+// the other methods return it
+
+// Scan calls fn for every key in [start, end) in order, a nil end means no upper bound
+// it reads a pinned snapshot, so writers are not blocked and fn may call back into db
+// stops when fn returns false
+func (db *KV) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	snap, release := db.pin()
+	defer release()
+
+	now := db.clock()
+	for iter := snap.tree.Seek(start); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return
+		}
+		if len(key) == 0 || isExpired(val, iter.Flags(), now) {
+			continue // dummy key
+		}
+		if !fn(key, mustDecodeVal(key, val, iter.Flags())) {
+			return
+		}
+	}
+}
+
+// PrefixEnd returns the first key after every key starting with prefix, nil if there's none
+// so [prefix, PrefixEnd(prefix)) is the range of Scan and Watch for the keys starting with prefix
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// read only view of the last commit
+type snapshot struct {
+	tree    BTree
+	ttl     BTree
+	catalog BTree
+	crypt   *pageCipher // the key of the file without its write versions, nil if it's not encrypted
+}
+
+// the pages reachable from the roots of the snapshot are not reused until release is called
+func (db *KV) pin() (*snapshot, func()) {
+	db.mu.Lock()
+	db.repl.waitApply()
+	chunks := db.mmap.chunks // chunks are only appended, this view covers every flushed page
+	get := func(ptr uint64) []byte {
+		return db.readFile(chunks, ptr)
+	}
+	snap := &snapshot{
+		tree:    BTree{root: db.tree.root, get: get},
+		ttl:     BTree{root: db.ttl.root, get: get},
+		catalog: BTree{root: db.catalog.root, get: get},
+	}
+	if db.crypt != nil {
+		snap.crypt = &pageCipher{aead: db.crypt.aead}
+	}
+	db.pins++
+	db.mu.Unlock()
+
+	return snap, func() {
+		db.mu.Lock()
+		db.pins--
+		db.repl.unpinned(db)
+		db.mu.Unlock()
+	}
 }
 
 // wrapper function to Insert key and value on Btree
 // synchronizes everything
-func (db *KV) Set(key []byte, val []byte) error {
+func (db *KV) Set(key []byte, val []byte) (err error) {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	stored, flags := db.encodeVal(val)
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	meta := saveMeta(db)
-	db.tree.Insert(key, val)
+	defer recoverCorrupt(&err, func() { revert(db, meta) })
+	db.watch.recordSet(db, key, val)
+	db.tree.InsertFlags(key, stored, flags)
 	return updateOrRevert(db, meta)
 }
 
 // Write temp to disc, synchronizes, write meta to db root and synchronizes again
 // if error -> sets db.failed to true and saves the snapshot to before the error
 func updateOrRevert(db *KV, meta []byte) error {
+	// the meta page of the failed commit may still reach the disk and it can point to pages
+	// that are free again in memory, so the last good one is made durable before any of them is reused
 	if db.failed {
+		good := bytes.Clone(meta)
+		if db.crypt != nil {
+			// the write versions reserved since then stay reserved
+			binary.LittleEndian.PutUint64(good[80:], db.crypt.reserved)
+		}
+		if _, err := db.store.WriteAt(good, 0); err != nil {
+			revert(db, meta)
+			return fmt.Errorf("restore meta page: %w", err)
+		}
+		if err := db.sync(); err != nil {
+			revert(db, meta)
+			return fmt.Errorf("restore meta page: %w", err)
+		}
 		db.failed = false
 	}
 
@@ -70,40 +354,101 @@ func updateOrRevert(db *KV, meta []byte) error {
 
 	if err != nil {
 		db.failed = true
-		loadMeta(db, meta)
-		db.page.temp = db.page.temp[:0]
+		revert(db, meta)
 	}
 
 	return err
 }
 
+// discards the pages of the current transaction and goes back to meta
+func revert(db *KV, meta []byte) {
+	loadMeta(db, meta)
+	// the commit may have failed after making its freed pages available
+	db.free.maxSeq = min(db.free.maxSeq, db.free.tailSeq)
+	db.page.temp = db.page.temp[:0]
+	clear(db.page.updates)
+	db.repl.abort()
+	db.watch.abort()
+}
+
 // deletes key and value for given key, returns true if value exists
-func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, updateFile(db)
+func (db *KV) Del(key []byte) (_ bool, err error) {
+	if db.readOnly() {
+		return false, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	meta := saveMeta(db)
+	defer recoverCorrupt(&err, func() { revert(db, meta) })
+	if len(key) > 0 {
+		db.watch.recordDel(db, key)
+	}
+	deleted := len(key) > 0 && db.tree.Delete(key) // the dummy key stays
+	if !deleted {
+		return false, nil
+	}
+	return true, updateOrRevert(db, meta)
+}
+
+// DeleteRange deletes the keys in [start, end) in a single commit, a nil end means no upper bound
+// returns true if there was any
+func (db *KV) DeleteRange(start, end []byte) (_ bool, err error) {
+	if db.readOnly() {
+		return false, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	meta := saveMeta(db)
+	defer recoverCorrupt(&err, func() { revert(db, meta) })
+	db.watch.recordRange(db, start, end)
+	if !db.tree.DeleteRange(start, end) {
+		return false, nil
+	}
+	return true, updateOrRevert(db, meta)
 }
 
 // Write all temp to disc, synchronizes, write meta to db and synchronizes again
 func updateFile(db *KV) error {
+	if db.readOnly() {
+		return ErrReadOnly
+	}
 	// write all temp files to disc
 	if err := writePages(db); err != nil {
 		return err
 	}
 
 	// Force ordering
-	if err := syscall.Fsync(db.fd); err != nil {
+	if err := db.sync(); err != nil {
 		return err
 	}
 
 	// update root pointer atomically
+	db.version++
 	if err := updateRoot(db); err != nil {
 		return err
 	}
 
-	db.free.SetMaxSeq()
+	pinRoots(db)
+
+	// pinned snapshots may still read the pages freed by this commit
+	if db.pins == 0 {
+		db.free.SetMaxSeq()
+	}
 
 	// make everything persistent
-	return syscall.Fsync(db.fd)
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.written.commits++
+	db.repl.commit(db)
+	db.watch.commit(db)
+	return nil
+}
+
+// fsyncs the file, counting it for Stats
+func (db *KV) sync() error {
+	db.written.syncs++
+	return db.store.Sync()
 }
 
 // if Freelist non empty then  it saves the node on the freelist head
@@ -119,12 +464,15 @@ func (db *KV) pageAlloc(node []byte) (uint64, error) {
 }
 
 // this is free list Set implementation
-// verify if pointer is on updates map (if yes, returns the node)
+// verify if pointer is on updates map or temp (if yes, returns the node)
 // if not then searches on mmap structure and updates the updates map
 func (db *KV) pageWrite(ptr uint64) []byte {
 	if node, ok := db.page.updates[ptr]; ok {
 		return node
 	}
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed]
+	}
 	node := make([]byte, BTREE_PAGE_SIZE)
 	copy(node, db.pageReadFile(ptr))
 	db.page.updates[ptr] = node
@@ -132,21 +480,41 @@ func (db *KV) pageWrite(ptr uint64) []byte {
 }
 
 // reads the pointer and returns the page
-// verify first if page is on updates dict
+// verify first if page is on updates dict or was appended in this transaction
 // then look for pointer on mmap structure
 // implements both Btree get and FreeList get
 func (db *KV) pageRead(ptr uint64) []byte {
 	if node, ok := db.page.updates[ptr]; ok {
 		return node
 	}
+	if ptr >= db.page.flushed {
+		return db.page.temp[ptr-db.page.flushed]
+	}
 	return db.pageReadFile(ptr)
 }
 
 // search for pointer on mmap structure and returns the page if found
 func (db *KV) pageReadFile(ptr uint64) []byte {
+	return db.readFile(db.mmap.chunks, ptr)
+}
+
+// reads a page written to the file, encrypted pages are decrypted in a new buffer
+func (db *KV) readFile(chunks [][]byte, ptr uint64) []byte {
+	if db.cache != nil {
+		return db.cache.get(ptr)
+	}
+	page := readChunks(chunks, ptr)
+	if db.crypt == nil {
+		return page
+	}
+	return db.crypt.open(ptr, page)
+}
+
+// finds the page ptr inside the mmap chunks
+func readChunks(chunks [][]byte, ptr uint64) []byte {
 	start := uint64(0)
 
-	for _, chunk := range db.mmap.chunks {
+	for _, chunk := range chunks {
 		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE // end-start = amount of pages
 		if ptr < end {
 			offset := BTREE_PAGE_SIZE * (ptr - start)     // size of pages times the amount of page, calculate the offset where the page is
@@ -161,30 +529,86 @@ func (db *KV) pageReadFile(ptr uint64) []byte {
 // Write all temp files to disc
 func writePages(db *KV) error {
 	//extending the map if needed
-	size := ((int)(db.page.flushed) + len(db.page.temp)) * BTREE_PAGE_SIZE
-	if err := extendMap(db, size); err != nil {
-		return err
+	if db.cache == nil {
+		size := (int(db.page.flushed) + len(db.page.temp)) * BTREE_PAGE_SIZE
+		if err := extendMap(db, size); err != nil {
+			return err
+		}
+	}
+
+	temp, updates := db.page.temp, db.page.updates
+	if db.crypt != nil {
+		var err error
+		if temp, updates, err = sealPages(db); err != nil {
+			return err
+		}
+	}
+
+	db.repl.capture(db, temp, updates)
+
+	// a failed commit may have left cached copies of the pages after the flushed ones
+	if db.cache != nil {
+		for i := range temp {
+			db.cache.drop(db.page.flushed + uint64(i))
+		}
 	}
 
 	//write the pages to file
-	offset := int64(db.page.flushed * BTREE_PAGE_SIZE)
-	if _, err := unix.Pwritev(db.fd, db.page.temp, offset); err != nil {
+	if _, err := db.store.WritevAt(temp, int64(db.page.flushed*BTREE_PAGE_SIZE)); err != nil {
 		return err
 	}
 
+	//write the pages reused from the free list in place
+	for ptr, node := range updates {
+		if db.cache != nil {
+			db.cache.drop(ptr)
+		}
+		if _, err := db.store.WriteAt(node, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+			return err
+		}
+	}
+
 	//discard memory data
+	db.written.pages += uint64(len(temp) + len(updates))
 	db.page.flushed += uint64(len(db.page.temp))
 	db.page.temp = db.page.temp[:0]
+	clear(db.page.updates)
 
 	return nil
 }
 
+// encrypts the pages of writePages with a new write version
+func sealPages(db *KV) ([][]byte, map[uint64][]byte, error) {
+	if db.page.flushed+uint64(len(db.page.temp)) > MAX_ENCRYPTED_PAGES {
+		return nil, nil, fmt.Errorf("encryption: the file can't have more than %d pages", uint64(MAX_ENCRYPTED_PAGES))
+	}
+	version, err := db.crypt.nextVersion(db.store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	temp := make([][]byte, len(db.page.temp))
+	for i, node := range db.page.temp {
+		temp[i] = db.crypt.seal(db.page.flushed+uint64(i), node, version)
+	}
+	updates := make(map[uint64][]byte, len(db.page.updates))
+	for ptr, node := range db.page.updates {
+		updates[ptr] = db.crypt.seal(ptr, node, version)
+	}
+	return temp, updates, nil
+}
+
 func readRoot(db *KV, fileSize int64) error {
 	if fileSize == 0 {
+		if err := openCipher(db, nil); err != nil {
+			return err
+		}
 		db.page.flushed = 2 //the meta page is initialized on the first page and a free list node
 		db.free.headPage = 1
 		db.free.tailPage = 1
-		return nil //the meta page will be written on the first update
+		// the free list node is an empty page, it's written with the meta page by Open
+		db.page.updates[1] = make([]byte, BTREE_PAGE_SIZE)
+		return nil
 	}
 
 	if fileSize < int64(BTREE_PAGE_SIZE) {
@@ -192,8 +616,21 @@ func readRoot(db *KV, fileSize int64) error {
 	}
 
 	//read the page
-	data := db.mmap.chunks[0]
+	data, err := readMetaPage(db)
+	if err != nil {
+		return err
+	}
+	if string(data[:len(DB_SIG)]) != DB_SIG {
+		return fmt.Errorf("database corrupted: invalid signature")
+	}
+	if version := binary.LittleEndian.Uint64(data[64:72]); version > FORMAT_VERSION {
+		return fmt.Errorf("unsupported format version %d, the newest known is %d", version, FORMAT_VERSION)
+	}
+	if err := openCipher(db, data); err != nil {
+		return err
+	}
 	loadMeta(db, data)
+	db.free.SetMaxSeq()
 
 	//verify the page
 	expectedSize := int64(db.page.flushed * uint64(BTREE_PAGE_SIZE))
@@ -205,16 +642,40 @@ func readRoot(db *KV, fileSize int64) error {
 		return fmt.Errorf("database corrupted: root pointer (%d) exceeds flushed pages count (%d)", db.tree.root, db.page.flushed)
 	}
 
+	if db.free.headPage >= db.page.flushed || db.free.tailPage >= db.page.flushed {
+		return fmt.Errorf("database corrupted: free list pointer exceeds flushed pages count (%d)", db.page.flushed)
+	}
+
 	return nil
 }
 
+// the meta page as it is in the file
+func readMetaPage(db *KV) ([]byte, error) {
+	if db.cache == nil {
+		return db.mmap.chunks[0], nil
+	}
+	data := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := db.store.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("read meta page: %w", err)
+	}
+	return data, nil
+}
+
+// keeps the roots of the trees in the page cache
+func pinRoots(db *KV) {
+	if db.cache != nil {
+		db.cache.pinOnly(db.tree.root, db.ttl.root, db.catalog.root)
+	}
+}
+
 // rewrites Meta to root
 func updateRoot(db *KV) error {
 	// Pwrite is used here so several threads can write to file at the same time without need to block
 	// It means positional write, the offset is completely stateless
-	if _, err := syscall.Pwrite(db.fd, saveMeta(db), 0); err != nil {
+	if _, err := db.store.WriteAt(saveMeta(db), 0); err != nil {
 		return fmt.Errorf("write meta page: %w", err)
 	}
+	db.written.pages++
 
 	return nil
 }
@@ -248,17 +709,28 @@ func createFileSync(file string) (int, error) {
 }
 
 // database + current size of database
+// the first chunk mapped, the next ones double the mapped space
+// the memory of KV.InMemory is allocated rather than reserved, so it starts small
+const (
+	MMAP_MIN_CHUNK   = 64 << 20
+	MEMORY_MIN_CHUNK = 64 << 10
+)
+
 func extendMap(db *KV, size int) error {
 	if size <= db.mmap.total {
 		return nil
 	}
 
-	alloc := max(db.mmap.total, 64<<20) // 64Mb each time
-	for db.mmap.total+alloc < size {    //double the current address space
+	minChunk := MMAP_MIN_CHUNK
+	if _, ok := db.store.(*memStorage); ok {
+		minChunk = MEMORY_MIN_CHUNK
+	}
+	alloc := max(db.mmap.total, minChunk)
+	for db.mmap.total+alloc < size { //double the current address space
 		alloc *= 2 // still not enough?
 	}
 
-	chunk, err := syscall.Mmap(db.fd, int64(db.mmap.total), alloc, syscall.PROT_READ, syscall.MAP_SHARED)
+	chunk, err := db.store.Mmap(int64(db.mmap.total), alloc)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
@@ -277,22 +749,42 @@ func (db *KV) pageAppend(node []byte) uint64 {
 	return ptr
 }
 
-// backup snapshot of operation , gets the meta from db.tree
+// backup snapshot of operation , gets the meta from db.tree and db.free
 func saveMeta(db *KV) []byte {
-	var data [32]byte
+	var data [META_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[64:], FORMAT_VERSION)
+	if db.crypt != nil {
+		binary.LittleEndian.PutUint64(data[72:], META_ENCRYPTED)
+		binary.LittleEndian.PutUint64(data[80:], db.crypt.reserved)
+		copy(data[88:], db.crypt.keyCheck())
+	}
+	binary.LittleEndian.PutUint64(data[120:], db.ttl.root)
+	binary.LittleEndian.PutUint64(data[128:], db.catalog.root)
+	binary.LittleEndian.PutUint64(data[136:], db.version)
 	return data[:]
 }
 
 // provides snapshot isolation writing the pointer to root and the amount of nodes already written in db.tree
 func loadMeta(db *KV, data []byte) {
-	sig := string(data[:16])
+	sig := string(data[:len(DB_SIG)])
 	if sig != DB_SIG {
 		panic("invalid database signature")
 	}
 
 	db.tree.root = binary.LittleEndian.Uint64(data[16:24])
 	db.page.flushed = binary.LittleEndian.Uint64(data[24:32])
+	db.free.headPage = binary.LittleEndian.Uint64(data[32:40])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[40:48])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[48:56])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:64])
+	db.ttl.root = binary.LittleEndian.Uint64(data[120:128])
+	db.catalog.root = binary.LittleEndian.Uint64(data[128:136])
+	db.version = binary.LittleEndian.Uint64(data[136:144])
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
-	"syscall"
 )
 
 // Main demonstration
@@ -18,16 +17,9 @@ func RunDemo() {
 	db := &KV{Path: "test.db"}
 
 	// Open file
-	fd, err := createFileSync(db.Path)
-	if err != nil {
+	if err := db.Open(); err != nil {
 		panic(err)
 	}
-	db.fd = fd
-	db.Open()
-
-	// Initialize empty database
-	db.page.flushed = 1
-	db.tree.root = 0
 
 	fmt.Println("1️⃣  Starting with empty database")
 	db.DumpState()
@@ -67,26 +59,9 @@ func RunDemo() {
 
 	// Reopen
 	db2 := &KV{Path: "test.db"}
-	fd2, err := syscall.Open(db2.Path, syscall.O_RDWR, 0644)
-	if err != nil {
+	if err := db2.Open(); err != nil {
 		panic(err)
 	}
-	db2.fd = fd2
-	db2.Open()
-
-	// Get file size
-	stat := &syscall.Stat_t{}
-	syscall.Fstat(fd2, stat)
-
-	// Map the file
-	extendMap(db2, int(stat.Size))
-
-	// Read metadata
-	if stat.Size > 0 {
-		db2.mmap.chunks[0] = db2.mmap.chunks[0][:stat.Size]
-		data := db2.mmap.chunks[0]
-		loadMeta(db2, data)
-	}
 
 	fmt.Println("\n8️⃣  After reopening:")
 	db2.DumpState()
@@ -121,7 +96,7 @@ func RunDemo() {
 func (db *KV) DumpState() {
 	fmt.Println("\n=== KV Store State ===")
 	fmt.Printf("File: %s\n", db.Path)
-	fmt.Printf("fd: %d\n", db.fd)
+	fmt.Printf("Storage: %T\n", db.store)
 	fmt.Printf("Root pointer: %d\n", db.tree.root)
 	fmt.Printf("Flushed pages: %d\n", db.page.flushed)
 	fmt.Printf("Temp pages: %d\n", len(db.page.temp))
@@ -143,10 +118,13 @@ func (db *KV) DumpState() {
 }
 
 func (db *KV) Close() error {
+	db.stopSweeper()
+	db.repl.close(db)
+	db.watch.close(db)
 	// Unmap all chunks
 	for _, chunk := range db.mmap.chunks {
-		syscall.Munmap(chunk)
+		db.store.Munmap(chunk)
 	}
 	// Close file
-	return syscall.Close(db.fd)
+	return db.store.Close()
 }
@@ -0,0 +1,1970 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestKV(t *testing.T, name string) *KV {
+	t.Helper()
+	db := &KV{Path: filepath.Join(t.TempDir(), name)}
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func reopenKV(t *testing.T, db *KV) *KV {
+	t.Helper()
+	require.NoError(t, db.Close())
+	db2 := &KV{Path: db.Path}
+	require.NoError(t, db2.Open())
+	t.Cleanup(func() { db2.Close() })
+	return db2
+}
+
+func openKV(path string, key []byte) (*KV, error) {
+	db := &KV{Path: path, Key: key}
+	return db, db.Open()
+}
+
+func TestKVPersistence(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		require.NoError(t, db.Set([]byte(key), []byte("value"+key)))
+	}
+	for i := 0; i < 2000; i += 3 {
+		ok, err := db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	db = reopenKV(t, db)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val, ok := db.Get([]byte(key))
+		if i%3 == 0 {
+			assert.False(t, ok, key)
+			continue
+		}
+		assert.True(t, ok, key)
+		assert.Equal(t, "value"+key, string(val))
+	}
+}
+
+func TestKVBackupRestore(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		require.NoError(t, db.Set([]byte(key), bytes.Repeat([]byte{byte(i)}, 20)))
+	}
+
+	// commits keep going while the backup runs
+	var buf bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			assert.NoError(t, db.Set([]byte(key), []byte("overwritten")))
+			_, err := db.Del([]byte(fmt.Sprintf("key%05d", 2999-i)))
+			assert.NoError(t, err)
+		}
+	}()
+	require.NoError(t, db.Backup(&buf))
+	wg.Wait()
+
+	file := filepath.Join(t.TempDir(), "restored.db")
+	require.NoError(t, Restore(bytes.NewReader(buf.Bytes()), file))
+
+	restored := &KV{Path: file}
+	require.NoError(t, restored.Open())
+	defer restored.Close()
+
+	// every key is either from before or after the concurrent writes
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val, ok := restored.Get([]byte(key))
+		if !ok {
+			assert.GreaterOrEqual(t, i, 2800, key)
+			continue
+		}
+		if string(val) != "overwritten" {
+			assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 20), val, key)
+		}
+	}
+
+	// the restored file is a regular database
+	require.NoError(t, restored.Set([]byte("after"), []byte("restore")))
+	val, ok := restored.Get([]byte("after"))
+	assert.True(t, ok)
+	assert.Equal(t, "restore", string(val))
+}
+
+func TestKVRestoreRejectsCorruption(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	for i := 0; i < 500; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value")))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, db.Backup(&buf))
+	data := buf.Bytes()
+
+	dir := t.TempDir()
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 0xff
+	err := Restore(bytes.NewReader(flipped), filepath.Join(dir, "flipped.db"))
+	assert.ErrorIs(t, err, ErrBadBackup)
+	assert.NoFileExists(t, filepath.Join(dir, "flipped.db"))
+
+	err = Restore(bytes.NewReader(data[:len(data)-100]), filepath.Join(dir, "short.db"))
+	assert.ErrorIs(t, err, ErrBadBackup)
+
+	require.NoError(t, Restore(bytes.NewReader(data), filepath.Join(dir, "ok.db")))
+}
+
+func TestKVCheck(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	require.NoError(t, db.Check())
+	for i := 0; i < 500; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value")))
+	}
+	require.NoError(t, db.SetWithTTL([]byte("ttl"), []byte("value"), time.Hour))
+	_, err := db.CreateBucket([]byte("bucket"))
+	require.NoError(t, err)
+	require.NoError(t, db.Check())
+
+	// the root is rewritten behind the back of KV
+	page := make([]byte, BTREE_PAGE_SIZE)
+	copy(page, db.tree.get(db.tree.root))
+	binary.LittleEndian.PutUint16(page, 7)
+	_, err = db.store.WriteAt(page, int64(db.tree.root*BTREE_PAGE_SIZE))
+	require.NoError(t, err)
+	assert.ErrorIs(t, db.Check(), ErrCorrupt)
+}
+
+func TestKVExportImport(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val := []byte{byte(i), 0, '"', ',', '\n', 0xff}
+		require.NoError(t, db.Set([]byte(key), val))
+	}
+
+	for _, format := range []string{FORMAT_JSONL, FORMAT_CSV} {
+		for _, encoding := range []string{ENCODING_BASE64, ENCODING_ESCAPE} {
+			t.Run(format+"-"+encoding, func(t *testing.T) {
+				opts := DumpOptions{Format: format, Encoding: encoding, Start: []byte("key00100"), End: []byte("key02000")}
+				var buf bytes.Buffer
+				n, err := db.Export(&buf, opts)
+				require.NoError(t, err)
+				assert.Equal(t, 1900, n)
+
+				fresh := openTestKV(t, "fresh.db")
+				calls := 0
+				n, err = fresh.Import(&buf, opts, func(int) { calls++ })
+				require.NoError(t, err)
+				assert.Equal(t, 1900, n)
+				assert.Equal(t, 2, calls)
+
+				for i := 0; i < 2500; i++ {
+					key := fmt.Sprintf("key%05d", i)
+					val, ok := fresh.Get([]byte(key))
+					assert.Equal(t, i >= 100 && i < 2000, ok, key)
+					if ok {
+						assert.Equal(t, []byte{byte(i), 0, '"', ',', '\n', 0xff}, val)
+					}
+				}
+
+				_, err = fresh.Import(bytes.NewReader(nil), opts, nil)
+				assert.ErrorIs(t, err, ErrNotEmpty)
+			})
+		}
+	}
+}
+
+func TestKVStats(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Depth)
+	assert.Equal(t, uint64(2), stats.TotalPages)
+
+	for i := 0; i < 3000; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value")))
+	}
+	for i := 0; i < 1000; i++ {
+		_, err := db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err)
+	}
+
+	stats, err = db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 2000, stats.Keys)
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 1, stats.InternalPages)
+	assert.Greater(t, stats.LeafPages, 1)
+	assert.LessOrEqual(t, stats.MinFill, stats.AvgFill)
+	assert.LessOrEqual(t, stats.AvgFill, stats.MaxFill)
+	assert.LessOrEqual(t, stats.MaxFill, 1.0)
+	assert.Greater(t, stats.FreePages, uint64(0))
+	assert.Equal(t, int64(stats.TotalPages*BTREE_PAGE_SIZE), stats.FileSize)
+	assert.Less(t, stats.LiveBytes, stats.FileSize)
+	// the commit of the new file, then one per update with two fsyncs each
+	// every commit writes a leaf and the meta page at least
+	assert.Equal(t, uint64(4001), stats.Commits)
+	assert.Equal(t, 2*stats.Commits, stats.Syncs)
+	assert.Greater(t, stats.PagesWritten, 2*stats.Commits)
+	assert.Zero(t, stats.IndexPages)
+	assert.Zero(t, stats.BucketPages)
+
+	// the expiry index and the buckets count in the pages and bytes, not in the keys of the main tree
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for _, name := range []string{"a", "b", "empty"} {
+			if err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 3000; i++ {
+			if err := tx.Bucket([]byte("a")).Set([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte("b")).Set([]byte("key"), []byte("value"))
+	}))
+	require.NoError(t, db.SetWithTTL([]byte("expiring"), []byte("value"), time.Hour))
+	before := stats
+	stats, err = db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 2001, stats.Keys)
+	assert.Equal(t, before.LeafPages, stats.LeafPages)
+	assert.Equal(t, 1, stats.IndexPages)
+	assert.Equal(t, 3, stats.Buckets)
+	assert.Equal(t, 3001, stats.BucketKeys)
+	// the catalog, the internal node and the leaves of a, the leaf of b
+	assert.Greater(t, stats.BucketPages, 4)
+	assert.Greater(t, stats.LiveBytes, before.LiveBytes+3000*int64(len("key00000value")))
+	assert.Less(t, stats.LiveBytes, stats.FileSize)
+}
+
+func TestKVBulkLoad(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+
+	val := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, i%200)
+	}
+	pairs := func(n int) func(func([]byte, []byte) bool) {
+		return func(yield func([]byte, []byte) bool) {
+			for i := 0; i < n; i++ {
+				if !yield([]byte(fmt.Sprintf("key%06d", i)), val(i)) {
+					return
+				}
+			}
+		}
+	}
+
+	n, err := db.BulkLoad(pairs(50000), 0.8)
+	require.NoError(t, err)
+	assert.Equal(t, 50000, n)
+
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 50000, stats.Keys)
+	assert.GreaterOrEqual(t, stats.Depth, 3)
+	assert.LessOrEqual(t, stats.MaxFill, 0.8)
+
+	db = reopenKV(t, db)
+	for i := 0; i < 50000; i += 7 {
+		got, ok := db.Get([]byte(fmt.Sprintf("key%06d", i)))
+		require.True(t, ok, i)
+		assert.Equal(t, val(i), got)
+	}
+
+	// the loaded tree takes regular updates
+	require.NoError(t, db.Set([]byte("key000100"), []byte("new")))
+	ok, err := db.Del([]byte("key000200"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = db.BulkLoad(pairs(10), 0)
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestKVBulkLoadRejectsUnsorted(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+
+	for _, keys := range [][]string{{"a", "c", "b"}, {"a", "b", "b"}, {""}} {
+		_, err := db.BulkLoad(func(yield func([]byte, []byte) bool) {
+			for _, k := range keys {
+				if !yield([]byte(k), []byte("v")) {
+					return
+				}
+			}
+		}, 0)
+		assert.ErrorIs(t, err, ErrUnsorted, keys)
+	}
+
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Keys)
+	assert.Equal(t, uint64(2), stats.TotalPages)
+}
+
+func TestKVFormatVersion(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	require.NoError(t, db.Set([]byte("key"), []byte("value")))
+	require.NoError(t, db.Close())
+
+	// a file from a newer version of the code
+	fd, err := syscall.Open(db.Path, syscall.O_RDWR, 0)
+	require.NoError(t, err)
+	var version [8]byte
+	binary.LittleEndian.PutUint64(version[:], FORMAT_VERSION+1)
+	_, err = syscall.Pwrite(fd, version[:], 64)
+	require.NoError(t, err)
+	require.NoError(t, syscall.Close(fd))
+
+	db2 := &KV{Path: db.Path}
+	err = db2.Open()
+	assert.ErrorContains(t, err, "unsupported format version")
+}
+
+func TestKVCompression(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	db.CompressMin = 64
+
+	rng := rand.New(rand.NewSource(1))
+	ref := map[string][]byte{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		var val []byte
+		switch i % 3 {
+		case 0: // compressible json
+			val = []byte(fmt.Sprintf(`{"id":%d,"name":"user %d","tags":["a","b","c"],"bio":"%s"}`, i, i, strings.Repeat("lorem ipsum ", 20)))
+		case 1: // below the threshold
+			val = []byte(fmt.Sprintf("small%d", i))
+		default: // doesn't get smaller
+			val = make([]byte, 200)
+			rng.Read(val)
+		}
+		ref[key] = val
+		require.NoError(t, db.Set([]byte(key), val))
+	}
+
+	// values written before are read the same way whatever the option
+	db = reopenKV(t, db)
+	for key, val := range ref {
+		got, ok := db.Get([]byte(key))
+		require.True(t, ok)
+		require.Equal(t, val, got, key)
+	}
+	n := 0
+	db.Scan(nil, nil, func(key, val []byte) bool {
+		assert.Equal(t, ref[string(key)], val, string(key))
+		n++
+		return true
+	})
+	assert.Equal(t, len(ref), n)
+
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1000, stats.CompressedValues)
+	assert.Greater(t, stats.CompressionRatio, 1.5)
+
+	// overwriting without compression clears the flag
+	for i := 0; i < 3000; i += 3 {
+		key := fmt.Sprintf("key%05d", i)
+		require.NoError(t, db.Set([]byte(key), ref[key]))
+	}
+	stats, err = db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.CompressedValues)
+	assert.InDelta(t, 1.0, stats.CompressionRatio, 1e-9)
+	val, ok := db.Get([]byte("key00000"))
+	assert.True(t, ok)
+	assert.Equal(t, ref["key00000"], val)
+}
+
+func TestKVEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	db := &KV{Path: filepath.Join(t.TempDir(), "kv.db"), Key: key}
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		require.NoError(t, db.Set([]byte(k), []byte("secret-"+k)))
+	}
+	// frees pages, so the next commits rewrite reused pages with new versions
+	for i := 0; i < 3000; i += 2 {
+		_, err := db.Del([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+
+	data, err := os.ReadFile(db.Path)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("secret-")))
+	assert.False(t, bytes.Contains(data, []byte("key0")))
+
+	_, err = openKV(db.Path, nil)
+	assert.ErrorIs(t, err, ErrEncrypted)
+	_, err = openKV(db.Path, bytes.Repeat([]byte{8}, 32))
+	assert.ErrorIs(t, err, ErrBadKey)
+
+	db2, err := openKV(db.Path, key)
+	require.NoError(t, err)
+	t.Cleanup(func() { db2.Close() })
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		val, ok := db2.Get([]byte(k))
+		require.Equal(t, i%2 == 1, ok, k)
+		if ok {
+			require.Equal(t, "secret-"+k, string(val))
+		}
+	}
+
+	// backups restore to a file encrypted with the same key
+	var buf bytes.Buffer
+	require.NoError(t, db2.Backup(&buf))
+	dir := t.TempDir()
+	restored := filepath.Join(dir, "restored.db")
+	assert.ErrorIs(t, Restore(bytes.NewReader(buf.Bytes()), restored), ErrEncrypted)
+	assert.NoFileExists(t, restored)
+	assert.ErrorIs(t, RestoreKey(bytes.NewReader(buf.Bytes()), restored, bytes.Repeat([]byte{8}, 32)), ErrBadKey)
+	assert.NoFileExists(t, restored)
+	require.NoError(t, RestoreKey(bytes.NewReader(buf.Bytes()), restored, key))
+
+	restoredData, err := os.ReadFile(restored)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(restoredData, []byte("secret-")))
+	_, err = openKV(restored, nil)
+	assert.ErrorIs(t, err, ErrEncrypted)
+	db3, err := openKV(restored, key)
+	require.NoError(t, err)
+	t.Cleanup(func() { db3.Close() })
+	val, ok := db3.Get([]byte("key00001"))
+	assert.True(t, ok)
+	assert.Equal(t, "secret-key00001", string(val))
+	require.NoError(t, db3.Set([]byte("key00001"), []byte("restored")))
+	require.NoError(t, db3.Check())
+	require.NoError(t, db2.Close())
+
+	// a plain backup has no key to restore with
+	plain := openTestKV(t, "plain.db")
+	require.NoError(t, plain.Set([]byte("key"), []byte("value")))
+	buf.Reset()
+	require.NoError(t, plain.Backup(&buf))
+	assert.ErrorIs(t, RestoreKey(&buf, filepath.Join(dir, "plain.db"), key), ErrBadKey)
+
+	// a flipped bit in the root fails authentication
+	root := binary.LittleEndian.Uint64(data[16:])
+	data[root*BTREE_PAGE_SIZE+100] ^= 1
+	require.NoError(t, os.WriteFile(db.Path, data, 0o644))
+	db4, err := openKV(db.Path, key)
+	require.NoError(t, err)
+	t.Cleanup(func() { db4.Close() })
+	_, err = db4.Stats()
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorIs(t, db4.Set([]byte("key"), []byte("val")), ErrCorrupt)
+	assert.Panics(t, func() { db4.Get([]byte("key00001")) })
+}
+
+func TestKVKeyOnPlainFile(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	require.NoError(t, db.Set([]byte("key"), []byte("value")))
+	require.NoError(t, db.Close())
+
+	_, err := openKV(db.Path, bytes.Repeat([]byte{7}, 16))
+	assert.ErrorIs(t, err, ErrBadKey)
+}
+
+func TestKVDeleteRange(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for tenant := 1; tenant <= 3; tenant++ {
+			for i := 0; i < 3000; i++ {
+				key := fmt.Sprintf("tenant-%d/%05d", tenant, i)
+				if err := tx.Set([]byte(key), []byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}))
+	before, err := db.Stats()
+	require.NoError(t, err)
+
+	deleted, err := db.DeleteRange([]byte("tenant-2/"), []byte("tenant-20"))
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = db.DeleteRange([]byte("tenant-2/"), []byte("tenant-20"))
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	db = reopenKV(t, db)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 6000, stats.Keys)
+	assert.Greater(t, stats.FreePages, before.FreePages)
+	for _, key := range []string{"tenant-1/02999", "tenant-3/00000"} {
+		_, ok := db.Get([]byte(key))
+		assert.True(t, ok, key)
+	}
+	db.Scan([]byte("tenant-2/"), []byte("tenant-20"), func(key, val []byte) bool {
+		t.Fatalf("key %q was not deleted", key)
+		return false
+	})
+
+	// up to the end
+	deleted, err = db.DeleteRange([]byte("tenant-3/01000"), nil)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	stats, err = db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 4000, stats.Keys)
+}
+
+func TestKVTTL(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	db := &KV{Path: filepath.Join(t.TempDir(), "kv.db"), SweepInterval: -1, clock: func() time.Time { return now }}
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("session%05d", i)
+		require.NoError(t, db.SetWithTTL([]byte(key), []byte(key), time.Minute))
+	}
+	require.NoError(t, db.SetWithTTL([]byte("long"), []byte("lived"), time.Hour))
+	require.NoError(t, db.Set([]byte("plain"), []byte("value")))
+	// overwritten before it expires, the index entry is stale
+	require.NoError(t, db.Set([]byte("session00000"), []byte("kept")))
+
+	val, ok := db.Get([]byte("session00001"))
+	assert.True(t, ok)
+	assert.Equal(t, "session00001", string(val))
+	ttl, ok := db.TTL([]byte("long"))
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, ttl)
+	ttl, ok = db.TTL([]byte("plain"))
+	assert.True(t, ok)
+	assert.Zero(t, ttl)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = db.TTL([]byte("session00001"))
+	assert.False(t, ok)
+	_, ok = db.Get([]byte("session00001"))
+	assert.False(t, ok)
+	seen := []string{}
+	db.Scan(nil, nil, func(key, val []byte) bool {
+		seen = append(seen, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"long", "plain", "session00000"}, seen)
+	// the transaction sees its own delete, then it's rolled back
+	require.Error(t, db.Update(func(tx *Tx) error {
+		tx.Del([]byte("plain"))
+		seen = seen[:0]
+		tx.Scan([]byte("l"), []byte("q"), func(key, val []byte) bool {
+			seen = append(seen, string(key))
+			return true
+		})
+		return errors.New("rollback")
+	}))
+	assert.Equal(t, []string{"long"}, seen)
+
+	// expired keys are still in the tree until they are swept
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 2502, stats.Keys)
+
+	swept := []int{}
+	for {
+		n, err := db.SweepExpired()
+		require.NoError(t, err)
+		if n == 0 {
+			break
+		}
+		swept = append(swept, n)
+	}
+	assert.Equal(t, []int{TTL_SWEEP_BATCH, TTL_SWEEP_BATCH, 500}, swept)
+	stats, err = db.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Keys)
+	val, ok = db.Get([]byte("session00000"))
+	assert.True(t, ok)
+	assert.Equal(t, "kept", string(val))
+
+	// the index survives a reopen and a backup
+	require.NoError(t, db.Close())
+	db = &KV{Path: db.Path, SweepInterval: -1, clock: func() time.Time { return now }}
+	require.NoError(t, db.Open())
+	var buf bytes.Buffer
+	require.NoError(t, db.Backup(&buf))
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	require.NoError(t, Restore(&buf, restored))
+	db2 := &KV{Path: restored, SweepInterval: -1, clock: func() time.Time { return now }}
+	require.NoError(t, db2.Open())
+	t.Cleanup(func() { db2.Close() })
+
+	now = now.Add(time.Hour)
+	for _, db := range []*KV{db, db2} {
+		n, err := db.SweepExpired()
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		_, ok = db.Get([]byte("long"))
+		assert.False(t, ok)
+		stats, err = db.Stats()
+		require.NoError(t, err)
+		assert.Equal(t, 2, stats.Keys)
+	}
+}
+
+func TestKVSweeper(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "kv.db"), SweepInterval: 10 * time.Millisecond}
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < 3000; i++ {
+			if err := tx.SetWithTTL([]byte(fmt.Sprintf("key%05d", i)), []byte("v"), time.Millisecond); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	assert.Eventually(t, func() bool {
+		stats, err := db.Stats()
+		return err == nil && stats.Keys == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKVBuckets(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	require.NoError(t, db.Set([]byte("k"), []byte("main")))
+
+	users, err := db.CreateBucket([]byte("users"))
+	require.NoError(t, err)
+	_, err = db.CreateBucket([]byte("users"))
+	assert.ErrorIs(t, err, ErrBucketExists)
+	_, err = db.CreateBucket(nil)
+	assert.Error(t, err)
+	_, err = db.CreateBucket([]byte("orders"))
+	require.NoError(t, err)
+	orders := db.Bucket([]byte("orders"))
+
+	require.NoError(t, users.Set([]byte("k"), []byte("user")))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("order%05d", i)
+			if err := tx.Bucket([]byte("orders")).Set([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	assert.ErrorIs(t, db.Bucket([]byte("missing")).Set([]byte("k"), nil), ErrBucketNotFound)
+
+	// the keyspaces don't overlap
+	val, ok := db.Get([]byte("k"))
+	assert.True(t, ok)
+	assert.Equal(t, "main", string(val))
+	val, ok = users.Get([]byte("k"))
+	assert.True(t, ok)
+	assert.Equal(t, "user", string(val))
+	_, ok = orders.Get([]byte("k"))
+	assert.False(t, ok)
+	_, ok = db.Get([]byte("order00000"))
+	assert.False(t, ok)
+
+	deleted, err := orders.Del([]byte("order00000"))
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = orders.Del([]byte("order00000"))
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	deleted, err = orders.DeleteRange([]byte("order01000"), []byte("order02000"))
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	// buckets survive a reopen and a backup
+	db = reopenKV(t, db)
+	var buf bytes.Buffer
+	require.NoError(t, db.Backup(&buf))
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	require.NoError(t, Restore(&buf, restored))
+	db2, err := openKV(restored, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db2.Close() })
+
+	for _, db := range []*KV{db, db2} {
+		names, err := db.ListBuckets()
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("orders"), []byte("users")}, names)
+
+		count := 0
+		require.NoError(t, db.Bucket([]byte("orders")).Scan(nil, nil, func(key, val []byte) bool {
+			assert.Equal(t, key, val)
+			count++
+			return true
+		}))
+		assert.Equal(t, 1999, count)
+		val, ok := db.Bucket([]byte("users")).Get([]byte("k"))
+		assert.True(t, ok)
+		assert.Equal(t, "user", string(val))
+	}
+
+	// deleting a bucket frees its pages
+	before, err := db.Stats()
+	require.NoError(t, err)
+	require.NoError(t, db.DeleteBucket([]byte("orders")))
+	assert.ErrorIs(t, db.DeleteBucket([]byte("orders")), ErrBucketNotFound)
+	stats, err := db.Stats()
+	require.NoError(t, err)
+	assert.Greater(t, stats.FreePages, before.FreePages+10)
+	assert.Equal(t, 1, stats.Keys)
+	names, err := db.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("users")}, names)
+	_, ok = db.Bucket([]byte("orders")).Get([]byte("order00001"))
+	assert.False(t, ok)
+	assert.ErrorIs(t, db.Bucket([]byte("orders")).Scan(nil, nil, func(key, val []byte) bool { return true }), ErrBucketNotFound)
+}
+
+func TestKVGetCopy(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	require.NoError(t, db.Set([]byte("k"), []byte("main")))
+	bucket, err := db.CreateBucket([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, bucket.Set([]byte("k"), []byte("bucket")))
+	val, _ := db.Get([]byte("k"))
+	bval, _ := bucket.Get([]byte("k"))
+
+	// the pages the values were read from are reused by the next commits
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set([]byte("k"), []byte(fmt.Sprintf("main%02d", i))))
+		require.NoError(t, bucket.Set([]byte("k"), []byte(fmt.Sprintf("bucket%02d", i))))
+	}
+	assert.Equal(t, "main", string(val))
+	assert.Equal(t, "bucket", string(bval))
+}
+
+func TestKVListBucketsCopy(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	_, err := db.CreateBucket([]byte("users"))
+	require.NoError(t, err)
+	names, err := db.ListBuckets()
+	require.NoError(t, err)
+
+	// the catalog pages the names were read from are reused by the next commits
+	for i := 0; i < 20; i++ {
+		_, err := db.CreateBucket([]byte(fmt.Sprintf("a%02d", i)))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, [][]byte{[]byte("users")}, names)
+}
+
+func TestKVOrderStatistics(t *testing.T) {
+	db := openTestKV(t, "kv.db")
+	assert.Equal(t, 0, db.Count(nil, nil))
+	_, _, ok := db.Select(0)
+	assert.False(t, ok)
+
+	// the bulk loader writes the counts too
+	n, err := db.BulkLoad(func(yield func([]byte, []byte) bool) {
+		for i := 0; i < 30000; i += 2 {
+			if !yield([]byte(fmt.Sprintf("key%06d", i)), []byte("v")) {
+				return
+			}
+		}
+	}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 15000, n)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for i := 1; i < 30000; i += 2 {
+			if err := tx.Set([]byte(fmt.Sprintf("key%06d", i)), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	_, err = db.DeleteRange([]byte("key020000"), []byte("key025000"))
+	require.NoError(t, err)
+
+	db = reopenKV(t, db)
+	assert.Equal(t, 25000, db.Count(nil, nil))
+	assert.Equal(t, 1000, db.Count([]byte("key001000"), []byte("key002000")))
+	assert.Equal(t, 2000, db.Count([]byte("key019000"), []byte("key026000")))
+	assert.Equal(t, 0, db.Count([]byte("key002000"), []byte("key001000")))
+	assert.Equal(t, 4000, db.Count([]byte("key026000"), nil))
+
+	assert.Equal(t, 0, db.Rank(nil))
+	assert.Equal(t, 0, db.Rank([]byte("key000000")))
+	assert.Equal(t, 10000, db.Rank([]byte("key010000")))
+	assert.Equal(t, 20000, db.Rank([]byte("key025000")))
+	assert.Equal(t, 25000, db.Rank([]byte("zzz")))
+
+	key, val, ok := db.Select(10000)
+	assert.True(t, ok)
+	assert.Equal(t, "key010000", string(key))
+	assert.Equal(t, "v", string(val))
+	key, _, ok = db.Select(20000)
+	assert.True(t, ok)
+	assert.Equal(t, "key025000", string(key))
+	_, _, ok = db.Select(25000)
+	assert.False(t, ok)
+	_, _, ok = db.Select(-1)
+	assert.False(t, ok)
+}
+
+func TestKVPageCache(t *testing.T) {
+	for _, key := range [][]byte{nil, bytes.Repeat([]byte{7}, 32)} {
+		path := filepath.Join(t.TempDir(), "kv.db")
+		db := &KV{Path: path, Key: key, CachePages: 16}
+		require.NoError(t, db.Open())
+		assert.Empty(t, db.mmap.chunks)
+
+		ref := map[string]string{}
+		rng := rand.New(rand.NewSource(5))
+		done := make(chan struct{})
+		go func() {
+			// readers share the cache with the writer
+			defer close(done)
+			for i := 0; i < 2000; i++ {
+				db.Get([]byte(fmt.Sprintf("key%05d", i)))
+			}
+		}()
+		for i := 0; i < 4000; i++ {
+			k := fmt.Sprintf("key%05d", rng.Intn(3000))
+			if rng.Intn(4) == 0 {
+				_, err := db.Del([]byte(k))
+				require.NoError(t, err)
+				delete(ref, k)
+				continue
+			}
+			v := strings.Repeat(k, 1+rng.Intn(20))
+			require.NoError(t, db.Set([]byte(k), []byte(v)))
+			ref[k] = v
+		}
+		<-done
+		assert.LessOrEqual(t, len(db.cache.pages), 16)
+
+		check := func(db *KV) {
+			t.Helper()
+			for k, v := range ref {
+				val, ok := db.Get([]byte(k))
+				require.True(t, ok, k)
+				require.Equal(t, v, string(val))
+			}
+			n := 0
+			db.Scan(nil, nil, func(key, val []byte) bool {
+				n++
+				return true
+			})
+			assert.Equal(t, len(ref), n)
+		}
+		check(db)
+		stats, err := db.Stats()
+		require.NoError(t, err)
+		assert.Greater(t, stats.CacheHits, uint64(0))
+		assert.Greater(t, stats.CacheMisses, uint64(0))
+		assert.Equal(t, float64(stats.CacheHits)/float64(stats.CacheHits+stats.CacheMisses), stats.CacheHitRate)
+		assert.Equal(t, len(ref), stats.Keys)
+
+		// the file is the same with or without the cache
+		require.NoError(t, db.Close())
+		db2 := &KV{Path: path, Key: key}
+		require.NoError(t, db2.Open())
+		check(db2)
+		require.NoError(t, db2.Set([]byte("mapped"), []byte("write")))
+		require.NoError(t, db2.Close())
+		ref["mapped"] = "write"
+
+		db3 := &KV{Path: path, Key: key, CachePages: 4}
+		require.NoError(t, db3.Open())
+		check(db3)
+		assert.LessOrEqual(t, len(db3.cache.pages), 4)
+		// the roots are pinned, every lookup starts with a hit
+		hits, _ := db3.cache.stats()
+		db3.Get([]byte("mapped"))
+		after, _ := db3.cache.stats()
+		assert.Greater(t, after, hits)
+		require.NoError(t, db3.Close())
+	}
+}
+
+// the child process of the lock tests, it writes a key and holds the database until its stdin is closed
+// with DB_LOCK_READONLY set it opens the database read-only and doesn't write
+func TestKVLockHelper(t *testing.T) {
+	path := os.Getenv("DB_LOCK_HELPER")
+	if path == "" {
+		t.Skip("started by TestKVLockProcesses")
+	}
+	db := &KV{Path: path, ReadOnly: os.Getenv("DB_LOCK_READONLY") != ""}
+	if err := db.Open(); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	if !db.ReadOnly {
+		if err := db.Set([]byte("child"), []byte(fmt.Sprint(os.Getpid()))); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("locked")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+	_ = db.Close()
+	os.Exit(0)
+}
+
+// re-runs the test binary as TestKVLockHelper and waits for its first line
+func startLockHelper(t *testing.T, path string, readOnly bool) (*exec.Cmd, io.WriteCloser, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestKVLockHelper$")
+	cmd.Env = append(os.Environ(), "DB_LOCK_HELPER="+path)
+	if readOnly {
+		cmd.Env = append(cmd.Env, "DB_LOCK_READONLY=1")
+	}
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	return cmd, stdin, strings.TrimSpace(line)
+}
+
+func TestKVLockProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.db")
+	child, stdin, line := startLockHelper(t, path, false)
+	require.Equal(t, "locked", line)
+
+	db := &KV{Path: path}
+	assert.ErrorIs(t, db.Open(), ErrLocked)
+	start := time.Now()
+	db.LockTimeout = 100 * time.Millisecond
+	assert.ErrorIs(t, db.Open(), ErrLocked)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// the lock is released when the child closes the database
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stdin.Close()
+	}()
+	db.LockTimeout = 10 * time.Second
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+	val, ok := db.Get([]byte("child"))
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprint(child.Process.Pid), string(val))
+
+	// and now the child is the one locked out
+	_, _, line = startLockHelper(t, path, false)
+	assert.Contains(t, line, ErrLocked.Error())
+}
+
+func TestKVReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	missing := &KV{Path: filepath.Join(dir, "missing.db"), ReadOnly: true}
+	assert.Error(t, missing.Open())
+	_, err := os.Stat(missing.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	path := filepath.Join(dir, "kv.db")
+	db, err := openKV(path, nil)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		require.NoError(t, db.Set([]byte(key), []byte(key)))
+	}
+	require.NoError(t, db.SetWithTTL([]byte("expiring"), []byte("v"), time.Nanosecond))
+	_, err = db.CreateBucket([]byte("bucket"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// readers share the lock, in this process and in others
+	ro1 := &KV{Path: path, ReadOnly: true}
+	require.NoError(t, ro1.Open())
+	ro2 := &KV{Path: path, ReadOnly: true, CachePages: 8}
+	require.NoError(t, ro2.Open())
+	_, _, line := startLockHelper(t, path, true)
+	assert.Equal(t, "locked", line)
+	_, _, line = startLockHelper(t, path, false)
+	assert.Contains(t, line, ErrLocked.Error())
+	assert.ErrorIs(t, (&KV{Path: path}).Open(), ErrLocked)
+
+	for _, ro := range []*KV{ro1, ro2} {
+		assert.Nil(t, ro.sweep.stop, "the sweeper doesn't run")
+		val, ok := ro.Get([]byte("key0500"))
+		assert.True(t, ok)
+		assert.Equal(t, "key0500", string(val))
+		assert.Equal(t, 1000, ro.Count([]byte("key"), []byte("kez")))
+		var buf bytes.Buffer
+		require.NoError(t, ro.Backup(&buf))
+
+		assert.ErrorIs(t, ro.Set([]byte("a"), []byte("b")), ErrReadOnly)
+		assert.ErrorIs(t, ro.SetWithTTL([]byte("a"), []byte("b"), time.Hour), ErrReadOnly)
+		_, err := ro.Del([]byte("key0001"))
+		assert.ErrorIs(t, err, ErrReadOnly)
+		_, err = ro.DeleteRange(nil, nil)
+		assert.ErrorIs(t, err, ErrReadOnly)
+		assert.ErrorIs(t, ro.Update(func(tx *Tx) error { return nil }), ErrReadOnly)
+		_, err = ro.SweepExpired()
+		assert.ErrorIs(t, err, ErrReadOnly)
+		_, err = ro.CreateBucket([]byte("other"))
+		assert.ErrorIs(t, err, ErrReadOnly)
+		assert.ErrorIs(t, ro.DeleteBucket([]byte("bucket")), ErrReadOnly)
+		assert.ErrorIs(t, ro.Bucket([]byte("bucket")).Set([]byte("a"), nil), ErrReadOnly)
+		_, err = ro.Bucket([]byte("bucket")).Del([]byte("a"))
+		assert.ErrorIs(t, err, ErrReadOnly)
+	}
+	require.NoError(t, ro1.Close())
+	require.NoError(t, ro2.Close())
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(before, after), "the file changed")
+}
+
+var (
+	errPowerLoss = errors.New("power loss")
+	errDisk      = errors.New("disk error")
+)
+
+// reads every key of db
+func kvContents(db *KV) map[string]string {
+	contents := map[string]string{}
+	db.Scan(nil, nil, func(key, val []byte) bool {
+		contents[string(key)] = string(val)
+		return true
+	})
+	return contents
+}
+
+// a transaction of random updates and the contents after it
+func randomUpdates(rng *rand.Rand, contents map[string]string) (func(tx *Tx) error, map[string]string) {
+	next := maps.Clone(contents)
+	var keys, vals []string
+	for i := rng.Intn(50) + 1; i > 0; i-- {
+		key := fmt.Sprintf("key%04d", rng.Intn(2000))
+		val := ""
+		if rng.Intn(4) > 0 {
+			val = strings.Repeat(key, rng.Intn(20)+1)
+			next[key] = val
+		} else {
+			delete(next, key)
+		}
+		keys, vals = append(keys, key), append(vals, val)
+	}
+	return func(tx *Tx) error {
+		for i, key := range keys {
+			if vals[i] == "" {
+				tx.Del([]byte(key))
+			} else if err := tx.Set([]byte(key), []byte(vals[i])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, next
+}
+
+func TestKVCrashRecovery(t *testing.T) {
+	for _, key := range [][]byte{nil, bytes.Repeat([]byte{7}, 32)} {
+		rng := rand.New(rand.NewSource(42))
+		for round := 0; round < 100; round++ {
+			sim := NewSimStorage(nil)
+			if key != nil {
+				sim.Sector = BTREE_PAGE_SIZE // free list nodes are sealed in place
+			}
+			db := &KV{Storage: sim, Key: key, SweepInterval: -1}
+			require.NoError(t, db.Open())
+
+			// some writes and syncs fail on their own, then the power goes out
+			crashAt := rng.Intn(300)
+			sim.Fault = func(op SimOp) error {
+				if crashAt--; crashAt < 0 {
+					return errPowerLoss
+				}
+				if rng.Intn(40) == 0 {
+					return errDisk
+				}
+				return nil
+			}
+
+			// a failed commit may still be on disk, until the next commit succeeds
+			contents := map[string]string{}
+			possible := []map[string]string{contents}
+			for {
+				fn, next := randomUpdates(rng, contents)
+				err := db.Update(fn)
+				if err == nil {
+					contents = next
+					possible = []map[string]string{contents}
+					continue
+				}
+				possible = append(possible, next)
+				if errors.Is(err, errPowerLoss) {
+					break
+				}
+				require.ErrorIs(t, err, errDisk)
+				require.Equal(t, contents, kvContents(db), "the failed commit was reverted")
+			}
+
+			db2 := &KV{Storage: NewSimStorage(sim.Crash(rng)), Key: key, SweepInterval: -1}
+			require.NoError(t, db2.Open(), "round %d", round)
+			got := kvContents(db2)
+			assert.True(t, slices.ContainsFunc(possible, func(m map[string]string) bool {
+				return maps.Equal(m, got)
+			}), "round %d: the database is not at a committed state", round)
+			_, err := db2.Stats()
+			require.NoError(t, err)
+
+			// the free list survived too
+			contents = got
+			for i := 0; i < 5; i++ {
+				fn, next := randomUpdates(rng, contents)
+				require.NoError(t, db2.Update(fn))
+				contents = next
+			}
+			require.Equal(t, contents, kvContents(db2))
+			require.NoError(t, db2.Close())
+		}
+	}
+}
+
+func TestKVCommitFailure(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	check := func(db *KV, after bool) {
+		t.Helper()
+		for i := 0; i < 510; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			val, ok := db.Get([]byte(key))
+			require.Equal(t, i < 500, ok, key)
+			if ok {
+				require.Equal(t, "val"+key, string(val))
+			}
+		}
+		_, ok := db.Get([]byte("after"))
+		require.Equal(t, after, ok)
+	}
+
+	for _, kind := range []string{"write", "sync"} {
+		for nth := 0; ; nth++ {
+			sim := NewSimStorage(nil)
+			db := &KV{Storage: sim, SweepInterval: -1}
+			require.NoError(t, db.Open())
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				for i := 0; i < 500; i++ {
+					key := fmt.Sprintf("key%04d", i)
+					if err := tx.Set([]byte(key), []byte("val"+key)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+
+			// fails the nth write or sync of the commit
+			seen, failed := 0, false
+			sim.Fault = func(op SimOp) error {
+				if op.Kind != kind {
+					return nil
+				}
+				seen++
+				if seen-1 == nth {
+					failed = true
+					return errDisk
+				}
+				return nil
+			}
+			err := db.Update(func(tx *Tx) error {
+				for i := 490; i < 510; i++ {
+					key := fmt.Sprintf("key%04d", i)
+					if i < 500 {
+						tx.Del([]byte(key))
+					} else if err := tx.Set([]byte(key), []byte("new"+key)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if !failed {
+				// every operation of the commit has failed once
+				require.NoError(t, err)
+				require.NoError(t, db.Close())
+				require.Greater(t, nth, 1)
+				break
+			}
+			require.ErrorIs(t, err, errDisk, "%s %d", kind, nth)
+			check(db, false)
+
+			// the disk is still failing when the last meta page is restored
+			sim.Fault = func(op SimOp) error { return errDisk }
+			require.ErrorIs(t, db.Set([]byte("after"), []byte("x")), errDisk)
+			check(db, false)
+
+			sim.Fault = nil
+			require.NoError(t, db.Set([]byte("after"), []byte("x")))
+			check(db, true)
+
+			// a clean shutdown and a power loss both keep the last commit
+			for _, image := range [][]byte{sim.Bytes(), sim.Crash(rng)} {
+				db2 := &KV{Storage: NewSimStorage(image), SweepInterval: -1}
+				require.NoError(t, db2.Open())
+				check(db2, true)
+				require.NoError(t, db2.Close())
+			}
+			require.NoError(t, db.Close())
+		}
+	}
+}
+
+func TestKVInMemory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, cachePages := range []int{0, 16} {
+		db := &KV{Path: "kv.db", InMemory: true, CachePages: cachePages}
+		require.NoError(t, db.Open())
+
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			require.NoError(t, db.Set([]byte(key), []byte("value"+key)))
+		}
+		for i := 0; i < 3000; i += 3 {
+			_, err := db.Del([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 2000, db.Count(nil, nil))
+		if cachePages == 0 {
+			// the memory grows with the data, not by the 64MB of a mapped file
+			assert.Less(t, db.mmap.total, 1<<20)
+			assert.GreaterOrEqual(t, db.mmap.total, int(db.page.flushed*BTREE_PAGE_SIZE))
+		}
+
+		// transactions commit and roll back as on a file
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			return tx.Set([]byte("tx"), []byte("committed"))
+		}))
+		errAbort := errors.New("abort")
+		require.ErrorIs(t, db.Update(func(tx *Tx) error {
+			tx.Del([]byte("tx"))
+			return errAbort
+		}), errAbort)
+		val, ok := db.Get([]byte("tx"))
+		assert.True(t, ok)
+		assert.Equal(t, "committed", string(val))
+
+		var keys []string
+		db.Scan([]byte("key00010"), []byte("key00016"), func(key, val []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		assert.Equal(t, []string{"key00010", "key00011", "key00013", "key00014"}, keys)
+
+		b, err := db.CreateBucket([]byte("users"))
+		require.NoError(t, err)
+		require.NoError(t, b.Set([]byte("alice"), []byte("1")))
+
+		// a backup of the memory opens as a file
+		var buf bytes.Buffer
+		require.NoError(t, db.Backup(&buf))
+		require.NoError(t, Restore(&buf, "restored.db"))
+		restored, err := openKV("restored.db", nil)
+		require.NoError(t, err)
+		assert.Equal(t, kvContents(db), kvContents(restored))
+		val, ok = restored.Bucket([]byte("users")).Get([]byte("alice"))
+		assert.True(t, ok)
+		assert.Equal(t, "1", string(val))
+		require.NoError(t, restored.Close())
+		require.NoError(t, os.Remove("restored.db"))
+
+		require.NoError(t, db.Close())
+		_, err = os.Stat("kv.db")
+		assert.ErrorIs(t, err, os.ErrNotExist, "nothing is written to Path")
+
+		// every open starts empty
+		db = &KV{Path: "kv.db", InMemory: true, CachePages: cachePages}
+		require.NoError(t, db.Open())
+		assert.Equal(t, 0, db.Count(nil, nil))
+		require.NoError(t, db.Close())
+	}
+}
+
+// the empty key is the dummy key of the tree, writing or deleting it used to break the tree
+func TestKVEmptyKey(t *testing.T) {
+	db := &KV{InMemory: true}
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+
+	assert.ErrorIs(t, db.Set(nil, []byte("x")), ErrEmptyKey)
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	assert.ErrorIs(t, db.Set([]byte{}, []byte("x")), ErrEmptyKey)
+	assert.ErrorIs(t, db.Update(func(tx *Tx) error {
+		return tx.Set(nil, []byte("x"))
+	}), ErrEmptyKey)
+	ok, err := db.Del(nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, db.Set([]byte("b"), []byte("2")))
+	_, ok = db.Get(nil)
+	assert.False(t, ok)
+	assert.Equal(t, 2, db.Count(nil, nil))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, kvContents(db))
+
+	b, err := db.CreateBucket([]byte("bucket"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, b.Set(nil, []byte("x")), ErrEmptyKey)
+	require.NoError(t, b.Set([]byte("a"), []byte("1")))
+	_, ok = b.Get(nil)
+	assert.False(t, ok)
+	ok, err = b.Del(nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// runs ServeReplica and Follow over a pipe until the returned function is called
+func replicate(t *testing.T, primary, follower *KV) func() {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		primary.ServeReplica(c1)
+		c1.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		follower.Follow(c2)
+		c2.Close()
+	}()
+	return func() {
+		c2.Close()
+		wg.Wait()
+	}
+}
+
+// waits until the follower applied the last commit of the primary
+func waitReplica(t *testing.T, primary, follower *KV) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return follower.ReplicaStatus().Applied == primary.Version()
+	}, 10*time.Second, time.Millisecond)
+}
+
+func TestKVReplication(t *testing.T) {
+	dir := t.TempDir()
+	primary := &KV{Path: filepath.Join(dir, "primary.db"), ReplicationLog: 64}
+	require.NoError(t, primary.Open())
+	defer primary.Close()
+	for i := 0; i < 300; i++ {
+		require.NoError(t, primary.Set([]byte(fmt.Sprintf("key%04d", i)), bytes.Repeat([]byte{byte(i)}, i)))
+	}
+	require.NoError(t, primary.SetWithTTL([]byte("ttl"), []byte("v"), time.Hour))
+	b, err := primary.CreateBucket([]byte("bucket"))
+	require.NoError(t, err)
+	require.NoError(t, b.Set([]byte("a"), []byte("1")))
+
+	follower := &KV{Path: filepath.Join(dir, "follower.db"), Follower: true}
+	require.NoError(t, follower.Open())
+	defer follower.Close()
+	assert.Equal(t, uint64(0), follower.Version())
+	assert.ErrorIs(t, follower.Set([]byte("a"), []byte("b")), ErrReadOnly)
+	assert.Empty(t, kvContents(follower))
+
+	// commits made during the base copy
+	stop := replicate(t, primary, follower)
+	rng := rand.New(rand.NewSource(1))
+	contents := kvContents(primary)
+	for i := 0; i < 50; i++ {
+		update, next := randomUpdates(rng, contents)
+		require.NoError(t, primary.Update(update))
+		contents = next
+	}
+	waitReplica(t, primary, follower)
+	assert.Equal(t, contents, kvContents(follower))
+	val, ok := follower.Bucket([]byte("bucket")).Get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), val)
+	ttl, ok := follower.TTL([]byte("ttl"))
+	assert.True(t, ok)
+	assert.Greater(t, ttl, time.Minute)
+	status := follower.ReplicaStatus()
+	assert.Equal(t, 1, status.Bases)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.False(t, status.Contact.IsZero())
+	stop()
+
+	// a follower within the log catches up from it
+	for i := 0; i < 10; i++ {
+		update, next := randomUpdates(rng, contents)
+		require.NoError(t, primary.Update(update))
+		contents = next
+	}
+	stop = replicate(t, primary, follower)
+	waitReplica(t, primary, follower)
+	assert.Equal(t, contents, kvContents(follower))
+	assert.Equal(t, 1, follower.ReplicaStatus().Bases)
+
+	// a scan keeps its snapshot, the commits wait for it
+	scanning, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		follower.Scan(nil, nil, func(key, val []byte) bool {
+			close(scanning)
+			<-release
+			return false
+		})
+	}()
+	<-scanning
+	require.NoError(t, primary.Set([]byte("key0000"), []byte("new")))
+	require.Eventually(t, func() bool {
+		return follower.ReplicaStatus().Lag == 1
+	}, 10*time.Second, time.Millisecond)
+	close(release)
+	waitReplica(t, primary, follower)
+	val, _ = follower.Get([]byte("key0000"))
+	assert.Equal(t, []byte("new"), val)
+	contents["key0000"] = "new"
+	stop()
+
+	// a follower behind the log gets a new base copy
+	for i := 0; i < 100; i++ {
+		update, next := randomUpdates(rng, contents)
+		require.NoError(t, primary.Update(update))
+		contents = next
+	}
+	stop = replicate(t, primary, follower)
+	waitReplica(t, primary, follower)
+	stop()
+	assert.Equal(t, contents, kvContents(follower))
+	assert.Equal(t, 2, follower.ReplicaStatus().Bases)
+
+	// the follower file is a copy of the primary
+	stats, err := primary.Stats()
+	require.NoError(t, err)
+	require.NoError(t, primary.Close())
+	require.NoError(t, follower.Close())
+	size := int(stats.TotalPages * BTREE_PAGE_SIZE)
+	want, err := os.ReadFile(primary.Path)
+	require.NoError(t, err)
+	got, err := os.ReadFile(follower.Path)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(got), size)
+	assert.True(t, bytes.Equal(want[:size], got[:size]))
+
+	// and a database of its own once it's opened without Follower
+	db := &KV{Path: follower.Path, ReadOnly: true}
+	require.NoError(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, contents, kvContents(db))
+	assert.NoError(t, db.Check())
+}
+
+// a writer that fails after n bytes
+type failingWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.n {
+		return 0, errDisk
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestKVReplicationInterruptedBase(t *testing.T) {
+	dir := t.TempDir()
+	primary := &KV{Path: filepath.Join(dir, "primary.db"), ReplicationLog: 4}
+	require.NoError(t, primary.Open())
+	defer primary.Close()
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, primary.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("value")))
+	}
+
+	follower := &KV{Path: filepath.Join(dir, "follower.db"), Follower: true}
+	require.NoError(t, follower.Open())
+	stop := replicate(t, primary, follower)
+	waitReplica(t, primary, follower)
+	stop()
+	require.NoError(t, primary.Set([]byte("key0000"), []byte("new")))
+
+	// the stream of a new base copy breaks in the middle
+	hello := make([]byte, 16)
+	copy(hello, REPLICA_MAGIC)
+	stream := &failingWriter{n: 20 * BTREE_PAGE_SIZE}
+	assert.ErrorIs(t, primary.ServeReplica(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(hello), stream}), errDisk)
+	err := follower.Follow(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(stream.Bytes()), io.Discard})
+	assert.ErrorIs(t, err, ErrBadReplication)
+	assert.Equal(t, uint64(0), follower.Version())
+	assert.Empty(t, kvContents(follower))
+
+	// the half copied file is not a database
+	require.NoError(t, follower.Close())
+	follower = &KV{Path: follower.Path, Follower: true}
+	require.NoError(t, follower.Open())
+	defer follower.Close()
+	assert.Equal(t, uint64(0), follower.Version())
+	stop = replicate(t, primary, follower)
+	waitReplica(t, primary, follower)
+	stop()
+	assert.Equal(t, kvContents(primary), kvContents(follower))
+
+	// the stream is checked
+	var buf bytes.Buffer
+	buf.WriteString(REPLICA_MAGIC)
+	buf.Write([]byte{9, 0, 0, 0})
+	err = follower.Follow(struct {
+		io.Reader
+		io.Writer
+	}{&buf, io.Discard})
+	assert.ErrorIs(t, err, ErrBadReplication)
+	assert.Error(t, primary.Follow(nil))
+	assert.Error(t, follower.ServeReplica(nil))
+}
+
+func TestKVReplicationBulkLoad(t *testing.T) {
+	dir := t.TempDir()
+	primary := &KV{Path: filepath.Join(dir, "primary.db"), ReplicationLog: 4}
+	require.NoError(t, primary.Open())
+	defer primary.Close()
+	follower := &KV{Path: filepath.Join(dir, "follower.db"), Follower: true}
+	require.NoError(t, follower.Open())
+	defer follower.Close()
+	stop := replicate(t, primary, follower)
+	defer stop()
+	waitReplica(t, primary, follower)
+
+	// more pages than IOV_MAX, BulkLoad writes them before its commit
+	pairs := func(n int, unsorted bool) func(func([]byte, []byte) bool) {
+		return func(yield func([]byte, []byte) bool) {
+			for i := 0; i < n; i++ {
+				if !yield([]byte(fmt.Sprintf("key%06d", i)), bytes.Repeat([]byte{byte(i)}, i%200)) {
+					return
+				}
+			}
+			if unsorted {
+				yield([]byte("key"), nil)
+			}
+		}
+	}
+	// the pages written by a load that fails are not sent
+	_, err := primary.BulkLoad(pairs(30000, true), 0)
+	require.ErrorIs(t, err, ErrUnsorted)
+	n, err := primary.BulkLoad(pairs(50000, false), 0)
+	require.NoError(t, err)
+	require.Equal(t, 50000, n)
+	stats, err := primary.Stats()
+	require.NoError(t, err)
+	require.Greater(t, stats.PagesWritten, uint64(IOV_MAX))
+
+	// the follower got the commit from the log, not from a base copy
+	waitReplica(t, primary, follower)
+	assert.Equal(t, 1, follower.ReplicaStatus().Bases)
+	assert.NoError(t, follower.Check())
+	assert.Equal(t, kvContents(primary), kvContents(follower))
+}
+
+// the next change of w, fails after a second
+func nextChange(t *testing.T, w *Watcher) Change {
+	t.Helper()
+	select {
+	case change, ok := <-w.C:
+		require.True(t, ok, "watcher ended: %v", w.Err())
+		return change
+	case <-time.After(time.Second):
+		require.FailNow(t, "no change")
+		return Change{}
+	}
+}
+
+// no change comes for a moment
+func noChange(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case change := <-w.C:
+		assert.Fail(t, "unexpected change", "%q", change.Key)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestKVWatch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sim := NewSimStorage(nil)
+	db := &KV{Storage: sim, SweepInterval: -1, WatchLog: 8, CompressMin: 16, clock: func() time.Time { return now }}
+	require.NoError(t, db.Open())
+	defer db.Close()
+	require.NoError(t, db.Set([]byte("user/1"), []byte("a")))
+
+	w, err := db.WatchPrefix([]byte("user/"), 0)
+	require.NoError(t, err)
+	defer w.Close()
+	noChange(t, w)
+
+	big := bytes.Repeat([]byte("z"), 100)
+	require.NoError(t, db.Set([]byte("other"), []byte("x")))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		require.NoError(t, tx.Set([]byte("user/2"), big))
+		require.True(t, tx.Del([]byte("user/1")))
+		require.False(t, tx.Del([]byte("user/9")))
+		return tx.SetWithTTL([]byte("user/3"), nil, time.Minute)
+	}))
+	version := db.Version()
+	assert.Equal(t, Change{[]byte("user/2"), nil, big, version}, nextChange(t, w))
+	assert.Equal(t, Change{[]byte("user/1"), []byte("a"), nil, version}, nextChange(t, w))
+	assert.Equal(t, Change{[]byte("user/3"), nil, []byte{}, version}, nextChange(t, w))
+
+	// nothing is emitted for a transaction that fails or a commit that isn't durable
+	assert.Error(t, db.Update(func(tx *Tx) error {
+		tx.Set([]byte("user/4"), []byte("x"))
+		return errors.New("abort")
+	}))
+	syncs := 0
+	sim.Fault = func(op SimOp) error {
+		if op.Kind == "sync" {
+			syncs++
+			if syncs == 2 {
+				return errDisk // the final fsync of updateFile
+			}
+		}
+		return nil
+	}
+	assert.ErrorIs(t, db.Set([]byte("user/5"), []byte("x")), errDisk)
+	sim.Fault = nil
+	noChange(t, w)
+
+	_, err = db.DeleteRange([]byte("user/2"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, Change{[]byte("user/2"), big, nil, db.Version()}, nextChange(t, w))
+	assert.Equal(t, Change{[]byte("user/3"), []byte{}, nil, db.Version()}, nextChange(t, w))
+
+	// the sweeper's deletes of expired keys
+	require.NoError(t, db.SetWithTTL([]byte("user/6"), []byte("ttl"), time.Second))
+	assert.Equal(t, []byte("ttl"), nextChange(t, w).New)
+	now = now.Add(time.Hour)
+	_, err = db.SweepExpired()
+	require.NoError(t, err)
+	assert.Equal(t, Change{[]byte("user/6"), []byte("ttl"), nil, db.Version()}, nextChange(t, w))
+
+	// resume from the last version read
+	require.NoError(t, db.Set([]byte("user/7"), []byte("1")))
+	nextChange(t, w)
+	w.Close()
+	_, ok := <-w.C
+	assert.False(t, ok)
+	assert.NoError(t, w.Err())
+	require.NoError(t, db.Set([]byte("user/8"), []byte("2")))
+	require.NoError(t, db.Set([]byte("user/7"), []byte("3")))
+	w2, err := db.Watch([]byte("user/7"), []byte("user/8"), w.Version())
+	require.NoError(t, err)
+	assert.Equal(t, Change{[]byte("user/7"), []byte("1"), []byte("3"), db.Version()}, nextChange(t, w2))
+
+	// a watcher that doesn't read falls behind the log
+	require.NoError(t, db.Set([]byte("user/7"), []byte("4")))
+	time.Sleep(20 * time.Millisecond) // the watcher waits for the reader with the change
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set([]byte("user/7"), []byte{byte(i)}))
+	}
+	n := 0
+	for range w2.C {
+		n++
+	}
+	assert.Less(t, n, 20)
+	assert.ErrorIs(t, w2.Err(), ErrWatchBehind)
+	_, err = db.Watch(nil, nil, w.Version())
+	assert.ErrorIs(t, err, ErrWatchBehind)
+	_, err = db.Watch(nil, nil, db.Version()+1)
+	assert.Error(t, err)
+
+	// Close ends the watchers
+	w3, err := db.Watch(nil, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, ok = <-w3.C
+	assert.False(t, ok)
+	assert.NoError(t, w3.Err())
+
+	plain := openTestKV(t, "kv.db")
+	_, err = plain.Watch(nil, nil, 0)
+	assert.Error(t, err)
+}
+
+func TestKVMerge(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	db := &KV{
+		Path:          filepath.Join(t.TempDir(), "kv.db"),
+		SweepInterval: -1,
+		MergeOperators: map[string]MergeFunc{
+			"":         MergeAppend,
+			"count:":   MergeAdd,
+			"count:hi": MergeMax,
+			"set:":     MergeUnion,
+		},
+		clock: func() time.Time { return now },
+	}
+	require.NoError(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+
+	get := func(key string) string {
+		val, ok := db.Get([]byte(key))
+		require.True(t, ok, key)
+		return string(val)
+	}
+
+	// the longest prefix wins
+	require.NoError(t, db.Merge([]byte("count:a"), []byte("5")))
+	require.NoError(t, db.Merge([]byte("count:a"), []byte("-7")))
+	assert.Equal(t, "-2", get("count:a"))
+	require.NoError(t, db.Merge([]byte("count:hi"), []byte("3")))
+	require.NoError(t, db.Merge([]byte("count:hi"), []byte("9")))
+	require.NoError(t, db.Merge([]byte("count:hi"), []byte("4")))
+	assert.Equal(t, "9", get("count:hi"))
+	require.NoError(t, db.Merge([]byte("log"), []byte("a,")))
+	require.NoError(t, db.Merge([]byte("log"), []byte("b,")))
+	assert.Equal(t, "a,b,", get("log"))
+
+	require.NoError(t, db.Merge([]byte("set:s"), EncodeSet([]byte("b"), []byte("a"), []byte("b"))))
+	require.NoError(t, db.Merge([]byte("set:s"), EncodeSet([]byte("c"), []byte("a"), []byte{})))
+	elems, err := DecodeSet([]byte(get("set:s")))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{}, []byte("a"), []byte("b"), []byte("c")}, elems)
+
+	// a failed merge doesn't commit
+	version := db.Version()
+	assert.ErrorIs(t, db.Merge([]byte("count:a"), []byte("x")), ErrNotInteger)
+	assert.ErrorIs(t, db.Merge([]byte("set:s"), []byte{5, 'a'}), ErrBadSet)
+	require.NoError(t, db.Set([]byte("count:big"), []byte("9223372036854775807")))
+	assert.ErrorIs(t, db.Merge([]byte("count:big"), []byte("1")), ErrOverflow)
+	assert.Equal(t, version+1, db.Version())
+	assert.Equal(t, "-2", get("count:a"))
+
+	plain := &KV{Path: filepath.Join(t.TempDir(), "plain.db"), SweepInterval: -1}
+	require.NoError(t, plain.Open())
+	defer plain.Close()
+	assert.ErrorIs(t, plain.Merge([]byte("k"), []byte("v")), ErrNoMergeOperator)
+
+	// Incr needs no operator
+	n, err := plain.Incr([]byte("n"), 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	n, err = plain.Incr([]byte("n"), -3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+	require.NoError(t, plain.Set([]byte("min"), []byte("-9223372036854775808")))
+	_, err = plain.Incr([]byte("min"), -1)
+	assert.ErrorIs(t, err, ErrOverflow)
+
+	// the expiry is kept, an expired key starts over without one
+	require.NoError(t, db.SetWithTTL([]byte("count:ttl"), []byte("1"), time.Minute))
+	now = now.Add(20 * time.Second)
+	n, err = db.Incr([]byte("count:ttl"), 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	ttl, ok := db.TTL([]byte("count:ttl"))
+	assert.True(t, ok)
+	assert.Equal(t, 40*time.Second, ttl)
+	now = now.Add(time.Minute)
+	require.NoError(t, db.Merge([]byte("count:ttl"), []byte("5")))
+	assert.Equal(t, "5", get("count:ttl"))
+	ttl, ok = db.TTL([]byte("count:ttl"))
+	assert.True(t, ok)
+	assert.Zero(t, ttl)
+
+	// concurrent increments are not lost
+	const WRITERS, INCRS = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < WRITERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < INCRS; j++ {
+				_, err := plain.Incr([]byte("hits"), 1)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	val, _ := plain.Get([]byte("hits"))
+	assert.Equal(t, fmt.Sprint(WRITERS*INCRS), string(val))
+}
+
+// key orders of the benchmarks
+var benchDists = []string{"seq", "random", "zipf"}
+
+const BENCH_KEYS = 100000
+
+// indexes of keys in [0, n) in the order of dist
+// the zipfian hot keys are spread over the key space instead of being neighbours
+func benchKeyGen(dist string, n int, rng *rand.Rand) func() int {
+	switch dist {
+	case "seq":
+		i := -1
+		return func() int {
+			i = (i + 1) % n
+			return i
+		}
+	case "zipf":
+		zipf := rand.NewZipf(rng, 1.1, 1, uint64(n-1))
+		return func() int { return int(zipf.Uint64() * 2654435761 % uint64(n)) }
+	}
+	return func() int { return rng.Intn(n) }
+}
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%010d", i))
+}
+
+var benchVal = bytes.Repeat([]byte("v"), 100)
+
+// a database holding the keys [0, n), loaded in a single commit
+func benchKV(b *testing.B, n int) *KV {
+	db := &KV{Path: filepath.Join(b.TempDir(), "bench.db"), SweepInterval: -1}
+	require.NoError(b, db.Open())
+	b.Cleanup(func() { db.Close() })
+	_, err := db.BulkLoad(func(yield func([]byte, []byte) bool) {
+		for i := 0; i < n && yield(benchKey(i), benchVal); i++ {
+		}
+	}, 0)
+	require.NoError(b, err)
+	return db
+}
+
+// reports the pages written and the fsyncs per logical write since before
+func reportWrites(b *testing.B, db *KV, before Stats, writes int) {
+	b.StopTimer()
+	after, err := db.Stats()
+	require.NoError(b, err)
+	b.ReportMetric(float64(after.PagesWritten-before.PagesWritten)/float64(writes), "pages/write")
+	b.ReportMetric(float64(after.Syncs-before.Syncs)/float64(writes), "fsyncs/write")
+}
+
+func BenchmarkKVGet(b *testing.B) {
+	db := benchKV(b, BENCH_KEYS)
+	for _, dist := range benchDists {
+		b.Run(dist, func(b *testing.B) {
+			next := benchKeyGen(dist, BENCH_KEYS, rand.New(rand.NewSource(1)))
+			for i := 0; i < b.N; i++ {
+				if _, ok := db.Get(benchKey(next())); !ok {
+					b.Fatal("key not found")
+				}
+			}
+		})
+	}
+}
+
+// every Set is a commit with its two fsyncs
+func BenchmarkKVSet(b *testing.B) {
+	for _, dist := range benchDists {
+		b.Run(dist, func(b *testing.B) {
+			db := benchKV(b, BENCH_KEYS)
+			next := benchKeyGen(dist, BENCH_KEYS, rand.New(rand.NewSource(1)))
+			before, err := db.Stats()
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.Set(benchKey(next()), benchVal))
+			}
+			reportWrites(b, db, before, b.N)
+		})
+	}
+}
+
+// a key is only deleted once, so there's no zipfian order
+func BenchmarkKVDel(b *testing.B) {
+	for _, dist := range benchDists[:2] {
+		b.Run(dist, func(b *testing.B) {
+			db := benchKV(b, b.N)
+			order := rand.New(rand.NewSource(1)).Perm(b.N)
+			if dist == "seq" {
+				slices.Sort(order)
+			}
+			before, err := db.Stats()
+			require.NoError(b, err)
+			b.ResetTimer()
+			for _, i := range order {
+				if ok, err := db.Del(benchKey(i)); err != nil || !ok {
+					b.Fatal("delete failed", err)
+				}
+			}
+			reportWrites(b, db, before, b.N)
+		})
+	}
+}
+
+// scans of 100 keys from a key of the distribution
+func BenchmarkKVScan(b *testing.B) {
+	db := benchKV(b, BENCH_KEYS)
+	for _, dist := range benchDists {
+		b.Run(dist, func(b *testing.B) {
+			next := benchKeyGen(dist, BENCH_KEYS, rand.New(rand.NewSource(1)))
+			for i := 0; i < b.N; i++ {
+				n := 0
+				db.Scan(benchKey(next()), nil, func(key, val []byte) bool {
+					n++
+					return n < 100
+				})
+			}
+		})
+	}
+}
+
+// transactions of 100 Sets, the commit cost is shared by the writes
+func BenchmarkKVUpdate(b *testing.B) {
+	for _, dist := range benchDists {
+		b.Run(dist, func(b *testing.B) {
+			db := benchKV(b, BENCH_KEYS)
+			next := benchKeyGen(dist, BENCH_KEYS, rand.New(rand.NewSource(1)))
+			before, err := db.Stats()
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.Update(func(tx *Tx) error {
+					for j := 0; j < 100; j++ {
+						if err := tx.Set(benchKey(next()), benchVal); err != nil {
+							return err
+						}
+					}
+					return nil
+				}))
+			}
+			reportWrites(b, db, before, 100*b.N)
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package btree
+
+import (
+	"errors"
+	"time"
+)
+
+// Open takes an advisory flock on the file, exclusive for writers and shared for readers
+// so several readers can have the file open but a writer is alone
+// the lock belongs to the file descriptor, it's released by Close (or when the process dies)
+
+var ErrLocked = errors.New("database is locked by another process")
+
+// how often a blocked Open retries while waiting for KV.LockTimeout
+const LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// takes the lock of the storage, waits up to timeout if another process holds it
+func lockStorage(s Storage, shared bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := s.Lock(shared)
+		if err != ErrLocked || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(min(LOCK_RETRY_INTERVAL, time.Until(deadline)))
+	}
+}
@@ -0,0 +1,120 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// with KV.InMemory the database lives in memory and is lost on Close
+// it's the same engine, the file is replaced by chunks of memory that KV maps like the chunks of a file,
+// so transactions, scans, buckets and backups behave the same and Sync costs nothing
+
+// the chunks are handed out by Mmap, so the mapped pages are the storage itself
+type memStorage struct {
+	mu     sync.Mutex
+	chunks [][]byte // back to back from offset 0
+	mapped int64    // bytes in chunks
+	size   int64    // end of the last write
+}
+
+// grows the memory to at least end bytes, doubling it like extendMap
+func (m *memStorage) grow(end int64) {
+	if end <= m.mapped {
+		return
+	}
+	alloc := max(m.mapped, BTREE_PAGE_SIZE)
+	for m.mapped+alloc < end {
+		alloc *= 2
+	}
+	m.chunks = append(m.chunks, make([]byte, alloc))
+	m.mapped += alloc
+}
+
+// calls fn for the parts of the chunks in [off, off+n)
+func (m *memStorage) each(off int64, n int, fn func(part []byte, done int)) {
+	start := int64(0)
+	done := 0
+	for _, chunk := range m.chunks {
+		end := start + int64(len(chunk))
+		if done < n && off+int64(done) < end {
+			from := off + int64(done) - start
+			part := chunk[from:min(int64(len(chunk)), from+int64(n-done))]
+			fn(part, done)
+			done += len(part)
+		}
+		start = end
+	}
+}
+
+func (m *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), m.size-off))
+	m.each(off, n, func(part []byte, done int) {
+		copy(p[done:], part)
+	})
+	return n, nil
+}
+
+func (m *memStorage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.grow(off + int64(len(p)))
+	m.each(off, len(p), func(part []byte, done int) {
+		copy(part, p[done:])
+	})
+	m.size = max(m.size, off+int64(len(p)))
+	return len(p), nil
+}
+
+func (m *memStorage) WritevAt(bufs [][]byte, off int64) (int, error) {
+	total := 0
+	for _, buf := range bufs {
+		n, _ := m.WriteAt(buf, off+int64(total))
+		total += n
+	}
+	return total, nil
+}
+
+func (m *memStorage) Sync() error {
+	return nil
+}
+
+func (m *memStorage) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size, nil
+}
+
+// KV maps the memory in order, each mapping is a new chunk
+func (m *memStorage) Mmap(off int64, length int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off != m.mapped {
+		return nil, fmt.Errorf("memory storage: mapping at %d with %d bytes mapped", off, m.mapped)
+	}
+	chunk := make([]byte, length)
+	m.chunks = append(m.chunks, chunk)
+	m.mapped += int64(length)
+	return chunk, nil
+}
+
+func (m *memStorage) Munmap(data []byte) error {
+	return nil
+}
+
+// the memory belongs to a single KV
+func (m *memStorage) Lock(shared bool) error {
+	return nil
+}
+
+func (m *memStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chunks, m.mapped, m.size = nil, 0, 0
+	return nil
+}
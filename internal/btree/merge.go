@@ -0,0 +1,192 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Merge applies a merge function to the value of a key and an operand in the transaction that
+// commits the result, so a counter or a list is updated without a Get and a Set by the caller
+// the function is picked by the prefix of the key in KV.MergeOperators
+// a merged key keeps its time to live
+//
+// the integers of MergeAdd, MergeMax and Incr are decimal text, like the INCR of cmd/dbserver
+// the sets of MergeUnion are sorted distinct elements, each one a uvarint length and its bytes
+
+var (
+	ErrNoMergeOperator = errors.New("no merge operator for the key")
+	ErrNotInteger      = errors.New("value is not an integer")
+	ErrOverflow        = errors.New("integer overflow")
+	ErrBadSet          = errors.New("value is not a set")
+)
+
+// MergeFunc returns the new value of a key from its value, nil if it doesn't exist, and an operand
+type MergeFunc func(old []byte, exists bool, operand []byte) ([]byte, error)
+
+// Merge merges operand into the value of key in a single commit, see merge.go
+func (db *KV) Merge(key, operand []byte) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Merge(key, operand)
+	})
+}
+
+// like KV.Merge, inside a transaction
+func (tx *Tx) Merge(key, operand []byte) error {
+	fn := tx.db.mergeOperator(key)
+	if fn == nil {
+		return fmt.Errorf("%w %q", ErrNoMergeOperator, key)
+	}
+	old, exists := tx.Get(key)
+	val, err := fn(old, exists, operand)
+	if err != nil {
+		return fmt.Errorf("merge %q: %w", key, err)
+	}
+	return tx.setKeepTTL(key, val)
+}
+
+// Incr adds delta to the integer at key, a missing key counts as 0, and returns the sum
+func (db *KV) Incr(key []byte, delta int64) (n int64, err error) {
+	err = db.Update(func(tx *Tx) error {
+		n, err = tx.Incr(key, delta)
+		return err
+	})
+	return n, err
+}
+
+// like KV.Incr, inside a transaction
+func (tx *Tx) Incr(key []byte, delta int64) (int64, error) {
+	old, exists := tx.Get(key)
+	n, err := addInt(old, exists, delta)
+	if err != nil {
+		return 0, fmt.Errorf("incr %q: %w", key, err)
+	}
+	return n, tx.setKeepTTL(key, strconv.AppendInt(nil, n, 10))
+}
+
+// the merge function of the longest prefix of key in KV.MergeOperators, nil if none matches
+func (db *KV) mergeOperator(key []byte) MergeFunc {
+	var fn MergeFunc
+	longest := -1
+	for prefix, op := range db.MergeOperators {
+		if len(prefix) > longest && strings.HasPrefix(string(key), prefix) {
+			fn, longest = op, len(prefix)
+		}
+	}
+	return fn
+}
+
+// sets key to val, keeping the expiry of its old value
+func (tx *Tx) setKeepTTL(key, val []byte) error {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	// an expired value is gone, the new one doesn't expire
+	stored, flags, ok := tx.db.tree.GetFlags(key)
+	if expiry := valExpiry(stored, flags); ok && expiry != 0 && !isExpired(stored, flags, tx.db.clock()) {
+		tx.setExpiring(key, val, expiry)
+		return nil
+	}
+	return tx.Set(key, val)
+}
+
+func parseInt(val []byte, exists bool) (int64, error) {
+	if !exists {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrNotInteger, val)
+	}
+	return n, nil
+}
+
+func addInt(old []byte, exists bool, delta int64) (int64, error) {
+	n, err := parseInt(old, exists)
+	if err != nil {
+		return 0, err
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		return 0, fmt.Errorf("%w: %d + %d", ErrOverflow, n, delta)
+	}
+	return n + delta, nil
+}
+
+// MergeAdd adds the integer operand to the integer value
+func MergeAdd(old []byte, exists bool, operand []byte) ([]byte, error) {
+	delta, err := parseInt(operand, true)
+	if err != nil {
+		return nil, err
+	}
+	n, err := addInt(old, exists, delta)
+	if err != nil {
+		return nil, err
+	}
+	return strconv.AppendInt(nil, n, 10), nil
+}
+
+// MergeMax keeps the greater of the integer value and the integer operand
+func MergeMax(old []byte, exists bool, operand []byte) ([]byte, error) {
+	m, err := parseInt(operand, true)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		n, err := parseInt(old, exists)
+		if err != nil {
+			return nil, err
+		}
+		m = max(m, n)
+	}
+	return strconv.AppendInt(nil, m, 10), nil
+}
+
+// MergeAppend appends the operand to the value
+func MergeAppend(old []byte, exists bool, operand []byte) ([]byte, error) {
+	return append(bytes.Clone(old), operand...), nil
+}
+
+// MergeUnion adds the elements of the set operand to the set value
+func MergeUnion(old []byte, exists bool, operand []byte) ([]byte, error) {
+	elems, err := DecodeSet(old)
+	if err != nil {
+		return nil, err
+	}
+	add, err := DecodeSet(operand)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeSet(append(elems, add...)...), nil
+}
+
+// EncodeSet returns the set of elems as MergeUnion stores it, sorted without duplicates
+func EncodeSet(elems ...[]byte) []byte {
+	sorted := slices.Clone(elems)
+	slices.SortFunc(sorted, bytes.Compare)
+	sorted = slices.CompactFunc(sorted, bytes.Equal)
+	var out []byte
+	for _, elem := range sorted {
+		out = binary.AppendUvarint(out, uint64(len(elem)))
+		out = append(out, elem...)
+	}
+	return out
+}
+
+// DecodeSet returns the elements of a set made by EncodeSet
+func DecodeSet(val []byte) ([][]byte, error) {
+	elems := [][]byte{}
+	for len(val) > 0 {
+		n, size := binary.Uvarint(val)
+		if size <= 0 || n > uint64(len(val)-size) {
+			return nil, fmt.Errorf("%w: bad element length", ErrBadSet)
+		}
+		elems = append(elems, val[size:size+int(n)])
+		val = val[size+int(n):]
+	}
+	return elems, nil
+}
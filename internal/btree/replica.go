@@ -0,0 +1,620 @@
+package btree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// Log shipping: a primary streams every commit to followers as the page images it wrote,
+// so the file of a follower is a copy of the file of its primary, page for page
+//
+// the follower opens the stream with a hello
+// | magic | version it has |
+// | 8B    | 8B            |
+// and the primary answers with the header of the stream
+// | magic | version | page size | records ... |
+// | 8B    | 4B      | 4B        |             |
+// each record is a tag byte followed by its fields
+// tag 'S' -> version (8B), meta (META_SIZE) a base copy of the file at version starts
+// tag 'P' -> ptr (8B), page image, a page of the base copy or of the next commit
+// tag 'E' -> version (8B), crc (4B) the base copy ends, the follower has a valid file once it applied version
+// tag 'C' -> version (8B), meta (META_SIZE), crc (4B) the pages since the last commit are a commit
+// tag 'H' -> version (8B) the newest version of the primary, sent when there is nothing else
+// crc is the crc32 (castagnoli) of the records since the previous 'E' or 'C' record, or since the header
+//
+// the base copy is read while the primary keeps committing, so a page can be copied newer than
+// the version of the base, the commits after it overwrite every such page and the follower
+// doesn't write its meta page until it applied the version of the 'E' record
+const (
+	REPLICA_MAGIC   = "DBREPLIC"
+	REPLICA_VERSION = 1
+	// how often the primary sends its version when it has no commit to send
+	REPLICA_HEARTBEAT = time.Second
+	// pages of a base copy read under a single hold of the read lock
+	REPLICA_BASE_BATCH = 256
+)
+
+const (
+	replTagBase      = 'S'
+	replTagPage      = 'P'
+	replTagBaseEnd   = 'E'
+	replTagCommit    = 'C'
+	replTagHeartbeat = 'H'
+)
+
+var ErrBadReplication = errors.New("invalid replication stream")
+
+// ReplicaStatus is how far a follower is behind its primary
+type ReplicaStatus struct {
+	Applied uint64    // version of the last applied commit, 0 until a base copy is complete
+	Primary uint64    // newest version announced by the primary
+	Lag     uint64    // commits announced but not applied yet
+	Contact time.Time // when the primary was last heard from, zero if it never was
+	Bases   int       // base copies received since Open
+}
+
+// a commit as it was written to the file
+type replCommit struct {
+	version uint64
+	meta    []byte
+	pages   []replPage
+}
+
+type replPage struct {
+	ptr  uint64
+	data []byte
+}
+
+type replState struct {
+	// primary: the last KV.ReplicationLog commits, oldest first
+	log     []*replCommit
+	pending *replCommit   // pages written by the commit in progress
+	notify  chan struct{} // closed and replaced by every commit
+	closed  chan struct{} // closed by Close
+	// follower: a commit being applied waits for the pinned snapshots, new ones wait for it
+	applying bool
+	cond     *sync.Cond
+	status   ReplicaStatus
+}
+
+func (r *replState) init(db *KV) {
+	r.log, r.pending = nil, nil
+	r.notify = make(chan struct{})
+	r.closed = make(chan struct{})
+	r.cond = sync.NewCond(&db.mu)
+	r.status = ReplicaStatus{}
+}
+
+// wakes ServeReplica, called by Close
+func (r *replState) close(db *KV) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if r.closed != nil {
+		close(r.closed)
+		r.closed = nil
+	}
+}
+
+// keeps the pages written by writePages for the log, called with the pages as they reach the file
+// BulkLoad calls writePages before its commit is done, the pages add up until commit or abort
+func (r *replState) capture(db *KV, temp [][]byte, updates map[uint64][]byte) {
+	if db.ReplicationLog <= 0 || db.Follower {
+		return
+	}
+	if r.pending == nil {
+		r.pending = &replCommit{}
+	}
+	c := r.pending
+	for i, page := range temp {
+		c.pages = append(c.pages, replPage{db.page.flushed + uint64(i), clonePage(page)})
+	}
+	for ptr, page := range updates {
+		c.pages = append(c.pages, replPage{ptr, clonePage(page)})
+	}
+}
+
+// the commit in progress was reverted
+func (r *replState) abort() {
+	r.pending = nil
+}
+
+func clonePage(page []byte) []byte {
+	return append(make([]byte, 0, BTREE_PAGE_SIZE), page...)
+}
+
+// adds the commit updateFile just made durable to the log, called with the lock held
+func (r *replState) commit(db *KV) {
+	c := r.pending
+	r.pending = nil
+	if c == nil {
+		return
+	}
+	c.version = db.version
+	c.meta = saveMeta(db)
+	// the old entries are dropped by reslicing, ServeReplica may still be sending them
+	r.log = append(r.log, c)
+	if len(r.log) > db.ReplicationLog {
+		r.log = r.log[len(r.log)-db.ReplicationLog:]
+	}
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// the commits after version from, false if the log doesn't have all of them
+func (r *replState) since(from, version uint64) ([]*replCommit, bool) {
+	if from == 0 || from > version {
+		return nil, false
+	}
+	if from == version {
+		return nil, true
+	}
+	if len(r.log) == 0 || r.log[0].version > from+1 {
+		return nil, false
+	}
+	return r.log[from+1-r.log[0].version:], true
+}
+
+// called by pin with the lock held
+func (r *replState) waitApply() {
+	for r.applying {
+		r.cond.Wait()
+	}
+}
+
+// called when a snapshot is released with the lock held
+func (r *replState) unpinned(db *KV) {
+	if db.pins == 0 && r.applying {
+		r.cond.Broadcast()
+	}
+}
+
+// ServeReplica streams the commits of db to the follower on the other end of conn
+// until the follower hangs up, writing to conn fails or db is closed
+// the follower gets the commits after the version it has from the log kept with KV.ReplicationLog,
+// or a base copy of the file first when the log doesn't reach back that far
+// commits never wait for followers, one that falls behind the log gets a new base copy
+// conn should be closed before db so a blocked write doesn't keep ServeReplica from returning
+func (db *KV) ServeReplica(conn io.ReadWriter) error {
+	if db.ReplicationLog <= 0 || db.Follower {
+		return fmt.Errorf("serve replica: KV.ReplicationLog is not set")
+	}
+	var hello [16]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return fmt.Errorf("%w: hello: %v", ErrBadReplication, err)
+	}
+	if string(hello[:8]) != REPLICA_MAGIC {
+		return fmt.Errorf("%w: bad magic", ErrBadReplication)
+	}
+	from := binary.LittleEndian.Uint64(hello[8:])
+	// the follower sends nothing after the hello, the read ends when it hangs up
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	w := newReplWriter(conn)
+	var header [16]byte
+	copy(header[:8], REPLICA_MAGIC)
+	binary.LittleEndian.PutUint32(header[8:], REPLICA_VERSION)
+	binary.LittleEndian.PutUint32(header[12:], BTREE_PAGE_SIZE)
+	w.write(header[:])
+	w.crc.Reset()
+
+	heartbeat := time.NewTicker(REPLICA_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		db.mu.RLock()
+		commits, ok := db.repl.since(from, db.version)
+		version, notify, closed := db.version, db.repl.notify, db.repl.closed
+		db.mu.RUnlock()
+		if closed == nil {
+			return nil
+		}
+
+		if !ok {
+			var err error
+			if from, err = db.sendBase(w); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, c := range commits {
+			for _, page := range c.pages {
+				w.page(page.ptr, page.data)
+			}
+			w.tag(replTagCommit)
+			w.uint64(c.version)
+			w.write(c.meta)
+			w.sum()
+			from = c.version
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+		if len(commits) > 0 {
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-closed:
+			return nil
+		case <-gone:
+			return nil
+		case <-heartbeat.C:
+			w.tag(replTagHeartbeat)
+			w.uint64(version)
+		}
+	}
+}
+
+// streams a base copy of the file, returns its version
+// the file is read in batches under the read lock, so writers are only blocked while a batch is read
+func (db *KV) sendBase(w *replWriter) (uint64, error) {
+	db.mu.RLock()
+	version, flushed, meta := db.version, db.page.flushed, saveMeta(db)
+	db.mu.RUnlock()
+
+	w.tag(replTagBase)
+	w.uint64(version)
+	w.write(meta)
+
+	batch := make([]byte, REPLICA_BASE_BATCH*BTREE_PAGE_SIZE)
+	for ptr := uint64(1); ptr < flushed; ptr += REPLICA_BASE_BATCH {
+		n := min(flushed-ptr, REPLICA_BASE_BATCH)
+		db.mu.RLock()
+		if db.repl.closed == nil {
+			db.mu.RUnlock()
+			return 0, nil // ServeReplica returns
+		}
+		_, err := db.store.ReadAt(batch[:n*BTREE_PAGE_SIZE], int64(ptr*BTREE_PAGE_SIZE))
+		db.mu.RUnlock()
+		if err != nil {
+			return 0, fmt.Errorf("base copy: %w", err)
+		}
+		for i := uint64(0); i < n; i++ {
+			w.page(ptr+i, batch[i*BTREE_PAGE_SIZE:(i+1)*BTREE_PAGE_SIZE])
+		}
+		if err := w.err; err != nil {
+			return 0, err
+		}
+	}
+
+	// the commits made during the copy come next, the follower needs them all
+	db.mu.RLock()
+	end := db.version
+	db.mu.RUnlock()
+	w.tag(replTagBaseEnd)
+	w.uint64(end)
+	w.sum()
+	return version, w.flush()
+}
+
+// buffered writes of records, the first error sticks
+type replWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+func newReplWriter(w io.Writer) *replWriter {
+	return &replWriter{w: bufio.NewWriter(w), crc: crc32.New(backupCRC)}
+}
+
+func (w *replWriter) write(p []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+		w.crc.Write(p)
+	}
+}
+
+func (w *replWriter) tag(tag byte) {
+	w.write([]byte{tag})
+}
+
+func (w *replWriter) uint64(v uint64) {
+	w.write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func (w *replWriter) page(ptr uint64, data []byte) {
+	w.tag(replTagPage)
+	w.uint64(ptr)
+	w.write(data)
+}
+
+// ends a checkpoint record with the crc of the records since the last one
+func (w *replWriter) sum() {
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], w.crc.Sum32())
+	if w.err == nil {
+		_, w.err = w.w.Write(sum[:])
+	}
+	w.crc.Reset()
+}
+
+func (w *replWriter) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// Follow keeps a follower up to date with the primary on the other end of conn until reading
+// from conn fails, it returns nil when the primary ends the stream
+// a commit is applied like updateFile writes it, so after a crash the follower is at the last
+// commit it applied, and Follow picks up from there
+// readers see the last applied commit, a commit waits for the snapshots pinned before it
+func (db *KV) Follow(conn io.ReadWriter) error {
+	if !db.Follower {
+		return fmt.Errorf("follow: KV.Follower is not set")
+	}
+	db.mu.RLock()
+	from := db.version
+	db.mu.RUnlock()
+
+	var hello [16]byte
+	copy(hello[:8], REPLICA_MAGIC)
+	binary.LittleEndian.PutUint64(hello[8:], from)
+	if _, err := conn.Write(hello[:]); err != nil {
+		return err
+	}
+
+	crc := crc32.New(backupCRC)
+	raw := bufio.NewReader(conn)
+	in := io.TeeReader(raw, crc)
+	read := func(p []byte) error {
+		if _, err := io.ReadFull(in, p); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadReplication, err)
+		}
+		return nil
+	}
+	checkSum := func() error {
+		sum := crc.Sum32()
+		var stored [4]byte
+		if _, err := io.ReadFull(raw, stored[:]); err != nil {
+			return fmt.Errorf("%w: checksum: %v", ErrBadReplication, err)
+		}
+		if binary.LittleEndian.Uint32(stored[:]) != sum {
+			return fmt.Errorf("%w: checksum mismatch", ErrBadReplication)
+		}
+		crc.Reset()
+		return nil
+	}
+
+	var header [16]byte
+	if _, err := io.ReadFull(raw, header[:]); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("%w: header: %v", ErrBadReplication, err)
+	}
+	if string(header[:8]) != REPLICA_MAGIC {
+		return fmt.Errorf("%w: bad magic", ErrBadReplication)
+	}
+	if v := binary.LittleEndian.Uint32(header[8:]); v != REPLICA_VERSION {
+		return fmt.Errorf("%w: unsupported version %d", ErrBadReplication, v)
+	}
+	if size := binary.LittleEndian.Uint32(header[12:]); size != BTREE_PAGE_SIZE {
+		return fmt.Errorf("%w: page size %d", ErrBadReplication, size)
+	}
+
+	// a base copy is being received until the follower applied end
+	base := struct {
+		copying bool // pages are written as they come
+		pending bool // the meta page is not written until end
+		end     uint64
+		meta    []byte
+	}{}
+	applied := from
+	known := from > 0 // the follower has a base copy of this primary
+	pages := []replPage{}
+	tag := []byte{0}
+	var word [8]byte
+	for {
+		if _, err := io.ReadFull(in, tag); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%w: %v", ErrBadReplication, err)
+		}
+		if err := read(word[:]); err != nil {
+			return err
+		}
+		num := binary.LittleEndian.Uint64(word[:])
+
+		switch tag[0] {
+		case replTagBase:
+			meta := make([]byte, META_SIZE)
+			if err := read(meta); err != nil {
+				return err
+			}
+			if err := db.startBase(num); err != nil {
+				return err
+			}
+			base.copying, base.pending, base.end, base.meta = true, true, 0, meta
+			applied, pages, known = num, pages[:0], true
+		case replTagPage:
+			page := make([]byte, BTREE_PAGE_SIZE)
+			if err := read(page); err != nil {
+				return err
+			}
+			if num == 0 {
+				return fmt.Errorf("%w: page record for the meta page", ErrBadReplication)
+			}
+			if !base.copying {
+				pages = append(pages, replPage{num, page})
+				continue
+			}
+			if err := db.applyPages([]replPage{{num, page}}); err != nil {
+				return err
+			}
+		case replTagBaseEnd:
+			if err := checkSum(); err != nil {
+				return err
+			}
+			if !base.copying || num < applied {
+				return fmt.Errorf("%w: base copy end at version %d", ErrBadReplication, num)
+			}
+			base.copying, base.end = false, num
+			db.announce(num)
+			if applied == base.end {
+				if err := db.applyCommit(nil, base.meta, true); err != nil {
+					return err
+				}
+				base.pending = false
+			}
+		case replTagCommit:
+			meta := make([]byte, META_SIZE)
+			if err := read(meta); err != nil {
+				return err
+			}
+			if err := checkSum(); err != nil {
+				return err
+			}
+			if base.copying || !known || num != applied+1 {
+				return fmt.Errorf("%w: commit %d after version %d", ErrBadReplication, num, applied)
+			}
+			db.announce(num)
+			publish := !base.pending || num >= base.end
+			if err := db.applyCommit(pages, meta, publish); err != nil {
+				return err
+			}
+			applied, pages = num, pages[:0]
+			if publish {
+				base.pending = false
+			}
+		case replTagHeartbeat:
+			db.announce(num)
+		default:
+			return fmt.Errorf("%w: bad record tag %q", ErrBadReplication, tag[0])
+		}
+	}
+}
+
+// records what the primary said it has
+func (db *KV) announce(version uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.repl.status.Primary = max(db.repl.status.Primary, version)
+	db.repl.status.Contact = db.clock()
+}
+
+// waits until the snapshots pinned by readers are released, called with the lock held
+// the snapshots pinned meanwhile wait for the caller to unlock
+func (db *KV) drainPins() {
+	db.repl.applying = true
+	for db.pins > 0 {
+		db.repl.cond.Wait()
+	}
+	db.repl.applying = false
+	db.repl.cond.Broadcast()
+}
+
+// drops the database to empty before a base copy overwrites its file
+// the meta page is invalidated first, so a crash in the middle of the copy leaves a file
+// Open treats as empty instead of a mix of two versions
+func (db *KV) startBase(version uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.drainPins()
+	if _, err := db.store.WriteAt(make([]byte, META_SIZE), 0); err != nil {
+		return fmt.Errorf("base copy: %w", err)
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.tree.root, db.ttl.root, db.catalog.root = 0, 0, 0
+	db.version = 0
+	clear(db.page.updates) // the free list node of the empty file Open made up
+	db.repl.status.Bases++
+	db.repl.status.Primary = max(db.repl.status.Primary, version)
+	return nil
+}
+
+// writes pages of the base copy, nothing reads them until the copy is complete
+func (db *KV) applyPages(pages []replPage) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return writeReplPages(db, pages)
+}
+
+func writeReplPages(db *KV, pages []replPage) error {
+	for _, page := range pages {
+		if db.cache != nil {
+			db.cache.drop(page.ptr)
+		}
+		if _, err := db.store.WriteAt(page.data, int64(page.ptr*BTREE_PAGE_SIZE)); err != nil {
+			return err
+		}
+		db.written.pages++
+	}
+	return nil
+}
+
+// writes the pages of a commit of the primary and, if publish is set, its meta page
+// the readers see the commit once its meta page is durable
+func (db *KV) applyCommit(pages []replPage, meta []byte, publish bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// the primary may reuse pages that were still reachable from the snapshots of the readers
+	db.drainPins()
+	if err := writeReplPages(db, pages); err != nil {
+		return err
+	}
+	if !publish {
+		return nil
+	}
+
+	if version := binary.LittleEndian.Uint64(meta[64:72]); string(meta[:len(DB_SIG)]) != DB_SIG || version > FORMAT_VERSION {
+		return fmt.Errorf("%w: meta page of format version %d", ErrBadReplication, version)
+	}
+	if err := openCipher(db, meta); err != nil {
+		return err
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	if _, err := db.store.WriteAt(meta, 0); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.written.pages++
+	db.written.commits++
+
+	loadMeta(db, meta)
+	if db.cache == nil {
+		if err := extendMap(db, int(db.page.flushed*BTREE_PAGE_SIZE)); err != nil {
+			return err
+		}
+	}
+	pinRoots(db)
+	return nil
+}
+
+// ReplicaStatus reports how far a follower is behind its primary
+func (db *KV) ReplicaStatus() ReplicaStatus {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	status := db.repl.status
+	status.Applied = db.version
+	if status.Primary > status.Applied {
+		status.Lag = status.Primary - status.Applied
+	}
+	return status
+}
+
+// the file starts with a valid meta page
+func hasMeta(db *KV) bool {
+	data, err := readMetaPage(db)
+	return err == nil && string(data[:len(DB_SIG)]) == DB_SIG
+}
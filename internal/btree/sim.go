@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+)
+
+// SimStorage is a Storage in memory that behaves like a disk with a volatile write cache
+// writes are seen by reads right away but they are only durable after Sync
+// Crash returns what a power loss would leave behind, Fault makes any write or sync fail
+// it's meant for crash tests, it can't be mapped so KV reads it through the page cache
+type SimStorage struct {
+	// called before every write and sync, an error fails the operation without applying it
+	Fault func(op SimOp) error
+	// writes are atomic in blocks of this many bytes, SIM_SECTOR if it's 0
+	Sector int
+
+	mu      sync.Mutex
+	data    []byte     // what reads see
+	durable []byte     // the content at the last Sync
+	pending []simWrite // the writes since the last Sync, in order
+	ops     int
+}
+
+// a torn write keeps some of its sectors, each of them is written or not
+const SIM_SECTOR = 512
+
+// a write or sync of a SimStorage
+type SimOp struct {
+	Kind string // "write" or "sync"
+	N    int    // number of operations before this one
+	Off  int64
+	Len  int
+}
+
+type simWrite struct {
+	off  int64
+	data []byte
+}
+
+// NewSimStorage returns a storage holding image, which is durable
+func NewSimStorage(image []byte) *SimStorage {
+	return &SimStorage{data: bytes.Clone(image), durable: bytes.Clone(image)}
+}
+
+// Bytes returns what reads see, it's the file after a clean shutdown
+func (s *SimStorage) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.data)
+}
+
+// Crash returns the file after a power loss, each write since the last Sync is lost,
+// kept or torn at a sector boundary as rng decides
+func (s *SimStorage) Crash(rng *rand.Rand) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := s.Sector
+	if size == 0 {
+		size = SIM_SECTOR
+	}
+	image := bytes.Clone(s.durable)
+	for _, w := range s.pending {
+		mode := rng.Intn(3)
+		if mode == 0 {
+			continue
+		}
+		for sector := 0; sector < len(w.data); sector += size {
+			if mode == 2 && rng.Intn(2) == 0 {
+				continue
+			}
+			data := w.data[sector:min(sector+size, len(w.data))]
+			image = writeAt(image, data, w.off+int64(sector))
+		}
+	}
+	return image
+}
+
+// copies data to buf at off, growing it if needed
+func writeAt(buf, data []byte, off int64) []byte {
+	if end := int(off) + len(data); end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[off:], data)
+	return buf
+}
+
+// counts the operation and asks Fault about it
+func (s *SimStorage) check(kind string, off int64, n int) error {
+	s.mu.Lock()
+	op := SimOp{Kind: kind, N: s.ops, Off: off, Len: n}
+	s.ops++
+	fault := s.Fault
+	s.mu.Unlock()
+
+	if fault == nil {
+		return nil
+	}
+	return fault(op)
+}
+
+func (s *SimStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *SimStorage) WriteAt(p []byte, off int64) (int, error) {
+	if err := s.check("write", off, len(p)); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = writeAt(s.data, p, off)
+	s.pending = append(s.pending, simWrite{off: off, data: bytes.Clone(p)})
+	return len(p), nil
+}
+
+// every buffer is a write of its own, they can be lost separately
+func (s *SimStorage) WritevAt(bufs [][]byte, off int64) (int, error) {
+	total := 0
+	for _, buf := range bufs {
+		n, err := s.WriteAt(buf, off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *SimStorage) Sync() error {
+	if err := s.check("sync", 0, 0); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.pending {
+		s.durable = writeAt(s.durable, w.data, w.off)
+	}
+	s.pending = nil
+	return nil
+}
+
+func (s *SimStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *SimStorage) Mmap(off int64, length int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (s *SimStorage) Munmap(data []byte) error {
+	return nil
+}
+
+// a SimStorage belongs to a single KV
+func (s *SimStorage) Lock(shared bool) error {
+	return nil
+}
+
+func (s *SimStorage) Close() error {
+	return nil
+}
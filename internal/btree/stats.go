@@ -0,0 +1,144 @@
+package btree
+
+import "encoding/binary"
+
+// Stats describes the shape of the tree and the use of the file
+// fill factors are the fraction of the page used by a node, they and LiveBytes cover every tree:
+// the main tree, the expiry index, the bucket catalog and the buckets
+// the depth, the pages, the keys and the values are the ones of the main tree unless their name says otherwise
+// there are no bytes in overflow to report: keys and values are limited to BTREE_MAX_KEY_SIZE
+// and BTREE_MAX_VAL_SIZE so that every entry fits in its leaf, the file has no overflow pages
+type Stats struct {
+	Depth         int // levels of the tree, 0 when empty
+	LeafPages     int
+	InternalPages int
+	Keys          int
+	AvgFill       float64
+	MinFill       float64
+	MaxFill       float64
+	TotalPages    uint64 // pages in the file including the meta page
+	FreePages     uint64 // pages waiting in the free list
+	FreeListNodes uint64 // pages holding the free list itself
+	FileSize      int64
+	LiveBytes     int64 // bytes used by the nodes reachable from the roots
+	IndexPages    int   // pages of the expiry index
+	BucketPages   int   // pages of the bucket catalog and of the buckets
+	Buckets       int
+	BucketKeys    int
+	// values as stored and as returned by Get, the ratio is raw/stored (1 without compression)
+	CompressedValues int
+	ValueBytes       int64
+	RawValueBytes    int64
+	CompressionRatio float64
+	// reads of the page cache (KV.CachePages) since Open, taken before the walk of the tree
+	CacheHits    uint64
+	CacheMisses  uint64
+	CacheHitRate float64
+	// commits, pages written (meta page included) and fsyncs since Open
+	Commits      uint64
+	PagesWritten uint64
+	Syncs        uint64
+	Version      uint64 // commit version in the meta page
+}
+
+// Stats walks a snapshot of the trees, writers are not blocked
+func (db *KV) Stats() (_ Stats, err error) {
+	stats := Stats{}
+
+	db.mu.RLock()
+	stats.TotalPages = db.page.flushed
+	stats.FreePages = db.free.tailSeq - db.free.headSeq
+	stats.FreeListNodes = db.free.tailSeq/db.free.nodeCap - db.free.headSeq/db.free.nodeCap + 1
+	stats.FileSize, err = db.store.Size()
+	stats.Commits, stats.PagesWritten, stats.Syncs = db.written.commits, db.written.pages, db.written.syncs
+	stats.Version = db.version
+	db.mu.RUnlock()
+	if err != nil {
+		return stats, err
+	}
+	if db.cache != nil {
+		stats.CacheHits, stats.CacheMisses = db.cache.stats()
+		if reads := stats.CacheHits + stats.CacheMisses; reads > 0 {
+			stats.CacheHitRate = float64(stats.CacheHits) / float64(reads)
+		}
+	}
+
+	snap, release := db.pin()
+	defer release()
+	defer recoverCorrupt(&err, nil)
+
+	stats.MinFill = 1
+	pages := 0
+	// leaf is called for every leaf of the tree
+	var walk func(ptr uint64, depth int, leaf func(node BNode, depth int))
+	walk = func(ptr uint64, depth int, leaf func(node BNode, depth int)) {
+		if ptr == 0 {
+			return
+		}
+		node := BNode(snap.tree.get(ptr))
+		fill := float64(node.nBytes()) / BTREE_PAGE_SIZE
+		stats.AvgFill += fill
+		stats.MinFill = min(stats.MinFill, fill)
+		stats.MaxFill = max(stats.MaxFill, fill)
+		stats.LiveBytes += int64(node.nBytes())
+		pages++
+
+		if node.bType() == BNODE_LEAF {
+			leaf(node, depth)
+			return
+		}
+		for i := uint16(0); i < node.nKeys(); i++ {
+			walk(node.getPtr(i), depth+1, leaf)
+		}
+	}
+
+	walk(snap.tree.root, 1, func(node BNode, depth int) {
+		stats.Depth = max(stats.Depth, depth)
+		stats.LeafPages++
+		stats.Keys += int(node.nKeys())
+		for i := uint16(0); i < node.nKeys(); i++ {
+			val, flags := node.getVal(i), node.getValFlags(i)
+			if flags&VAL_COMPRESSED != 0 {
+				stats.CompressedValues++
+			}
+			stats.ValueBytes += int64(len(val))
+			stats.RawValueBytes += int64(rawValSize(val, flags))
+		}
+	})
+	stats.InternalPages = pages - stats.LeafPages
+
+	walk(snap.ttl.root, 1, func(BNode, int) {})
+	stats.IndexPages = pages - stats.LeafPages - stats.InternalPages
+
+	bucketKeys := func(node BNode, _ int) {
+		stats.BucketKeys += int(node.nKeys())
+	}
+	walk(snap.catalog.root, 1, func(node BNode, _ int) {
+		for i := uint16(0); i < node.nKeys(); i++ {
+			val := node.getVal(i)
+			if len(val) != 8 {
+				continue // dummy key
+			}
+			stats.Buckets++
+			if root := binary.LittleEndian.Uint64(val); root != 0 {
+				stats.BucketKeys-- // dummy key of the bucket
+				walk(root, 1, bucketKeys)
+			}
+		}
+	})
+	stats.BucketPages = pages - stats.LeafPages - stats.InternalPages - stats.IndexPages
+
+	if stats.LeafPages > 0 {
+		stats.Keys-- // dummy key
+	}
+	if pages > 0 {
+		stats.AvgFill /= float64(pages)
+	} else {
+		stats.MinFill = 0
+	}
+	stats.CompressionRatio = 1
+	if stats.ValueBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawValueBytes) / float64(stats.ValueBytes)
+	}
+	return stats, nil
+}
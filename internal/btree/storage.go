@@ -0,0 +1,125 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Storage is the file under a KV, every read and write of the database goes through it
+// the methods behave like the syscalls they are named after
+// a write is only durable after Sync returns, KV orders its writes with it so a crash
+// at any point leaves the database at its last commit or at the one being written
+type Storage interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	// writes the buffers one after another starting at off
+	WritevAt(bufs [][]byte, off int64) (int, error)
+	Sync() error
+	Size() (int64, error)
+	// maps length bytes from off read-only, the mapping sees the writes that come after it
+	// storages that can't be mapped return errors.ErrUnsupported and KV reads them through its page cache
+	Mmap(off int64, length int) ([]byte, error)
+	Munmap(data []byte) error
+	// takes the lock of the database without waiting, returns ErrLocked if it's held
+	Lock(shared bool) error
+	Close() error
+}
+
+// pages kept by the page cache of a storage that can't be mapped when KV.CachePages is not set
+const DEFAULT_CACHE_PAGES = 1024
+
+// the file at a path, the lock is a flock
+type fileStorage struct {
+	fd int
+}
+
+// opens the database file, a read-only file must exist and the directory is not synced
+func openFile(file string, readOnly bool) (*fileStorage, error) {
+	if !readOnly {
+		fd, err := createFileSync(file)
+		if err != nil {
+			return nil, err
+		}
+		return &fileStorage{fd: fd}, nil
+	}
+	fd, err := syscall.Open(file, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	return &fileStorage{fd: fd}, nil
+}
+
+func (f *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return syscall.Pread(f.fd, p, off)
+}
+
+func (f *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return syscall.Pwrite(f.fd, p, off)
+}
+
+// pwritev takes at most IOV_MAX buffers at once
+func (f *fileStorage) WritevAt(bufs [][]byte, off int64) (int, error) {
+	total := 0
+	for len(bufs) > 0 {
+		n := min(len(bufs), IOV_MAX)
+		written, err := unix.Pwritev(f.fd, bufs[:n], off+int64(total))
+		total += written
+		if err != nil {
+			return total, err
+		}
+		bufs = bufs[n:]
+	}
+	return total, nil
+}
+
+func (f *fileStorage) Sync() error {
+	return syscall.Fsync(f.fd)
+}
+
+func (f *fileStorage) Size() (int64, error) {
+	stat := &syscall.Stat_t{}
+	if err := syscall.Fstat(f.fd, stat); err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	return stat.Size, nil
+}
+
+func (f *fileStorage) Mmap(off int64, length int) ([]byte, error) {
+	return syscall.Mmap(f.fd, off, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func (f *fileStorage) Munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+func (f *fileStorage) Lock(shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	for {
+		err := syscall.Flock(f.fd, how|syscall.LOCK_NB)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EWOULDBLOCK:
+			return ErrLocked
+		case err != nil:
+			return fmt.Errorf("flock: %w", err)
+		}
+		return nil
+	}
+}
+
+func (f *fileStorage) Close() error {
+	return syscall.Close(f.fd)
+}
+
+// the storage can't be mapped
+func isUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported)
+}
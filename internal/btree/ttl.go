@@ -0,0 +1,174 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// values with a time to live are stored as
+// | expiry | value |
+// | 8B     | ...   |
+// with VAL_TTL set, the expiry is in unix nanoseconds and the value may be compressed
+//
+// the expiry index (db.ttl) has a key per expiring value, so the sweeper only reads what has expired
+// entries left behind by an overwrite or a delete are dropped by the sweeper
+
+const (
+	TTL_SWEEP_INTERVAL = time.Second
+	TTL_SWEEP_BATCH    = 1000 // keys deleted per commit
+)
+
+// SetWithTTL sets key to val until ttl has elapsed, after that Get and Scan don't see it
+// and the sweeper deletes it
+func (db *KV) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.SetWithTTL(key, val, ttl)
+	})
+}
+
+// like KV.SetWithTTL, inside a transaction
+func (tx *Tx) SetWithTTL(key, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+
+	tx.setExpiring(key, val, tx.db.clock().Add(ttl).UnixNano())
+	return nil
+}
+
+// sets key to val until expiry (unix nanoseconds), the caller has checked them
+func (tx *Tx) setExpiring(key, val []byte, expiry int64) {
+	tx.db.watch.recordSet(tx.db, key, val)
+	val, flags := tx.db.encodeVal(val)
+	stored := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(val)), uint64(expiry))
+	tx.db.tree.InsertFlags(key, append(stored, val...), flags|VAL_TTL)
+	tx.db.ttl.Insert(ttlKey(expiry, key), nil)
+}
+
+// TTL returns the time key has left, 0 if it doesn't expire, false if it doesn't exist
+func (db *KV) TTL(key []byte) (time.Duration, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return (&Tx{db: db}).TTL(key)
+}
+
+// like KV.TTL, inside a transaction
+func (tx *Tx) TTL(key []byte) (time.Duration, bool) {
+	val, flags, ok := tx.db.tree.GetFlags(key)
+	now := tx.db.clock()
+	if !ok || len(key) == 0 || isExpired(val, flags, now) {
+		return 0, false
+	}
+	if expiry := valExpiry(val, flags); expiry != 0 {
+		return time.Duration(expiry - now.UnixNano()), true
+	}
+	return 0, true
+}
+
+// the key of the expiry index, sorted by time
+func ttlKey(expiry int64, key []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(expiry)), key...)
+}
+
+// expiry time of a stored value in unix nanoseconds, 0 if it doesn't expire
+func valExpiry(val []byte, flags uint16) int64 {
+	if flags&VAL_TTL == 0 || len(val) < 8 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(val))
+}
+
+func isExpired(val []byte, flags uint16, now time.Time) bool {
+	expiry := valExpiry(val, flags)
+	return expiry != 0 && expiry <= now.UnixNano()
+}
+
+// SweepExpired deletes up to TTL_SWEEP_BATCH expired keys in one commit
+// returns how many entries of the expiry index were processed, less than TTL_SWEEP_BATCH when it's done
+func (db *KV) SweepExpired() (n int, err error) {
+	if db.readOnly() {
+		return 0, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.ttl.root == 0 {
+		return 0, nil
+	}
+
+	meta := saveMeta(db)
+	defer recoverCorrupt(&err, func() { revert(db, meta) })
+
+	now := db.clock().UnixNano()
+	due := [][]byte{}
+	for iter := db.ttl.Seek(nil); iter.Valid() && len(due) < TTL_SWEEP_BATCH; iter.Next() {
+		ikey, _ := iter.Deref()
+		if len(ikey) == 0 {
+			continue // dummy key
+		}
+		if int64(binary.BigEndian.Uint64(ikey)) > now {
+			break
+		}
+		due = append(due, ikey)
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
+
+	for _, ikey := range due {
+		expiry, key := int64(binary.BigEndian.Uint64(ikey)), ikey[8:]
+		// the key may have been set again since
+		if val, flags, ok := db.tree.GetFlags(key); ok && valExpiry(val, flags) == expiry {
+			db.watch.recordExpired(db, key, val, flags)
+			db.tree.Delete(key)
+		}
+		db.ttl.Delete(ikey)
+	}
+
+	return len(due), updateOrRevert(db, meta)
+}
+
+// runs SweepExpired every db.SweepInterval until Close
+func (db *KV) startSweeper() {
+	interval := db.SweepInterval
+	if interval == 0 {
+		interval = TTL_SWEEP_INTERVAL
+	}
+	if interval < 0 || db.readOnly() {
+		return
+	}
+
+	db.sweep.stop = make(chan struct{})
+	db.sweep.done = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			// a full batch means there's more to delete
+			for {
+				n, err := db.SweepExpired()
+				if err != nil || n < TTL_SWEEP_BATCH {
+					break
+				}
+			}
+		}
+	}(db.sweep.stop, db.sweep.done)
+}
+
+func (db *KV) stopSweeper() {
+	if db.sweep.stop == nil {
+		return
+	}
+	close(db.sweep.stop)
+	<-db.sweep.done
+	db.sweep.stop = nil
+}
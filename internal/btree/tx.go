@@ -0,0 +1,107 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyKey    = errors.New("empty key")
+	ErrKeyTooLarge = errors.New("key too large")
+	ErrValTooLarge = errors.New("value too large")
+)
+
+// Tx groups several updates into a single commit
+// it's only valid inside the function passed to KV.Update
+type Tx struct {
+	db *KV
+}
+
+// Update runs fn with the write lock held and commits everything it did at once
+// if fn returns an error nothing is written and the tree goes back to the last commit
+func (db *KV) Update(fn func(tx *Tx) error) (err error) {
+	if db.readOnly() {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	meta := saveMeta(db)
+	defer recoverCorrupt(&err, func() { revert(db, meta) })
+	if err := fn(&Tx{db: db}); err != nil {
+		revert(db, meta)
+		return err
+	}
+
+	return updateOrRevert(db, meta)
+}
+
+// gets the value for key, the updates of this transaction are visible
+// the value points into a page of the tree, it's only valid inside the transaction
+func (tx *Tx) Get(key []byte) ([]byte, bool) {
+	val, flags, ok := tx.db.tree.GetFlags(key)
+	if !ok || len(key) == 0 || isExpired(val, flags, tx.db.clock()) {
+		return nil, false
+	}
+	return mustDecodeVal(key, val, flags), true
+}
+
+// calls fn for every key in [start, end) like KV.Scan, the updates of this transaction are visible
+// fn must not update the transaction
+func (tx *Tx) Scan(start, end []byte, fn func(key, val []byte) bool) {
+	now := tx.db.clock()
+	for iter := tx.db.tree.Seek(start); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return
+		}
+		if len(key) == 0 || isExpired(val, iter.Flags(), now) {
+			continue // dummy key
+		}
+		if !fn(key, mustDecodeVal(key, val, iter.Flags())) {
+			return
+		}
+	}
+}
+
+// inserts or updates key
+func (tx *Tx) Set(key, val []byte) error {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	tx.db.watch.recordSet(tx.db, key, val)
+	val, flags := tx.db.encodeVal(val)
+	tx.db.tree.InsertFlags(key, val, flags)
+	return nil
+}
+
+// deletes key, returns true if it existed
+func (tx *Tx) Del(key []byte) bool {
+	if len(key) == 0 {
+		return false // the dummy key stays
+	}
+	tx.db.watch.recordDel(tx.db, key)
+	return tx.db.tree.Delete(key)
+}
+
+// deletes the keys in [start, end), returns true if there was any
+func (tx *Tx) DeleteRange(start, end []byte) bool {
+	tx.db.watch.recordRange(tx.db, start, end)
+	return tx.db.tree.DeleteRange(start, end)
+}
+
+// the tree panics on entries that can't fit in a node
+// and the empty key is its dummy key
+func checkKV(key, val []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+	if len(val) > BTREE_MAX_VAL_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrValTooLarge, len(val))
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// With KV.WatchLog set, every update of the main tree is recorded with the value it replaces
+// while the transaction runs, and the changes of a commit are added to an in-memory log once
+// updateFile made it durable, a failed commit drops them with the rest of its updates
+// every Watcher reads the log at its own pace, so commits never wait for watchers, a watcher
+// that falls behind the log ends with ErrWatchBehind
+//
+// the keys of buckets are not watched, and a follower has no changes to watch
+
+// the log doesn't have the changes after the version a watcher asked for
+var ErrWatchBehind = errors.New("watch: changes are no longer in the log")
+
+// Change is an update of a key made by a commit
+type Change struct {
+	Key     []byte
+	Old     []byte // nil if the key didn't exist, the expired value for the deletes of the sweeper
+	New     []byte // nil if the key was deleted
+	Version uint64 // commit version of the update
+}
+
+// the changes of a commit
+type watchCommit struct {
+	version uint64
+	changes []Change
+}
+
+type watchState struct {
+	pending []Change       // recorded by the transaction in progress
+	log     []*watchCommit // the last KV.WatchLog commits that changed keys, oldest first
+	since   uint64         // the log has every change of the commits after this version
+	notify  chan struct{}  // closed and replaced by every commit
+	closed  chan struct{}  // closed by Close
+}
+
+func (w *watchState) init(db *KV) {
+	w.pending, w.log = nil, nil
+	w.since = db.version
+	w.notify = make(chan struct{})
+	w.closed = make(chan struct{})
+}
+
+// wakes the watchers, called by Close
+func (w *watchState) close(db *KV) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if w.closed != nil {
+		close(w.closed)
+		w.closed = nil
+	}
+}
+
+// records that key is going to be set to val, val is the value as the caller gave it
+// called with the lock held before the tree is updated
+func (w *watchState) recordSet(db *KV, key, val []byte) {
+	if db.WatchLog <= 0 || db.Follower {
+		return
+	}
+	old, _ := (&Tx{db: db}).Get(key)
+	// an empty value is not a delete
+	w.pending = append(w.pending, Change{Key: bytes.Clone(key), Old: bytes.Clone(old), New: append([]byte{}, val...)})
+}
+
+// records that key is going to be deleted, nothing if it doesn't exist
+func (w *watchState) recordDel(db *KV, key []byte) {
+	if db.WatchLog <= 0 || db.Follower {
+		return
+	}
+	if old, ok := (&Tx{db: db}).Get(key); ok {
+		w.pending = append(w.pending, Change{Key: bytes.Clone(key), Old: bytes.Clone(old)})
+	}
+}
+
+// records the delete of an expired key by the sweeper
+func (w *watchState) recordExpired(db *KV, key, stored []byte, flags uint16) {
+	if db.WatchLog <= 0 {
+		return
+	}
+	old := mustDecodeVal(key, stored, flags)
+	w.pending = append(w.pending, Change{Key: bytes.Clone(key), Old: bytes.Clone(old)})
+}
+
+// records the deletes of the keys in [start, end)
+func (w *watchState) recordRange(db *KV, start, end []byte) {
+	if db.WatchLog <= 0 || db.Follower {
+		return
+	}
+	now := db.clock()
+	for iter := db.tree.Seek(start); iter.Valid(); iter.Next() {
+		key, stored := iter.Deref()
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if len(key) == 0 || isExpired(stored, iter.Flags(), now) {
+			continue
+		}
+		old := mustDecodeVal(key, stored, iter.Flags())
+		w.pending = append(w.pending, Change{Key: bytes.Clone(key), Old: bytes.Clone(old)})
+	}
+}
+
+// the transaction was reverted
+func (w *watchState) abort() {
+	w.pending = w.pending[:0]
+}
+
+// adds the changes of the commit updateFile just made durable to the log, called with the lock held
+func (w *watchState) commit(db *KV) {
+	if len(w.pending) == 0 {
+		return
+	}
+	changes := make([]Change, len(w.pending))
+	for i, change := range w.pending {
+		change.Version = db.version
+		changes[i] = change
+	}
+	w.pending = w.pending[:0]
+
+	// the old entries are dropped by reslicing, watchers may still be reading them
+	w.log = append(w.log, &watchCommit{db.version, changes})
+	if len(w.log) > db.WatchLog {
+		drop := len(w.log) - db.WatchLog
+		w.since = w.log[drop-1].version
+		w.log = w.log[drop:]
+	}
+	close(w.notify)
+	w.notify = make(chan struct{})
+}
+
+// the commits that changed keys after version from, false if the log doesn't have all of them
+func (w *watchState) after(from uint64) ([]*watchCommit, bool) {
+	if from < w.since {
+		return nil, false
+	}
+	i := 0
+	for i < len(w.log) && w.log[i].version <= from {
+		i++
+	}
+	return w.log[i:], true
+}
+
+// Watcher delivers the changes of the keys in a range in commit order
+type Watcher struct {
+	// C is closed when the watcher ends, Err tells why
+	C <-chan Change
+
+	db         *KV
+	start, end []byte
+	c          chan Change
+	stop       chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mu      sync.Mutex
+	version uint64
+	err     error
+}
+
+// Watch returns a Watcher of the keys in [start, end), a nil end means no upper bound
+// it delivers the changes of the commits after version from, or after the last commit if from is 0
+// the log kept with KV.WatchLog must still have them, or Watch returns ErrWatchBehind
+// and the caller has to read the keys again and watch from the version it read
+func (db *KV) Watch(start, end []byte, from uint64) (*Watcher, error) {
+	if db.WatchLog <= 0 || db.Follower {
+		return nil, fmt.Errorf("watch: KV.WatchLog is not set")
+	}
+	db.mu.RLock()
+	if from == 0 {
+		from = db.version
+	}
+	_, ok := db.watch.after(from)
+	version := db.version
+	db.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: version %d", ErrWatchBehind, from)
+	}
+	if from > version {
+		return nil, fmt.Errorf("watch: version %d is after the last commit %d", from, version)
+	}
+
+	// unbuffered, so Version only counts the changes the reader took
+	c := make(chan Change)
+	w := &Watcher{
+		C:       c,
+		db:      db,
+		start:   bytes.Clone(start),
+		end:     bytes.Clone(end),
+		c:       c,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		version: from,
+	}
+	go w.run()
+	return w, nil
+}
+
+// WatchPrefix is Watch of the keys starting with prefix
+func (db *KV) WatchPrefix(prefix []byte, from uint64) (*Watcher, error) {
+	return db.Watch(prefix, PrefixEnd(prefix), from)
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	defer close(w.c)
+	db := w.db
+	from := w.Version()
+	for {
+		db.mu.RLock()
+		commits, ok := db.watch.after(from)
+		version, notify, closed := db.version, db.watch.notify, db.watch.closed
+		db.mu.RUnlock()
+		if closed == nil {
+			return
+		}
+		if !ok {
+			w.fail(fmt.Errorf("%w: version %d", ErrWatchBehind, from))
+			return
+		}
+
+		for _, commit := range commits {
+			for _, change := range commit.changes {
+				if bytes.Compare(change.Key, w.start) < 0 || w.end != nil && bytes.Compare(change.Key, w.end) >= 0 {
+					continue
+				}
+				select {
+				case w.c <- change:
+				case <-w.stop:
+					return
+				}
+			}
+			w.setVersion(commit.version)
+		}
+		// the commits up to version that are not in the log changed nothing
+		from = version
+		w.setVersion(version)
+
+		select {
+		case <-notify:
+		case <-closed:
+			return
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *Watcher) setVersion(version uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.version = max(w.version, version)
+}
+
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
+
+// Version is the last commit whose changes were all read from C, Watch can resume from it
+// the changes of a commit that was read in part come again
+func (w *Watcher) Version() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.version
+}
+
+// Err is why C was closed, nil after Close or the Close of the database
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher and closes C
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
@@ -0,0 +1,365 @@
+// Package httpapi serves a KV over HTTP with JSON bodies, for tools and dashboards
+package httpapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+// the endpoints
+//
+//	GET    /kv/{key}    the value and the remaining ttl of a key
+//	PUT    /kv/{key}    {"value": ..., "ttl_ms": ...}
+//	DELETE /kv/{key}    deletes the key
+//	GET    /kv          scan, query start, end or prefix, limit and cursor, the cursor of the next page is in the reply
+//	POST   /batch       {"ops": [...]} put, delete and delete_range in a single commit
+//	POST   /tx          {"ops": [...]} like batch with get and check, a failed check rolls back the transaction
+//	GET    /stats       KV.Stats
+//	GET    /check       KV.Check
+//
+// keys and values are binary, in JSON bodies they are standard base64 (what encoding/json does with []byte)
+// and in paths and queries they are unpadded URL-safe base64
+// errors are {"error": message} with a 4xx or 5xx status
+
+const (
+	MAX_BODY          = 64 << 20
+	DEFAULT_SCAN_SIZE = 100
+	MAX_SCAN_SIZE     = 10000
+	// larger ttl_ms overflow a time.Duration
+	MAX_TTL_MS = math.MaxInt64 / int64(time.Millisecond)
+)
+
+type api struct {
+	db *btree.KV
+}
+
+// NewHandler returns the handler of the endpoints above, the caller owns db and closes it
+// after shutting down the server
+func NewHandler(db *btree.KV) http.Handler {
+	a := &api{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key}", a.get)
+	mux.HandleFunc("PUT /kv/{key}", a.put)
+	mux.HandleFunc("DELETE /kv/{key}", a.del)
+	mux.HandleFunc("GET /kv", a.scan)
+	mux.HandleFunc("POST /batch", a.batch)
+	mux.HandleFunc("POST /tx", a.tx)
+	mux.HandleFunc("GET /stats", a.stats)
+	mux.HandleFunc("GET /check", a.check)
+	return mux
+}
+
+// an error with its status code
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...any) error {
+	return &httpError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var herr *httpError
+	switch {
+	case errors.As(err, &herr):
+		code = herr.code
+	case errors.Is(err, btree.ErrEmptyKey), errors.Is(err, btree.ErrKeyTooLarge), errors.Is(err, btree.ErrValTooLarge):
+		code = http.StatusBadRequest
+	case errors.Is(err, btree.ErrReadOnly):
+		code = http.StatusForbidden
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// a key or a bound in a path or a query, padding is accepted
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, badRequest("bad base64 key %q: %v", s, err)
+	}
+	return key, nil
+}
+
+func encodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// decodes a JSON body, unknown fields are rejected so typos don't go unnoticed
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BODY))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &httpError{http.StatusRequestEntityTooLarge, err.Error()}
+		}
+		return badRequest("bad body: %v", err)
+	}
+	return nil
+}
+
+type entry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	TTLMs int64  `json:"ttl_ms,omitempty"` // remaining time to live, absent when the key doesn't expire
+}
+
+func (a *api) get(w http.ResponseWriter, r *http.Request) {
+	key, err := decodeKey(r.PathValue("key"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	val, ok := a.db.Get(key)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+		return
+	}
+	// KV.Get copies the value under the read lock, a later commit can reuse its pages
+	e := entry{Key: key, Value: val}
+	if ttl, ok := a.db.TTL(key); ok {
+		e.TTLMs = ttl.Milliseconds()
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+type putBody struct {
+	Value []byte `json:"value"`
+	TTLMs int64  `json:"ttl_ms"`
+}
+
+func (a *api) put(w http.ResponseWriter, r *http.Request) {
+	key, err := decodeKey(r.PathValue("key"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	body := putBody{}
+	if err := readJSON(w, r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+	if body.TTLMs < 0 {
+		writeError(w, badRequest("negative ttl_ms"))
+		return
+	}
+	if body.TTLMs > MAX_TTL_MS {
+		writeError(w, badRequest("ttl_ms larger than %d", MAX_TTL_MS))
+		return
+	}
+	if body.TTLMs > 0 {
+		err = a.db.SetWithTTL(key, body.Value, time.Duration(body.TTLMs)*time.Millisecond)
+	} else {
+		err = a.db.Set(key, body.Value)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) del(w http.ResponseWriter, r *http.Request) {
+	key, err := decodeKey(r.PathValue("key"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	deleted, err := a.db.Del(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"deleted": deleted})
+}
+
+type scanReply struct {
+	Items  []entry `json:"items"`
+	Cursor string  `json:"cursor,omitempty"` // where the next page starts, absent after the last page
+}
+
+// the cursor is the key the next page starts from, so pages stay consistent with the keys
+// even though each one reads a different snapshot
+func (a *api) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var start, end []byte
+	var err error
+	bound := func(name string) []byte {
+		if err != nil || !query.Has(name) {
+			return nil
+		}
+		var key []byte
+		key, err = decodeKey(query.Get(name))
+		return key
+	}
+	start, end = bound("start"), bound("end")
+	if prefix := bound("prefix"); prefix != nil {
+		if start != nil || end != nil {
+			err = badRequest("prefix can't be combined with start or end")
+		}
+		start, end = prefix, btree.PrefixEnd(prefix)
+	}
+	if cursor := bound("cursor"); cursor != nil {
+		start = cursor
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	limit := DEFAULT_SCAN_SIZE
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > MAX_SCAN_SIZE {
+			writeError(w, badRequest("limit must be between 1 and %d", MAX_SCAN_SIZE))
+			return
+		}
+	}
+
+	reply := scanReply{Items: []entry{}}
+	a.db.Scan(start, end, func(key, val []byte) bool {
+		if len(reply.Items) == limit {
+			reply.Cursor = encodeKey(key)
+			return false
+		}
+		reply.Items = append(reply.Items, entry{Key: bytes.Clone(key), Value: bytes.Clone(val)})
+		return true
+	})
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// an operation of a batch or a transaction
+type op struct {
+	Op    string `json:"op"` // get, put, delete, delete_range or check
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	TTLMs int64  `json:"ttl_ms,omitempty"`
+	// bounds of delete_range, a missing end means no upper bound
+	Start []byte `json:"start,omitempty"`
+	End   []byte `json:"end,omitempty"`
+	// check succeeds when the key has the value, or when it doesn't exist with absent
+	Absent bool `json:"absent,omitempty"`
+}
+
+type opsBody struct {
+	Ops []op `json:"ops"`
+}
+
+// the result of an operation, get sets Found and Value, delete and delete_range set Deleted
+type result struct {
+	Found   *bool  `json:"found,omitempty"`
+	Value   []byte `json:"value,omitempty"`
+	Deleted *bool  `json:"deleted,omitempty"`
+}
+
+func (a *api) batch(w http.ResponseWriter, r *http.Request) {
+	a.runOps(w, r, false)
+}
+
+func (a *api) tx(w http.ResponseWriter, r *http.Request) {
+	a.runOps(w, r, true)
+}
+
+// runs the operations of the body in a single KV.Update, nothing is committed if one fails
+func (a *api) runOps(w http.ResponseWriter, r *http.Request, reads bool) {
+	body := opsBody{}
+	if err := readJSON(w, r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	results := []result{}
+	err := a.db.Update(func(tx *btree.Tx) error {
+		results = results[:0]
+		for i, op := range body.Ops {
+			if (op.Op == "get" || op.Op == "check") && !reads {
+				return badRequest("op %d: %s is only allowed in /tx", i, op.Op)
+			}
+			res, err := runOp(tx, op)
+			if err != nil {
+				return fmt.Errorf("op %d: %w", i, err)
+			}
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !reads {
+		writeJSON(w, http.StatusOK, map[string]int{"applied": len(results)})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]result{"results": results})
+}
+
+func runOp(tx *btree.Tx, op op) (result, error) {
+	switch op.Op {
+	case "get":
+		val, ok := tx.Get(op.Key)
+		return result{Found: &ok, Value: bytes.Clone(val)}, nil
+	case "put":
+		if op.TTLMs < 0 {
+			return result{}, badRequest("negative ttl_ms")
+		}
+		if op.TTLMs > MAX_TTL_MS {
+			return result{}, badRequest("ttl_ms larger than %d", MAX_TTL_MS)
+		}
+		if op.TTLMs > 0 {
+			return result{}, tx.SetWithTTL(op.Key, op.Value, time.Duration(op.TTLMs)*time.Millisecond)
+		}
+		return result{}, tx.Set(op.Key, op.Value)
+	case "delete":
+		deleted := tx.Del(op.Key)
+		return result{Deleted: &deleted}, nil
+	case "delete_range":
+		deleted := tx.DeleteRange(op.Start, op.End)
+		return result{Deleted: &deleted}, nil
+	case "check":
+		val, ok := tx.Get(op.Key)
+		if op.Absent && ok || !op.Absent && (!ok || !bytes.Equal(val, op.Value)) {
+			return result{}, &httpError{http.StatusConflict, fmt.Sprintf("check of key %q failed", op.Key)}
+		}
+		return result{}, nil
+	}
+	return result{}, badRequest("unknown op %q", op.Op)
+}
+
+func (a *api) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.db.Stats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *api) check(w http.ResponseWriter, r *http.Request) {
+	if err := a.db.Check(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"ok": false, "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
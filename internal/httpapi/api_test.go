@@ -0,0 +1,266 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siluk00/db.git/internal/btree"
+)
+
+func startAPI(t *testing.T) (*btree.KV, string) {
+	t.Helper()
+	db := &btree.KV{InMemory: true, SweepInterval: -1}
+	require.NoError(t, db.Open())
+	srv := httptest.NewServer(NewHandler(db))
+	t.Cleanup(func() {
+		srv.Close()
+		db.Close()
+	})
+	return db, srv.URL
+}
+
+// sends body as JSON and decodes the reply into a map, returns the status
+func call(t *testing.T, method, url string, body any) (int, map[string]any) {
+	t.Helper()
+	var in io.Reader
+	if s, ok := body.(string); ok {
+		in = bytes.NewBufferString(s)
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		in = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, in)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	reply := map[string]any{}
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if resp.Header.Get("Content-Type") == "application/json" {
+		require.NoError(t, json.Unmarshal(data, &reply), string(data))
+	}
+	return resp.StatusCode, reply
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func path(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func TestAPIKeys(t *testing.T) {
+	_, url := startAPI(t)
+	key := "bin\x00\xff/?key"
+
+	code, reply := call(t, "GET", url+"/kv/"+path(key), nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "key not found", reply["error"])
+
+	code, _ = call(t, "PUT", url+"/kv/"+path(key), map[string]any{"value": []byte("val\x00ue")})
+	assert.Equal(t, http.StatusNoContent, code)
+	code, reply = call(t, "GET", url+"/kv/"+path(key), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"key": b64(key), "value": b64("val\x00ue")}, reply)
+
+	// padded keys are accepted
+	code, _ = call(t, "GET", url+"/kv/"+base64.URLEncoding.EncodeToString([]byte(key)), nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = call(t, "PUT", url+"/kv/"+path("ttl"), map[string]any{"value": []byte("v"), "ttl_ms": 60000})
+	assert.Equal(t, http.StatusNoContent, code)
+	_, reply = call(t, "GET", url+"/kv/"+path("ttl"), nil)
+	assert.InDelta(t, 60000, reply["ttl_ms"], 1000)
+
+	code, reply = call(t, "DELETE", url+"/kv/"+path(key), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, reply["deleted"])
+	_, reply = call(t, "DELETE", url+"/kv/"+path(key), nil)
+	assert.Equal(t, false, reply["deleted"])
+
+	// bad requests
+	code, _ = call(t, "GET", url+"/kv/not*base64", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "PUT", url+"/kv/"+path("k"), `{"value": "dg==", "tll_ms": 5}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "PUT", url+"/kv/"+path("k"), `{"value": 5}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "PUT", url+"/kv/"+path("k"), map[string]any{"value": []byte("v"), "ttl_ms": -1})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "PUT", url+"/kv/"+path("k"), map[string]any{"value": []byte("v"), "ttl_ms": MAX_TTL_MS + 1})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, reply = call(t, "PUT", url+"/kv/"+path(string(make([]byte, btree.BTREE_MAX_KEY_SIZE+1))), map[string]any{})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, reply["error"], "key too large")
+	code, _ = call(t, "POST", url+"/kv/"+path("k"), nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestAPIScan(t *testing.T) {
+	db, url := startAPI(t)
+	for i := 0; i < 250; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("a%03d", i)), []byte{byte(i)}))
+	}
+	require.NoError(t, db.Set([]byte("b"), []byte("b")))
+	require.NoError(t, db.Set([]byte("a\xff"), []byte("ff")))
+
+	// pages through the scan, returns the keys
+	scan := func(query string) []string {
+		keys := []string{}
+		cursor := ""
+		for {
+			code, reply := call(t, "GET", url+"/kv?"+query+cursor, nil)
+			require.Equal(t, http.StatusOK, code, reply)
+			for _, item := range reply["items"].([]any) {
+				key, err := base64.StdEncoding.DecodeString(item.(map[string]any)["key"].(string))
+				require.NoError(t, err)
+				keys = append(keys, string(key))
+			}
+			if reply["cursor"] == nil {
+				return keys
+			}
+			cursor = "&cursor=" + reply["cursor"].(string)
+		}
+	}
+
+	keys := scan("")
+	assert.Len(t, keys, 252)
+	assert.Equal(t, []string{"a000", "a001"}, keys[:2])
+	assert.Equal(t, []string{"a\xff", "b"}, keys[250:])
+	assert.Len(t, scan("limit=7"), 252)
+	assert.Len(t, scan("limit=1000"), 252)
+
+	keys = scan("prefix=" + path("a1") + "&limit=30")
+	assert.Len(t, keys, 100)
+	assert.Equal(t, "a100", keys[0])
+	assert.Equal(t, "a199", keys[99])
+	assert.Equal(t, []string{"a\xff"}, scan("prefix="+path("a\xff")))
+	assert.Equal(t, []string{"a010", "a011"}, scan("start="+path("a010")+"&end="+path("a012")))
+
+	_, reply := call(t, "GET", url+"/kv?limit=2", nil)
+	items := reply["items"].([]any)
+	require.Len(t, items, 2)
+	assert.Equal(t, b64("\x01"), items[1].(map[string]any)["value"])
+	assert.Equal(t, path("a002"), reply["cursor"])
+
+	code, _ := call(t, "GET", url+"/kv?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "GET", url+"/kv?prefix=YQ&start=YQ", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "GET", url+"/kv?cursor=**", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAPIBatchAndTx(t *testing.T) {
+	db, url := startAPI(t)
+
+	code, reply := call(t, "POST", url+"/batch", map[string]any{"ops": []map[string]any{
+		{"op": "put", "key": []byte("a"), "value": []byte("1")},
+		{"op": "put", "key": []byte("b"), "value": []byte("2"), "ttl_ms": 60000},
+		{"op": "put", "key": []byte("c"), "value": []byte("3")},
+		{"op": "put", "key": []byte("d"), "value": []byte("4")},
+		{"op": "delete", "key": []byte("a")},
+		{"op": "delete_range", "start": []byte("c"), "end": []byte("d")},
+	}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(6), reply["applied"])
+	assert.Equal(t, 2, db.Count(nil, nil))
+
+	// reads belong in /tx
+	code, _ = call(t, "POST", url+"/batch", map[string]any{"ops": []map[string]any{{"op": "get", "key": []byte("b")}}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	// a failed op commits nothing
+	code, reply = call(t, "POST", url+"/batch", map[string]any{"ops": []map[string]any{
+		{"op": "put", "key": []byte("x"), "value": []byte("1")},
+		{"op": "put", "value": []byte("1")},
+	}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, reply["error"], "op 1: empty key")
+	_, ok := db.Get([]byte("x"))
+	assert.False(t, ok)
+
+	code, reply = call(t, "POST", url+"/tx", map[string]any{"ops": []map[string]any{
+		{"op": "check", "key": []byte("b"), "value": []byte("2")},
+		{"op": "check", "key": []byte("a"), "absent": true},
+		{"op": "put", "key": []byte("a"), "value": []byte("new")},
+		{"op": "get", "key": []byte("a")},
+		{"op": "get", "key": []byte("nope")},
+		{"op": "delete", "key": []byte("b")},
+	}})
+	assert.Equal(t, http.StatusOK, code, reply)
+	assert.Equal(t, []any{
+		map[string]any{},
+		map[string]any{},
+		map[string]any{},
+		map[string]any{"found": true, "value": b64("new")},
+		map[string]any{"found": false},
+		map[string]any{"deleted": true},
+	}, reply["results"])
+
+	// a failed check rolls back the transaction
+	code, reply = call(t, "POST", url+"/tx", map[string]any{"ops": []map[string]any{
+		{"op": "delete", "key": []byte("a")},
+		{"op": "check", "key": []byte("a"), "value": []byte("new")},
+	}})
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, reply["error"], "op 1: check of key")
+	val, _ := db.Get([]byte("a"))
+	assert.Equal(t, []byte("new"), val)
+
+	code, _ = call(t, "POST", url+"/batch", map[string]any{"ops": []map[string]any{
+		{"op": "put", "key": []byte("a"), "value": []byte("1"), "ttl_ms": MAX_TTL_MS + 1},
+	}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "POST", url+"/tx", map[string]any{"ops": []map[string]any{{"op": "merge"}}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, "POST", url+"/tx", `{"ops": [`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAPIStatsAndCheck(t *testing.T) {
+	db, url := startAPI(t)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")))
+	}
+
+	code, reply := call(t, "GET", url+"/stats", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(100), reply["Keys"])
+	assert.Equal(t, float64(101), reply["Commits"]) // opening the database commits once
+
+	code, reply = call(t, "GET", url+"/check", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"ok": true}, reply)
+}
+
+func TestAPIReadOnly(t *testing.T) {
+	file := t.TempDir() + "/kv.db"
+	db := &btree.KV{Path: file}
+	require.NoError(t, db.Open())
+	require.NoError(t, db.Set([]byte("k"), []byte("v")))
+	require.NoError(t, db.Close())
+
+	db = &btree.KV{Path: file, ReadOnly: true}
+	require.NoError(t, db.Open())
+	defer db.Close()
+	srv := httptest.NewServer(NewHandler(db))
+	defer srv.Close()
+
+	code, _ := call(t, "GET", srv.URL+"/kv/"+path("k"), nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(t, "PUT", srv.URL+"/kv/"+path("k"), map[string]any{"value": []byte("v2")})
+	assert.Equal(t, http.StatusForbidden, code)
+}
@@ -0,0 +1,191 @@
+// Package tuple encodes tuples of values into keys whose byte order is the order of the tuples
+// so composite keys can be compared with bytes.Compare like every key of the tree
+package tuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// every element starts with a type code, elements of different types sort by their code
+// | code | payload |
+// | 1B   | ...     |
+// nil, false and true have no payload
+// int64, uint64 and float64 -> 8B big endian with the sign handled so that the bytes sort like the numbers
+// string and []byte -> the bytes with 0x00 escaped as 0x00 0xff, then a 0x00 terminator
+//
+// a tuple is its elements one after another, a tuple that is a prefix of another sorts before it
+// the codes are below 0xff so a terminator followed by the next element sorts before an escaped 0x00
+const (
+	CODE_NIL    = 0x00
+	CODE_FALSE  = 0x01
+	CODE_TRUE   = 0x02
+	CODE_INT    = 0x03
+	CODE_UINT   = 0x04
+	CODE_FLOAT  = 0x05
+	CODE_STRING = 0x06
+	CODE_BYTES  = 0x07
+)
+
+const (
+	escByte   = 0x00
+	escSuffix = 0xff
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported tuple element type")
+	ErrBadEncoding     = errors.New("invalid tuple encoding")
+)
+
+// Encode encodes the elements, they must be nil, bool, int64, uint64, float64, string or []byte
+func Encode(elems ...any) ([]byte, error) {
+	return Append(nil, elems...)
+}
+
+// Append appends the encoding of the elements to dst
+func Append(dst []byte, elems ...any) ([]byte, error) {
+	for i, elem := range elems {
+		switch v := elem.(type) {
+		case nil:
+			dst = append(dst, CODE_NIL)
+		case bool:
+			if v {
+				dst = append(dst, CODE_TRUE)
+			} else {
+				dst = append(dst, CODE_FALSE)
+			}
+		case int64:
+			// flipping the sign bit puts the negative numbers first
+			dst = binary.BigEndian.AppendUint64(append(dst, CODE_INT), uint64(v)^(1<<63))
+		case uint64:
+			dst = binary.BigEndian.AppendUint64(append(dst, CODE_UINT), v)
+		case float64:
+			dst = binary.BigEndian.AppendUint64(append(dst, CODE_FLOAT), floatBits(v))
+		case string:
+			dst = appendEscaped(append(dst, CODE_STRING), []byte(v))
+		case []byte:
+			dst = appendEscaped(append(dst, CODE_BYTES), v)
+		default:
+			return nil, fmt.Errorf("%w: element %d is %T", ErrUnsupportedType, i, elem)
+		}
+	}
+	return dst, nil
+}
+
+// MustEncode is Encode for elements known to be supported, it panics otherwise
+func MustEncode(elems ...any) []byte {
+	key, err := Encode(elems...)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Decode returns the elements of an encoded tuple with the types they were encoded with
+// a nil []byte comes back as an empty one
+func Decode(key []byte) ([]any, error) {
+	elems := []any{}
+	for len(key) > 0 {
+		code := key[0]
+		key = key[1:]
+		switch code {
+		case CODE_NIL:
+			elems = append(elems, nil)
+		case CODE_FALSE, CODE_TRUE:
+			elems = append(elems, code == CODE_TRUE)
+		case CODE_INT, CODE_UINT, CODE_FLOAT:
+			if len(key) < 8 {
+				return nil, fmt.Errorf("%w: truncated number at element %d", ErrBadEncoding, len(elems))
+			}
+			u := binary.BigEndian.Uint64(key)
+			key = key[8:]
+			switch code {
+			case CODE_INT:
+				elems = append(elems, int64(u^(1<<63)))
+			case CODE_UINT:
+				elems = append(elems, u)
+			default:
+				elems = append(elems, floatFromBits(u))
+			}
+		case CODE_STRING, CODE_BYTES:
+			raw, rest, err := readEscaped(key)
+			if err != nil {
+				return nil, fmt.Errorf("%w: element %d: %v", ErrBadEncoding, len(elems), err)
+			}
+			key = rest
+			if code == CODE_STRING {
+				elems = append(elems, string(raw))
+			} else {
+				elems = append(elems, raw)
+			}
+		default:
+			return nil, fmt.Errorf("%w: bad type code 0x%02x at element %d", ErrBadEncoding, code, len(elems))
+		}
+	}
+	return elems, nil
+}
+
+// PrefixEnd returns the first key after every key starting with prefix, nil if there's none
+// a scan of [prefix, PrefixEnd(prefix)) visits the tuples that begin with the encoded elements
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// positive numbers get the sign bit set and negative ones get every bit flipped
+// so -Inf < ... < -0 < +0 < ... < +Inf, NaNs go to the ends according to their sign bit
+func floatBits(f float64) uint64 {
+	u := math.Float64bits(f)
+	if u&(1<<63) != 0 {
+		return ^u
+	}
+	return u | 1<<63
+}
+
+func floatFromBits(u uint64) float64 {
+	if u&(1<<63) != 0 {
+		return math.Float64frombits(u &^ (1 << 63))
+	}
+	return math.Float64frombits(^u)
+}
+
+func appendEscaped(dst, raw []byte) []byte {
+	for {
+		i := bytes.IndexByte(raw, escByte)
+		if i < 0 {
+			break
+		}
+		dst = append(dst, raw[:i+1]...)
+		dst = append(dst, escSuffix)
+		raw = raw[i+1:]
+	}
+	dst = append(dst, raw...)
+	return append(dst, escByte)
+}
+
+// returns the unescaped bytes and what comes after the terminator
+func readEscaped(key []byte) ([]byte, []byte, error) {
+	raw := []byte{}
+	for {
+		i := bytes.IndexByte(key, escByte)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("missing terminator")
+		}
+		raw = append(raw, key[:i]...)
+		if i+1 < len(key) && key[i+1] == escSuffix {
+			raw = append(raw, escByte)
+			key = key[i+2:]
+			continue
+		}
+		return raw, key[i+1:], nil
+	}
+}
@@ -0,0 +1,283 @@
+package tuple
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the order the encoding must give, numbers are compared by value and -0 sorts before +0
+func compareTuples(a, b []any) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareElems(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func compareElems(a, b any) int {
+	if c := cmp.Compare(typeCode(a), typeCode(b)); c != 0 {
+		return c
+	}
+	switch a := a.(type) {
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case uint64:
+		return cmp.Compare(a, b.(uint64))
+	case float64:
+		return compareFloats(a, b.(float64))
+	case string:
+		return cmp.Compare(a, b.(string))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	}
+	return 0 // nil, false and true only have their code
+}
+
+func compareFloats(a, b float64) int {
+	// negative NaNs first, positive NaNs last
+	rank := func(f float64) int {
+		switch {
+		case !math.IsNaN(f):
+			return 0
+		case math.Signbit(f):
+			return -1
+		}
+		return 1
+	}
+	if c := cmp.Compare(rank(a), rank(b)); c != 0 || rank(a) != 0 {
+		return c
+	}
+	if a == b && math.Signbit(a) != math.Signbit(b) {
+		if math.Signbit(a) {
+			return -1
+		}
+		return 1
+	}
+	return cmp.Compare(a, b)
+}
+
+func typeCode(elem any) int {
+	key, err := Encode(elem)
+	if err != nil {
+		panic(err)
+	}
+	return int(key[0])
+}
+
+func sign(c int) int {
+	return cmp.Compare(c, 0)
+}
+
+// builds a tuple out of fuzz input, each element is a type byte and its payload
+func tupleFrom(data []byte) []any {
+	elems := []any{}
+	for len(data) > 0 {
+		kind := data[0] % 8
+		data = data[1:]
+		number := func() uint64 {
+			var buf [8]byte
+			n := copy(buf[:], data)
+			data = data[n:]
+			return binary.BigEndian.Uint64(buf[:])
+		}
+		text := func() []byte {
+			n := 0
+			if len(data) > 0 {
+				n = min(int(data[0]%8), len(data)-1)
+				data = data[1:]
+			}
+			text := bytes.Clone(data[:n])
+			data = data[n:]
+			return text
+		}
+		switch kind {
+		case 0:
+			elems = append(elems, nil)
+		case 1:
+			elems = append(elems, false)
+		case 2:
+			elems = append(elems, true)
+		case 3:
+			elems = append(elems, int64(number()))
+		case 4:
+			elems = append(elems, number())
+		case 5:
+			elems = append(elems, math.Float64frombits(number()))
+		case 6:
+			elems = append(elems, string(text()))
+		case 7:
+			elems = append(elems, text())
+		}
+	}
+	return elems
+}
+
+func checkOrder(t *testing.T, a, b []any) {
+	t.Helper()
+	ka, err := Encode(a...)
+	require.NoError(t, err)
+	kb, err := Encode(b...)
+	require.NoError(t, err)
+	assert.Equal(t, sign(compareTuples(a, b)), bytes.Compare(ka, kb), "%v %v", a, b)
+}
+
+func checkRoundTrip(t *testing.T, elems []any) {
+	t.Helper()
+	key, err := Encode(elems...)
+	require.NoError(t, err)
+	decoded, err := Decode(key)
+	require.NoError(t, err)
+	require.Len(t, decoded, len(elems))
+	for i := range elems {
+		// NaNs are not equal to themselves
+		if f, ok := elems[i].(float64); ok {
+			assert.Equal(t, math.Float64bits(f), math.Float64bits(decoded[i].(float64)))
+			continue
+		}
+		assert.Equal(t, elems[i], decoded[i])
+	}
+}
+
+func TestTupleOrder(t *testing.T) {
+	sorted := [][]any{
+		{},
+		{nil},
+		{nil, nil},
+		{false},
+		{true},
+		{int64(math.MinInt64)},
+		{int64(-1)},
+		{int64(-1), "a"},
+		{int64(0)},
+		{int64(1)},
+		{int64(math.MaxInt64)},
+		{uint64(0)},
+		{uint64(math.MaxUint64)},
+		{math.Inf(-1)},
+		{-1.5},
+		{-math.SmallestNonzeroFloat64},
+		{math.Copysign(0, -1)},
+		{0.0},
+		{math.SmallestNonzeroFloat64},
+		{2.5},
+		{math.Inf(1)},
+		{math.NaN()},
+		{""},
+		{"", nil},
+		{"", "a"},
+		{"\x00"},
+		{"\x00", nil},
+		{"\x00\x00"},
+		{"\x00\xff"},
+		{"\x01"},
+		{"a"},
+		{"a", int64(-5)},
+		{"a", int64(3)},
+		{"a\x00"},
+		{"ab"},
+		{"b"},
+		{[]byte{}},
+		{[]byte{0}},
+		{[]byte{0xff}},
+	}
+	for i := range sorted {
+		checkRoundTrip(t, sorted[i])
+		for j := range sorted {
+			checkOrder(t, sorted[i], sorted[j])
+		}
+	}
+}
+
+func TestTupleErrors(t *testing.T) {
+	_, err := Encode("a", 1)
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+	assert.Panics(t, func() { MustEncode(int32(1)) })
+
+	for _, key := range [][]byte{
+		{CODE_INT, 1, 2},
+		{CODE_STRING, 'a'},
+		{CODE_BYTES, 'a', 0, 0xff},
+		{0x42},
+	} {
+		_, err := Decode(key)
+		assert.ErrorIs(t, err, ErrBadEncoding, "%x", key)
+	}
+}
+
+func TestTuplePrefixEnd(t *testing.T) {
+	prefix := MustEncode("users", int64(7))
+	end := PrefixEnd(prefix)
+	for _, elems := range [][]any{
+		{"users", int64(7)},
+		{"users", int64(7), nil},
+		{"users", int64(7), "\xff\xff"},
+		{"users", int64(7), []byte{0xff}},
+	} {
+		key := MustEncode(elems...)
+		assert.True(t, bytes.Compare(prefix, key) <= 0 && bytes.Compare(key, end) < 0, "%v", elems)
+	}
+	assert.GreaterOrEqual(t, bytes.Compare(MustEncode("users", int64(8)), end), 0)
+	assert.Nil(t, PrefixEnd([]byte{0xff, 0xff}))
+	assert.Equal(t, []byte{1}, PrefixEnd([]byte{0, 0xff}))
+}
+
+func FuzzTupleOrder(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 0, 0, 0, 0, 0, 1}, []byte{3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{6, 2, 'a', 0}, []byte{6, 1, 'a', 0})
+	f.Add([]byte{5, 0x80}, []byte{5, 0})
+	f.Add([]byte{7, 3, 0, 0xff, 1}, []byte{7, 2, 0, 0xff, 6, 0})
+	f.Fuzz(func(t *testing.T, a, b []byte) {
+		ta, tb := tupleFrom(a), tupleFrom(b)
+		checkRoundTrip(t, ta)
+		checkOrder(t, ta, tb)
+	})
+}
+
+func FuzzInt64Order(f *testing.F) {
+	f.Add(int64(-1), int64(0))
+	f.Add(int64(math.MinInt64), int64(math.MaxInt64))
+	f.Fuzz(func(t *testing.T, a, b int64) {
+		checkOrder(t, []any{a}, []any{b})
+	})
+}
+
+func FuzzFloat64Order(f *testing.F) {
+	f.Add(-1.0, 1.0)
+	f.Add(math.Copysign(0, -1), 0.0)
+	f.Add(math.Inf(-1), -math.MaxFloat64)
+	f.Fuzz(func(t *testing.T, a, b float64) {
+		checkRoundTrip(t, []any{a})
+		checkOrder(t, []any{a}, []any{b})
+	})
+}
+
+func FuzzStringOrder(f *testing.F) {
+	f.Add("a", "a\x00")
+	f.Add("\x00\xff", "\x00")
+	f.Fuzz(func(t *testing.T, a, b string) {
+		checkRoundTrip(t, []any{a, b})
+		checkOrder(t, []any{a, int64(1)}, []any{b, int64(0)})
+	})
+}
+
+// every key Decode accepts is the encoding of what it returns
+func FuzzDecode(f *testing.F) {
+	f.Add(MustEncode("a\x00b", int64(-3), nil, 1.5, []byte{0}, true))
+	f.Add([]byte{CODE_STRING, 0, 0xff})
+	f.Fuzz(func(t *testing.T, key []byte) {
+		elems, err := Decode(key)
+		if err != nil {
+			return
+		}
+		again, err := Encode(elems...)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(key, again), "%x %x", key, again)
+	})
+}